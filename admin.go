@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const MAINTENANCE_ADMIN_NAME = "maintenance"
+
+// Authenticate a request to the administration api, the X-Mt-Secret header
+// must hold the maintenance secret or one of the named admin tokens. The name
+// of the token ("maintenance" for the maintenance secret) is recorded in audit
+// metadata, ex: the creator of a ban.
+func (sfui *SfUI) authenticateAdmin(r *http.Request) (adminName string, ok bool) {
+	MtSecret := r.Header.Get("X-Mt-Secret")
+	if MtSecret == "" {
+		return "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(MtSecret), []byte(sfui.MaintenanceSecret)) == 1 {
+		return MAINTENANCE_ADMIN_NAME, true
+	}
+
+	for name, token := range sfui.AdminTokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(MtSecret), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// Record a change made through the administration api
+func logAdminAction(adminName string, action string, target string) {
+	MLogger.LogEvent(Metric{
+		Type:   METRIC_ADMIN_ACTION,
+		Admin:  adminName,
+		Action: action,
+		Target: target,
+	}, "")
+}
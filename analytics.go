@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rolling usage aggregates kept in memory and persisted periodically, for
+// deployments without a metric sink. Events are counted in hourly buckets,
+// in total and per country and endpoint, buckets older than the retention
+// are dropped.
+const (
+	ANALYTICS_GRANULARITY_HOUR = "hour"
+	ANALYTICS_GRANULARITY_DAY  = "day"
+
+	ANALYTICS_DIMENSION_TOTAL    = "total"
+	ANALYTICS_DIMENSION_COUNTRY  = "country"
+	ANALYTICS_DIMENSION_ENDPOINT = "endpoint"
+
+	ANALYTICS_DEFAULT_RANGE = 24 * time.Hour
+)
+
+type AnalyticsCounts struct {
+	Logins         int     `json:"logins"`
+	NewAccounts    int     `json:"new_accounts"`
+	Sessions       int     `json:"sessions"`        // Sessions that ended
+	SessionSeconds float64 `json:"session_seconds"` // Total duration of the sessions that ended
+}
+
+type AnalyticsBucket struct {
+	Time         time.Time `json:"time"` // Start of the hour/day, UTC
+	PeakSessions int       `json:"peak_sessions"`
+	AnalyticsCounts
+	Countries map[string]*AnalyticsCounts `json:"countries"`
+	Endpoints map[string]*AnalyticsCounts `json:"endpoints"`
+}
+
+type UsageAnalytics struct {
+	path           string
+	retention      time.Duration
+	mu             *sync.Mutex
+	buckets        map[int64]*AnalyticsBucket // Unix time of the hour -> bucket
+	activeSessions int
+	dirty          bool
+}
+
+var Analytics = UsageAnalytics{}
+
+func (analytics *UsageAnalytics) Init(sfui *SfUI) {
+	if !sfui.EnableAnalytics {
+		return
+	}
+
+	analytics.path = sfui.AnalyticsPath
+	analytics.retention = time.Hour * 24 * time.Duration(sfui.AnalyticsRetention)
+	analytics.buckets = make(map[int64]*AnalyticsBucket)
+
+	// Save would overwrite a file that could not be loaded
+	if data, err := os.ReadFile(analytics.path); err == nil {
+		buckets := []*AnalyticsBucket{}
+		if jerr := json.Unmarshal(data, &buckets); jerr != nil {
+			buckets = nil
+			if aside, merr := moveAside(analytics.path); merr != nil {
+				log.Fatalln("Failed to parse analytics,", jerr, ", and to move them aside,", merr)
+			} else {
+				log.Println("Failed to parse analytics, starting with empty ones, the file was moved to", aside, jerr)
+			}
+		}
+		for _, bucket := range buckets {
+			analytics.buckets[bucket.Time.Unix()] = bucket.copy() // copy() also fills in missing maps
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalln("Failed to read analytics,", err)
+	}
+
+	analytics.mu = &sync.Mutex{}
+	go analytics.periodicSave(time.Minute * time.Duration(sfui.AnalyticsSaveInterval))
+}
+
+func (analytics *UsageAnalytics) periodicSave(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		analytics.Save()
+	}
+}
+
+// Drop expired buckets and write the rest to disk, if anything changed
+func (analytics *UsageAnalytics) Save() error {
+	if analytics.mu == nil {
+		return nil
+	}
+
+	analytics.mu.Lock()
+	if !analytics.dirty {
+		analytics.mu.Unlock()
+		return nil
+	}
+	if analytics.retention > 0 {
+		cutoff := time.Now().Add(-analytics.retention).Unix()
+		for hour := range analytics.buckets {
+			if hour < cutoff {
+				delete(analytics.buckets, hour)
+			}
+		}
+	}
+	buckets := analytics.sortedBuckets(time.Time{}, time.Now().Add(time.Hour))
+	data, err := json.Marshal(buckets)
+	analytics.dirty = false
+	analytics.mu.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(analytics.path, data, 0600)
+	}
+	if err != nil {
+		log.Println("Failed to save analytics", err)
+	}
+	return err
+}
+
+// caller must hold the lock
+func (analytics *UsageAnalytics) currentBucket() *AnalyticsBucket {
+	hour := time.Now().UTC().Truncate(time.Hour)
+	bucket, ok := analytics.buckets[hour.Unix()]
+	if !ok {
+		bucket = newAnalyticsBucket(hour)
+		bucket.PeakSessions = analytics.activeSessions // sessions carried over from the previous hour
+		analytics.buckets[hour.Unix()] = bucket
+	}
+	analytics.dirty = true
+	return bucket
+}
+
+// Apply a change to the total and the country and endpoint counts of the
+// current hour
+func (analytics *UsageAnalytics) record(country string, endpoint string, update func(counts *AnalyticsCounts)) {
+	if analytics.mu == nil {
+		return
+	}
+	analytics.mu.Lock()
+	defer analytics.mu.Unlock()
+
+	bucket := analytics.currentBucket()
+	update(&bucket.AnalyticsCounts)
+	if country != "" {
+		update(countsOf(bucket.Countries, country))
+	}
+	if endpoint != "" {
+		update(countsOf(bucket.Endpoints, endpoint))
+	}
+}
+
+func countsOf(dimension map[string]*AnalyticsCounts, key string) *AnalyticsCounts {
+	counts, ok := dimension[key]
+	if !ok {
+		counts = &AnalyticsCounts{}
+		dimension[key] = counts
+	}
+	return counts
+}
+
+func (analytics *UsageAnalytics) RecordLogin(country string, endpoint string) {
+	analytics.record(country, endpoint, func(counts *AnalyticsCounts) { counts.Logins++ })
+}
+
+func (analytics *UsageAnalytics) RecordNewAccount(country string, endpoint string) {
+	analytics.record(country, endpoint, func(counts *AnalyticsCounts) { counts.NewAccounts++ })
+}
+
+// A master SSH connection was established
+func (analytics *UsageAnalytics) RecordSessionStart() {
+	if analytics.mu == nil {
+		return
+	}
+	analytics.mu.Lock()
+	defer analytics.mu.Unlock()
+
+	analytics.activeSessions++
+	if bucket := analytics.currentBucket(); analytics.activeSessions > bucket.PeakSessions {
+		bucket.PeakSessions = analytics.activeSessions
+	}
+}
+
+func (analytics *UsageAnalytics) RecordSessionEnd(country string, endpoint string, duration time.Duration) {
+	if analytics.mu == nil {
+		return
+	}
+	analytics.mu.Lock()
+	if analytics.activeSessions > 0 {
+		analytics.activeSessions--
+	}
+	analytics.mu.Unlock()
+
+	analytics.record(country, endpoint, func(counts *AnalyticsCounts) {
+		counts.Sessions++
+		counts.SessionSeconds += duration.Seconds()
+	})
+}
+
+// Copies of the buckets in [from, to), oldest first. caller must hold the lock
+func (analytics *UsageAnalytics) sortedBuckets(from time.Time, to time.Time) []*AnalyticsBucket {
+	buckets := []*AnalyticsBucket{}
+	for _, bucket := range analytics.buckets {
+		if !bucket.Time.Before(from) && bucket.Time.Before(to) {
+			buckets = append(buckets, bucket.copy())
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Time.Before(buckets[j].Time) })
+	return buckets
+}
+
+func (bucket *AnalyticsBucket) copy() *AnalyticsBucket {
+	copied := newAnalyticsBucket(bucket.Time)
+	copied.merge(bucket)
+	return copied
+}
+
+// Add the counts of other to the bucket, peaks are combined with max
+func (bucket *AnalyticsBucket) merge(other *AnalyticsBucket) {
+	if other.PeakSessions > bucket.PeakSessions {
+		bucket.PeakSessions = other.PeakSessions
+	}
+	bucket.AnalyticsCounts.add(&other.AnalyticsCounts)
+	for key, counts := range other.Countries {
+		countsOf(bucket.Countries, key).add(counts)
+	}
+	for key, counts := range other.Endpoints {
+		countsOf(bucket.Endpoints, key).add(counts)
+	}
+}
+
+func (counts *AnalyticsCounts) add(other *AnalyticsCounts) {
+	counts.Logins += other.Logins
+	counts.NewAccounts += other.NewAccounts
+	counts.Sessions += other.Sessions
+	counts.SessionSeconds += other.SessionSeconds
+}
+
+// Buckets in [from, to), grouped by hour or day, and the totals over them
+func (analytics *UsageAnalytics) Report(from time.Time, to time.Time, granularity string) AnalyticsReport {
+	analytics.mu.Lock()
+	hourly := analytics.sortedBuckets(from, to)
+	analytics.mu.Unlock()
+
+	report := AnalyticsReport{
+		From:        from.UTC(),
+		To:          to.UTC(),
+		Granularity: granularity,
+		Buckets:     []*AnalyticsBucket{},
+		Totals:      newAnalyticsBucket(from.UTC()),
+	}
+	for _, bucket := range hourly {
+		if granularity == ANALYTICS_GRANULARITY_DAY {
+			day := bucket.Time.Truncate(24 * time.Hour)
+			if n := len(report.Buckets); n == 0 || !report.Buckets[n-1].Time.Equal(day) {
+				report.Buckets = append(report.Buckets, newAnalyticsBucket(day))
+			}
+			report.Buckets[len(report.Buckets)-1].merge(bucket)
+		} else {
+			report.Buckets = append(report.Buckets, bucket)
+		}
+		report.Totals.merge(bucket)
+	}
+	return report
+}
+
+func newAnalyticsBucket(start time.Time) *AnalyticsBucket {
+	return &AnalyticsBucket{
+		Time:      start,
+		Countries: make(map[string]*AnalyticsCounts),
+		Endpoints: make(map[string]*AnalyticsCounts),
+	}
+}
+
+type AnalyticsReport struct {
+	From        time.Time          `json:"from"`
+	To          time.Time          `json:"to"`
+	Granularity string             `json:"granularity"`
+	Totals      *AnalyticsBucket   `json:"totals"` // Time is From, PeakSessions the highest peak in the range
+	Buckets     []*AnalyticsBucket `json:"buckets"`
+}
+
+// Parse a time given as RFC3339 or a date (2006-01-02, UTC)
+func parseAnalyticsTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// Supports the following query parameters
+//
+//	from        : start of the range, RFC3339 or 2006-01-02 (default 24 hours ago)
+//	to          : end of the range, exclusive (default now)
+//	granularity : hour (default) | day
+//	format      : json (default) | csv
+func (sfui *SfUI) handleAnalytics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	if _, ok := sfui.authenticateAdmin(r); !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"status":"denied"}`))
+		return
+	}
+	if Analytics.mu == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"analytics disabled"}`))
+		return
+	}
+
+	query := r.URL.Query()
+	now := time.Now()
+	to, terr := parseAnalyticsTime(query.Get("to"), now)
+	from, ferr := parseAnalyticsTime(query.Get("from"), to.Add(-ANALYTICS_DEFAULT_RANGE))
+	if terr != nil || ferr != nil || !from.Before(to) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"invalid time range"}`))
+		return
+	}
+	// include the bucket from falls into
+	from = from.UTC().Truncate(time.Hour)
+
+	granularity := query.Get("granularity")
+	if granularity == "" {
+		granularity = ANALYTICS_GRANULARITY_HOUR
+	}
+	if granularity != ANALYTICS_GRANULARITY_HOUR && granularity != ANALYTICS_GRANULARITY_DAY {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"status":"granularity must be hour or day"}`))
+		return
+	}
+
+	report := Analytics.Report(from, to, granularity)
+
+	if query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="sfui-analytics-%s.csv"`, from.Format("2006-01-02")))
+		w.WriteHeader(http.StatusOK)
+		writeAnalyticsCSV(w, report)
+		return
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"status":"error"}`))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// One row per bucket and dimension (total, country, endpoint)
+func writeAnalyticsCSV(w http.ResponseWriter, report AnalyticsReport) {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"time", "dimension", "key", "logins", "new_accounts", "sessions",
+		"session_seconds", "avg_session_seconds", "peak_sessions"})
+
+	row := func(bucket *AnalyticsBucket, dimension string, key string, counts *AnalyticsCounts, peak string) {
+		average := 0.0
+		if counts.Sessions > 0 {
+			average = counts.SessionSeconds / float64(counts.Sessions)
+		}
+		writer.Write([]string{
+			bucket.Time.Format(time.RFC3339), dimension, key,
+			strconv.Itoa(counts.Logins), strconv.Itoa(counts.NewAccounts), strconv.Itoa(counts.Sessions),
+			strconv.FormatFloat(counts.SessionSeconds, 'f', 0, 64), strconv.FormatFloat(average, 'f', 0, 64), peak,
+		})
+	}
+
+	for _, bucket := range report.Buckets {
+		row(bucket, ANALYTICS_DIMENSION_TOTAL, "", &bucket.AnalyticsCounts, strconv.Itoa(bucket.PeakSessions))
+		for _, dimension := range []struct {
+			name   string
+			counts map[string]*AnalyticsCounts
+		}{
+			{ANALYTICS_DIMENSION_COUNTRY, bucket.Countries},
+			{ANALYTICS_DIMENSION_ENDPOINT, bucket.Endpoints},
+		} {
+			keys := make([]string, 0, len(dimension.counts))
+			for key := range dimension.counts {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				row(bucket, dimension.name, key, dimension.counts[key], "") // peaks are only tracked in total
+			}
+		}
+	}
+	writer.Flush()
+}
@@ -2,50 +2,377 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/netip"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	BAN_DB_VERSION         = 2
+	BAN_DB_COMPACT_DELAY   = 5 * time.Minute  // interval at which hit counters are persisted and expired bans dropped
+	BAN_DB_RELOAD_INTERVAL = 10 * time.Second // interval at which the file is checked for external edits
+
+	BAN_SOURCE_DB        = "ban_db"    // manual and automatic bans
+	BAN_SOURCE_BLOCKLIST = "blocklist" // created_by of entries from external blocklists
+)
+
+type BanEntry struct {
+	Reason    string     `json:"reason"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nil for a permanent ban
+	CreatedBy string     `json:"created_by"`           // name of the admin token used to create the ban
+	Hits      int64      `json:"hits"`                 // no of requests rejected due to this ban
+	LastHit   *time.Time `json:"last_hit,omitempty"`
+}
+
+func (entry *BanEntry) Expired() bool {
+	return entry.ExpiresAt != nil && time.Now().After(*entry.ExpiresAt)
+}
+
+// Ban store, safe for concurrent use. Every change is written through to
+// disk atomically, the file is reloaded if it is edited externally.
 type SFBanDB struct {
-	Addresses map[string]string `json:"addresses"` // IP->reason
+	mu      *sync.Mutex
+	Version int                  `json:"version"`
+	Entries map[string]*BanEntry `json:"entries"` // IP or CIDR prefix->ban
+
+	prefixes    map[string]netip.Prefix // parsed CIDR entries of Entries, kept in sync with it
+	path        string
+	fileMu      *sync.Mutex // serializes writes to path
+	lastModTime time.Time   // mod time of path after our last write / load
+	failedMod   time.Time   // mod time of the last edit that could not be parsed, to log it once
+	dirty       bool        // hit counters changed since the last write
+}
+
+// Format used before version 2, IP->reason
+type legacyBanDB struct {
+	Addresses map[string]string `json:"addresses"`
 }
 
 var BanDB = SFBanDB{}
 
-func (banDB *SFBanDB) Init() {
-	banDB.Addresses = make(map[string]string)
-	data, err := os.ReadFile("banDB.json")
-	if err == nil {
-		json.Unmarshal(data, banDB)
+func (banDB *SFBanDB) Init(path string) {
+	banDB.mu = &sync.Mutex{}
+	banDB.fileMu = &sync.Mutex{}
+	banDB.Version = BAN_DB_VERSION
+	banDB.setEntries(make(map[string]*BanEntry))
+	banDB.path = path
+
+	if fi, err := os.Stat(path); err == nil {
+		data, rerr := os.ReadFile(path)
+		if rerr != nil {
+			log.Println("Failed to read ban db", rerr)
+		} else if entries, migrated, perr := parseBanDB(data); perr != nil {
+			// Keep the file for the admin to fix, Save would overwrite it
+			if aside, merr := moveAside(path); merr != nil {
+				log.Fatalln("Failed to parse ban db,", perr, ", and to move it aside,", merr)
+			} else {
+				log.Println("Failed to parse ban db, starting with a empty one, the file was moved to", aside, perr)
+			}
+		} else {
+			banDB.setEntries(entries)
+			banDB.lastModTime = fi.ModTime()
+			if migrated {
+				banDB.Save() // persist in the current format
+			}
+		}
 	}
+
+	go banDB.periodicCompaction()
+	go banDB.watchFile()
 }
 
-func (banDB *SFBanDB) Save() {
-	banData, err := json.Marshal(BanDB)
+// Parse a stored ban db, migrates the legacy format
+func parseBanDB(data []byte) (entries map[string]*BanEntry, migrated bool, err error) {
+	entries = make(map[string]*BanEntry)
+
+	stored := SFBanDB{}
+	err = json.Unmarshal(data, &stored)
+	if err == nil && stored.Version >= BAN_DB_VERSION {
+		for entry, ban := range stored.Entries {
+			if ban != nil {
+				entries[entry] = ban
+			}
+		}
+		return entries, false, nil
+	}
+
+	// Migrate the legacy format, existing bans become permanent bans
+	legacy := legacyBanDB{}
+	if json.Unmarshal(data, &legacy) == nil {
+		for ip, reason := range legacy.Addresses {
+			entry, nerr := normalizeBanEntry(ip)
+			if nerr != nil {
+				entry = ip
+			}
+			entries[entry] = &BanEntry{
+				Reason:    reason,
+				CreatedAt: time.Now(),
+				CreatedBy: "migration",
+			}
+		}
+		log.Printf("Migrated %d bans from the legacy ban db format\n", len(legacy.Addresses))
+		return entries, true, nil
+	}
+
 	if err == nil {
-		os.WriteFile("banDB.json", banData, 0644)
+		err = fmt.Errorf("unsupported ban db version %d", stored.Version)
+	}
+	return nil, false, err
+}
+
+// Atomically write the ban db to disk
+func (banDB *SFBanDB) Save() error {
+	if banDB.mu == nil {
+		return nil
+	}
+
+	banDB.fileMu.Lock()
+	defer banDB.fileMu.Unlock()
+
+	banDB.mu.Lock()
+	banData, err := json.MarshalIndent(banDB, "", " ")
+	banDB.dirty = false
+	banDB.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if werr := writeFileAtomic(banDB.path, banData, 0644); werr != nil {
+		log.Println("Failed to save ban db", werr)
+		return werr
+	}
+
+	if fi, serr := os.Stat(banDB.path); serr == nil {
+		banDB.mu.Lock()
+		banDB.lastModTime = fi.ModTime()
+		banDB.mu.Unlock()
+	}
+	return nil
+}
+
+// Drop expired bans and persist hit counters
+func (banDB *SFBanDB) periodicCompaction() {
+	for {
+		time.Sleep(BAN_DB_COMPACT_DELAY)
+		banDB.compact()
+	}
+}
+
+func (banDB *SFBanDB) compact() {
+	banDB.mu.Lock()
+	changed := banDB.dirty
+	for entry, ban := range banDB.Entries {
+		if ban.Expired() {
+			log.Printf("ban on %s expired (reason: %s)\n", Privacy.LogIP(entry), ban.Reason)
+			banDB.delete(entry)
+			changed = true
+		}
+	}
+	banDB.mu.Unlock()
+
+	if changed {
+		banDB.Save()
+	}
+}
+
+// Reload the ban db when the file is modified by someone else, ex: a admin
+// editing it by hand. Hit counters of unchanged entries are carried over.
+func (banDB *SFBanDB) watchFile() {
+	for {
+		time.Sleep(BAN_DB_RELOAD_INTERVAL)
+		banDB.reloadIfModified()
+	}
+}
+
+// Returns whether the file was reloaded
+func (banDB *SFBanDB) reloadIfModified() bool {
+	banDB.fileMu.Lock()
+	defer banDB.fileMu.Unlock()
+
+	fi, err := os.Stat(banDB.path)
+	banDB.mu.Lock()
+	modified := err == nil && !fi.ModTime().Equal(banDB.lastModTime)
+	banDB.mu.Unlock()
+	if !modified {
+		return false
+	}
+
+	data, rerr := os.ReadFile(banDB.path)
+	if rerr != nil {
+		return false
+	}
+	entries, _, perr := parseBanDB(data)
+	if perr != nil {
+		// Keep the current bans, lastModTime is left as is so that the
+		// file is parsed again once it is fixed
+		if !fi.ModTime().Equal(banDB.failedMod) {
+			log.Println("Failed to parse the edited ban db, keeping the current bans,", perr)
+			banDB.failedMod = fi.ModTime()
+		}
+		return false
+	}
+
+	banDB.mu.Lock()
+	for entry, ban := range entries {
+		if existing, ok := banDB.Entries[entry]; ok && existing.CreatedAt.Equal(ban.CreatedAt) && existing.Hits > ban.Hits {
+			ban.Hits = existing.Hits
+			ban.LastHit = existing.LastHit
+		}
 	}
+	banDB.setEntries(entries)
+	banDB.lastModTime = fi.ModTime()
+	banDB.mu.Unlock()
+
+	log.Printf("Reloaded ban db from %s (%d entries)\n", banDB.path, len(entries))
+	return true
 }
 
 func (banDB *SFBanDB) IsBanned(ip string) (isBanned bool, reason string) {
-	if banDB.Addresses != nil {
-		reason, isBanned = banDB.Addresses[ip]
-		return isBanned, reason
+	if banDB.mu == nil {
+		return false, ""
+	}
+
+	banDB.mu.Lock()
+	ban := banDB.lookup(ip)
+	if ban != nil {
+		now := time.Now()
+		ban.Hits++
+		ban.LastHit = &now
+		banDB.dirty = true
+		isBanned, reason = true, ban.Reason
 	}
-	return false, ""
+	banDB.mu.Unlock()
+
+	// Blocklists and metrics have their own locks, don't hold ours for them
+	source := BAN_SOURCE_DB
+	if !isBanned {
+		isBanned, source, reason = Blocklists.Lookup(ip)
+		if !isBanned {
+			return false, reason
+		}
+	}
+	promBanHits.Inc(source)
+	MLogger.LogSampledEvent(Metric{Type: METRIC_BAN_HIT, Source: source, Reason: reason}, ip,
+		METRIC_BAN_HIT+"|"+source+"|"+ip)
+	return isBanned, reason
+}
+
+// Find a active ban matching the address, caller must hold the lock
+func (banDB *SFBanDB) lookup(ip string) *BanEntry {
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		if ban, ok := banDB.Entries[ip]; ok && !ban.Expired() {
+			return ban
+		}
+		return nil
+	}
+
+	if ban, ok := banDB.Entries[addr.String()]; ok && !ban.Expired() {
+		return ban
+	}
+
+	// Check prefixes, ex: 10.0.0.0/8 or 2001:db8::/32
+	for entry, prefix := range banDB.prefixes {
+		if ban := banDB.Entries[entry]; ban != nil && !ban.Expired() && prefix.Contains(addr) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// Replace all entries, caller must hold the lock
+func (banDB *SFBanDB) setEntries(entries map[string]*BanEntry) {
+	banDB.Entries = make(map[string]*BanEntry, len(entries))
+	banDB.prefixes = make(map[string]netip.Prefix)
+	for entry, ban := range entries {
+		banDB.set(entry, ban)
+	}
+}
+
+// Add or replace a entry and parse it once if it is a prefix, so that
+// lookup doesn't have to. Caller must hold the lock.
+func (banDB *SFBanDB) set(entry string, ban *BanEntry) {
+	banDB.Entries[entry] = ban
+	if !strings.Contains(entry, "/") {
+		return
+	}
+	if prefix, err := ParseAddrOrPrefix(entry); err == nil {
+		if banDB.prefixes == nil {
+			banDB.prefixes = make(map[string]netip.Prefix)
+		}
+		banDB.prefixes[entry] = prefix
+	}
+}
+
+// Caller must hold the lock
+func (banDB *SFBanDB) delete(entry string) {
+	delete(banDB.Entries, entry)
+	delete(banDB.prefixes, entry)
+}
+
+// Add or replace a ban, a zero duration bans permanently
+func (banDB *SFBanDB) Add(entry string, reason string, duration time.Duration, createdBy string) {
+	ban := BanEntry{
+		Reason:    reason,
+		CreatedAt: time.Now(),
+		CreatedBy: createdBy,
+	}
+	if duration > 0 {
+		expiresAt := ban.CreatedAt.Add(duration)
+		ban.ExpiresAt = &expiresAt
+	}
+
+	banDB.mu.Lock()
+	banDB.set(entry, &ban)
+	banDB.mu.Unlock()
+
+	banDB.Save()
+}
+
+func (banDB *SFBanDB) Remove(entry string) (removed bool) {
+	banDB.mu.Lock()
+	_, removed = banDB.Entries[entry]
+	banDB.delete(entry)
+	banDB.mu.Unlock()
+
+	if removed {
+		banDB.Save()
+	}
+	return removed
+}
+
+// Normalize a address or CIDR prefix before it is used as a key, single
+// addresses are stored without a prefix length.
+func normalizeBanEntry(entry string) (string, error) {
+	prefix, err := ParseAddrOrPrefix(entry)
+	if err != nil {
+		return "", err
+	}
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String(), nil
+	}
+	return prefix.String(), nil
 }
 
 type BanDBOp struct {
-	Ip     string `json:"ip"`
-	Reason string `json:"reason"`
+	Ip       string `json:"ip"` // Address or CIDR prefix
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"` // ex: 30m, 24h, empty for a permanent ban
 }
 
 func (sfui *SfUI) AddBan(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
-	MtSecret := r.Header.Get("X-Mt-Secret")
+	adminName, ok := sfui.authenticateAdmin(r)
 
-	if MtSecret != sfui.MaintenanceSecret {
+	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`{"status":"denied"}`))
 		return
@@ -55,10 +382,23 @@ func (sfui *SfUI) AddBan(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		banRequest := BanDBOp{}
 		if json.Unmarshal(data, &banRequest) == nil {
-			if banRequest.Ip != "" && banRequest.Reason != "" && BanDB.Addresses != nil {
-				BanDB.Addresses[banRequest.Ip] = banRequest.Reason
+			var duration time.Duration
+			if banRequest.Duration != "" {
+				var derr error
+				duration, derr = time.ParseDuration(banRequest.Duration)
+				if derr != nil || duration < 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"status":"invalid duration"}`))
+					return
+				}
+			}
+
+			entry, nerr := normalizeBanEntry(banRequest.Ip)
+			if nerr == nil && banRequest.Reason != "" {
+				killed := sfui.Ban(entry, banRequest.Reason, duration, adminName)
+				logAdminAction(adminName, "ban", Privacy.LogIP(entry))
 				w.WriteHeader(http.StatusOK)
-				w.Write([]byte(`{"status":"ok"}`))
+				w.Write([]byte(fmt.Sprintf(`{"status":"ok","sessions_killed":%d}`, killed)))
 				return
 			}
 		}
@@ -68,11 +408,61 @@ func (sfui *SfUI) AddBan(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"status":"error"}`))
 }
 
+// Ban a normalized address or prefix and terminate the live sessions of every
+// client inside it, returns the no of sessions killed
+func (sfui *SfUI) Ban(entry string, reason string, duration time.Duration, createdBy string) (killed int) {
+	BanDB.Add(entry, reason, duration, createdBy)
+	killed = sfui.killSessionsIn(entry, reason)
+	log.Printf("%s banned %s for %s (reason: %s), %d sessions killed\n", createdBy, Privacy.LogIP(entry),
+		banDurationString(duration), reason, killed)
+	return killed
+}
+
+func (sfui *SfUI) killSessionsIn(entry string, reason string) (killed int) {
+	prefix, err := ParseAddrOrPrefix(entry)
+	if err != nil {
+		return 0
+	}
+
+	banned := []Client{}
+	cmu.Lock()
+	for _, client := range clients {
+		addr, aerr := ParseAddr(client.ClientIp)
+		if aerr == nil && prefix.Contains(addr) {
+			banned = append(banned, client)
+		}
+	}
+	cmu.Unlock()
+
+	for i := range banned {
+		client := banned[i]
+		if client.Terminals != nil {
+			client.Terminals.Range(func(key, value any) bool {
+				terminal := key.(*Terminal)
+				terminal.Write([]byte("\r\nSession terminated, banned: " + reason + "\r\n"))
+				terminal.WSConn.Close()
+				return true
+			})
+		}
+		sfui.RemoveClient(&client)
+		killed++
+	}
+
+	return killed
+}
+
+func banDurationString(duration time.Duration) string {
+	if duration == 0 {
+		return "ever"
+	}
+	return duration.String()
+}
+
 func (sfui *SfUI) RemoveBan(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
-	MtSecret := r.Header.Get("X-Mt-Secret")
+	adminName, ok := sfui.authenticateAdmin(r)
 
-	if MtSecret != sfui.MaintenanceSecret {
+	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`{"status":"denied"}`))
 		return
@@ -82,8 +472,15 @@ func (sfui *SfUI) RemoveBan(w http.ResponseWriter, r *http.Request) {
 	if err == nil {
 		banRequest := BanDBOp{}
 		if json.Unmarshal(data, &banRequest) == nil {
-			if banRequest.Ip != "" && BanDB.Addresses != nil {
-				delete(BanDB.Addresses, banRequest.Ip)
+			entry, nerr := normalizeBanEntry(banRequest.Ip)
+			if nerr != nil {
+				entry = banRequest.Ip // allow removal of entries that predate normalization
+			}
+			if banRequest.Ip != "" {
+				if BanDB.Remove(entry) {
+					log.Printf("%s unbanned %s\n", adminName, Privacy.LogIP(entry))
+					logAdminAction(adminName, "unban", Privacy.LogIP(entry))
+				}
 				w.WriteHeader(http.StatusOK)
 				w.Write([]byte(`{"status":"ok"}`))
 				return
@@ -95,17 +492,106 @@ func (sfui *SfUI) RemoveBan(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"status":"error"}`))
 }
 
+type BanListEntry struct {
+	Ip     string `json:"ip"`
+	Source string `json:"source"` // ban_db or the name of a blocklist
+	BanEntry
+}
+
+type BanList struct {
+	Count int            `json:"count"`
+	Bans  []BanListEntry `json:"bans"`
+}
+
+// List bans, supports the following query parameters
+//
+//	filter     : substring match on ip, reason and created_by
+//	created_by : exact match on created_by
+//	type       : permanent | temporary
+//	sort       : ip | created_at | expires_at | hits | last_hit (default created_at)
+//	order      : asc | desc (default asc)
+//	source     : ban_db (default) | <blocklist name> | all
+//	match      : only entries containing this address, ex: to find out why it is banned
 func (sfui *SfUI) ListBans(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
-	MtSecret := r.Header.Get("X-Mt-Secret")
 
-	if MtSecret != sfui.MaintenanceSecret {
+	if _, ok := sfui.authenticateAdmin(r); !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`{"status":"denied"}`))
 		return
 	}
 
-	banData, err := json.Marshal(BanDB)
+	query := r.URL.Query()
+	filter := strings.ToLower(query.Get("filter"))
+	createdBy := query.Get("created_by")
+	banType := query.Get("type")
+	source := query.Get("source")
+	if source == "" {
+		source = BAN_SOURCE_DB
+	}
+
+	var match netip.Addr
+	if query.Get("match") != "" {
+		var merr error
+		if match, merr = ParseAddr(query.Get("match")); merr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"invalid match address"}`))
+			return
+		}
+	}
+
+	candidates := []BanListEntry{}
+	if source == BAN_SOURCE_DB || source == "all" {
+		BanDB.mu.Lock()
+		for entry, ban := range BanDB.Entries {
+			if ban.Expired() {
+				continue
+			}
+			if match.IsValid() {
+				prefix, perr := ParseAddrOrPrefix(entry)
+				if perr != nil || !prefix.Contains(match) {
+					continue
+				}
+			}
+			candidates = append(candidates, BanListEntry{Ip: entry, Source: BAN_SOURCE_DB, BanEntry: *ban})
+		}
+		BanDB.mu.Unlock()
+	}
+	if source != BAN_SOURCE_DB {
+		candidates = append(candidates, Blocklists.banListEntries(source, match)...)
+	}
+
+	banList := BanList{Bans: []BanListEntry{}}
+	for _, ban := range candidates {
+		if filter != "" && !strings.Contains(strings.ToLower(ban.Ip+" "+ban.Reason+" "+ban.CreatedBy+" "+ban.Source), filter) {
+			continue
+		}
+		if createdBy != "" && ban.CreatedBy != createdBy {
+			continue
+		}
+		if (banType == "permanent" && ban.ExpiresAt != nil) || (banType == "temporary" && ban.ExpiresAt == nil) {
+			continue
+		}
+		banList.Bans = append(banList.Bans, ban)
+	}
+
+	less, serr := banListSorter(banList.Bans, query.Get("sort"))
+	if serr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf(`{"status":"%s"}`, serr.Error())))
+		return
+	}
+	if query.Get("order") == "desc" {
+		sort.SliceStable(banList.Bans, func(i, j int) bool { return less(j, i) })
+	} else {
+		sort.SliceStable(banList.Bans, less)
+	}
+	banList.Count = len(banList.Bans)
+	for i := range banList.Bans {
+		banList.Bans[i].Ip = Privacy.AdminIP(banList.Bans[i].Ip)
+	}
+
+	banData, err := json.Marshal(banList)
 	if err == nil {
 		w.WriteHeader(http.StatusOK)
 		w.Write(banData)
@@ -115,3 +601,27 @@ func (sfui *SfUI) ListBans(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Write([]byte(`{"status":"error"}`))
 }
+
+func banListSorter(bans []BanListEntry, field string) (func(i, j int) bool, error) {
+	// nil times (permanent, never hit) sort last
+	timeLess := func(a, b *time.Time) bool {
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		return a.Before(*b)
+	}
+
+	switch field {
+	case "", "created_at":
+		return func(i, j int) bool { return bans[i].CreatedAt.Before(bans[j].CreatedAt) }, nil
+	case "ip":
+		return func(i, j int) bool { return bans[i].Ip < bans[j].Ip }, nil
+	case "expires_at":
+		return func(i, j int) bool { return timeLess(bans[i].ExpiresAt, bans[j].ExpiresAt) }, nil
+	case "hits":
+		return func(i, j int) bool { return bans[i].Hits < bans[j].Hits }, nil
+	case "last_hit":
+		return func(i, j int) bool { return timeLess(bans[i].LastHit, bans[j].LastHit) }, nil
+	}
+	return nil, fmt.Errorf("cannot sort by %s", field)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestBanDB(path string) *SFBanDB {
+	return &SFBanDB{
+		mu:      &sync.Mutex{},
+		fileMu:  &sync.Mutex{},
+		Version: BAN_DB_VERSION,
+		Entries: make(map[string]*BanEntry),
+		path:    path,
+	}
+}
+
+func banEntryKeys(entries map[string]*BanEntry) []string {
+	keys := []string{}
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestParseBanDB(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		entries  []string
+		migrated bool
+		valid    bool
+	}{
+		{"current format", `{"version":2,"entries":{"192.0.2.1":{"reason":"spam"},"10.0.0.0/8":{"reason":"abuse"},"198.51.100.1":null}}`,
+			[]string{"10.0.0.0/8", "192.0.2.1"}, false, true},
+		{"legacy format", `{"addresses":{"192.0.2.1":"spam","10.1.2.3/8":"abuse","::ffff:198.51.100.1":"scan"}}`,
+			[]string{"10.0.0.0/8", "192.0.2.1", "198.51.100.1"}, true, true},
+		{"legacy entry that is not a address", `{"addresses":{"not an ip":"spam"}}`,
+			[]string{"not an ip"}, true, true},
+		{"invalid json", `{"version":2,"entries":`, nil, false, false},
+		{"not a object", `[]`, nil, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, migrated, err := parseBanDB([]byte(test.data))
+			if (err == nil) != test.valid {
+				t.Fatalf("parseBanDB() error = %v, want valid %v", err, test.valid)
+			}
+			if !test.valid {
+				return
+			}
+			if got := banEntryKeys(entries); !equalStrings(got, test.entries) {
+				t.Errorf("entries = %v, want %v", got, test.entries)
+			}
+			if migrated != test.migrated {
+				t.Errorf("migrated = %v, want %v", migrated, test.migrated)
+			}
+		})
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBanDBInitMigrates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banDB.json")
+	if err := os.WriteFile(path, []byte(`{"addresses":{"192.0.2.1":"spam"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	banDB := SFBanDB{}
+	banDB.Init(path)
+
+	if banned, reason := banDB.IsBanned("192.0.2.1"); !banned || reason != "spam" {
+		t.Errorf("IsBanned() = %v, %q after the migration", banned, reason)
+	}
+
+	data, _ := os.ReadFile(path)
+	stored := SFBanDB{}
+	if err := json.Unmarshal(data, &stored); err != nil || stored.Version != BAN_DB_VERSION {
+		t.Fatalf("migrated file not saved in the current format: %s", data)
+	}
+	if ban := stored.Entries["192.0.2.1"]; ban == nil || ban.CreatedBy != "migration" || ban.ExpiresAt != nil {
+		t.Errorf("migrated entry = %+v, want a permanent ban created by migration", ban)
+	}
+}
+
+func TestBanDBLookup(t *testing.T) {
+	banDB := newTestBanDB(filepath.Join(t.TempDir(), "banDB.json"))
+	banDB.Add("192.0.2.1", "single", 0, "test")
+	banDB.Add("198.51.100.0/24", "prefix", time.Hour, "test")
+	banDB.Add("2001:db8::/32", "ipv6 prefix", 0, "test")
+	banDB.Add("203.0.113.1", "expired", time.Nanosecond, "test")
+	banDB.Add("203.0.112.0/23", "expired prefix", time.Nanosecond, "test")
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		ip     string
+		reason string // empty if not banned
+	}{
+		{"192.0.2.1", "single"},
+		{"::ffff:192.0.2.1", "single"},
+		{"192.0.2.2", ""},
+		{"198.51.100.77", "prefix"},
+		{"2001:db8:1::1", "ipv6 prefix"},
+		{"2001:db9::1", ""},
+		{"203.0.113.1", ""},
+		{"203.0.112.1", ""},
+	}
+
+	for _, test := range tests {
+		banned, reason := banDB.IsBanned(test.ip)
+		if banned != (test.reason != "") || reason != test.reason {
+			t.Errorf("IsBanned(%s) = %v, %q, want %q", test.ip, banned, reason, test.reason)
+		}
+	}
+
+	if hits := banDB.Entries["192.0.2.1"].Hits; hits != 2 {
+		t.Errorf("Hits = %d, want 2", hits)
+	}
+
+	banDB.Remove("198.51.100.0/24")
+	if banned, _ := banDB.IsBanned("198.51.100.77"); banned {
+		t.Error("IsBanned() = true after the prefix was removed")
+	}
+}
+
+func TestBanDBCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banDB.json")
+	banDB := newTestBanDB(path)
+	banDB.Add("192.0.2.1", "permanent", 0, "test")
+	banDB.Add("192.0.2.2", "temporary", time.Hour, "test")
+	banDB.Add("192.0.2.3", "expired", time.Nanosecond, "test")
+	time.Sleep(time.Millisecond)
+
+	banDB.compact()
+
+	want := []string{"192.0.2.1", "192.0.2.2"}
+	if got := banEntryKeys(banDB.Entries); !equalStrings(got, want) {
+		t.Errorf("entries after compact() = %v, want %v", got, want)
+	}
+	data, _ := os.ReadFile(path)
+	entries, _, err := parseBanDB(data)
+	if err != nil || !equalStrings(banEntryKeys(entries), want) {
+		t.Errorf("saved entries = %v (%v), want %v", banEntryKeys(entries), err, want)
+	}
+}
+
+func TestBanDBSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "banDB.json")
+	if err := os.WriteFile(path, []byte("previous content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	banDB := newTestBanDB(path)
+	banDB.Add("192.0.2.1", "spam", 0, "test")
+
+	data, _ := os.ReadFile(path)
+	entries, migrated, err := parseBanDB(data)
+	if err != nil || migrated || entries["192.0.2.1"] == nil {
+		t.Fatalf("saved file does not parse back: %v %s", err, data)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0644 {
+		t.Errorf("mode = %v, want 0644", fi.Mode().Perm())
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("temporary files left behind: %v", files)
+	}
+
+	// a failed write leaves the previous file in place
+	banDB.path = filepath.Join(dir, "missing", "banDB.json")
+	if err := banDB.Save(); err == nil {
+		t.Error("Save() into a missing directory did not fail")
+	}
+	if after, _ := os.ReadFile(path); string(after) != string(data) {
+		t.Error("a failed save changed the existing file")
+	}
+}
+
+func TestBanDBReloadIfModified(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banDB.json")
+	banDB := newTestBanDB(path)
+	banDB.Add("192.0.2.1", "spam", 0, "test")
+	banDB.IsBanned("192.0.2.1")
+	createdAt := banDB.Entries["192.0.2.1"].CreatedAt
+
+	edit := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the edit must not share the mod time of our own write
+		modTime := time.Now().Add(time.Duration(len(content)) * time.Second)
+		os.Chtimes(path, modTime, modTime)
+	}
+	editedDB := func(entries map[string]*BanEntry) string {
+		data, _ := json.Marshal(SFBanDB{Version: BAN_DB_VERSION, Entries: entries})
+		return string(data)
+	}
+
+	tests := []struct {
+		name     string
+		content  string // empty to leave the file as is
+		reloaded bool
+		banned   []string
+	}{
+		{"unchanged", "", false, []string{"192.0.2.1"}},
+		{"entry added", editedDB(map[string]*BanEntry{
+			"192.0.2.1": {Reason: "spam", CreatedAt: createdAt},
+			"192.0.2.2": {Reason: "added by hand"},
+		}), true, []string{"192.0.2.1", "192.0.2.2"}},
+		{"garbled edit keeps the bans", `{"version":2,"entries":{`, false, []string{"192.0.2.1", "192.0.2.2"}},
+		{"fixed edit", editedDB(map[string]*BanEntry{
+			"192.0.2.1": {Reason: "spam", CreatedAt: createdAt},
+		}), true, []string{"192.0.2.1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.content != "" {
+				edit(test.content)
+			}
+			if got := banDB.reloadIfModified(); got != test.reloaded {
+				t.Errorf("reloadIfModified() = %v, want %v", got, test.reloaded)
+			}
+			if got := banEntryKeys(banDB.Entries); !equalStrings(got, test.banned) {
+				t.Errorf("entries = %v, want %v", got, test.banned)
+			}
+		})
+	}
+
+	if hits := banDB.Entries["192.0.2.1"].Hits; hits != 1 {
+		t.Errorf("Hits = %d, the hit counter of a unchanged entry should be kept", hits)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// External blocklists (ex: Spamhaus DROP, Tor exit nodes) merged into ban
+// lookups. They are kept apart from the ban db, a refresh replaces the
+// entries of its own source only and never touches manual bans.
+const (
+	BLOCKLIST_FORMAT_PLAIN = "plain" // one address per line, # and ; start a comment
+	BLOCKLIST_FORMAT_CIDR  = "cidr"  // one CIDR prefix (or address) per line, # and ; start a comment
+	BLOCKLIST_FORMAT_JSON  = "json"  // array of strings, or of objects with a "ip" or "cidr" field
+
+	BLOCKLIST_MAX_SIZE      = 64 << 20 // 64 MiB
+	BLOCKLIST_FETCH_TIMEOUT = 30 * time.Second
+)
+
+type BlocklistSource struct {
+	Name            string `yaml:"name"`             // Unique label, shown as the source of a ban
+	Url             string `yaml:"url"`              // http(s) url or local file path
+	Format          string `yaml:"format"`           // plain | cidr | json
+	Reason          string `yaml:"reason"`           // Ban reason, defaults to "listed in <name>"
+	RefreshInterval int    `yaml:"refresh_interval"` // Minutes
+}
+
+type blocklist struct {
+	Source    BlocklistSource
+	Prefixes  map[netip.Prefix]struct{}
+	BitLens   []int // distinct prefix lengths in Prefixes, longest first
+	UpdatedAt time.Time
+	LastError string
+	Hits      atomic.Int64 // updated under the read lock, lookups do not block each other
+	LastHit   atomic.Int64 // unix nano, 0 if never hit
+}
+
+type BlocklistStore struct {
+	mu    *sync.RWMutex
+	lists []*blocklist
+}
+
+var Blocklists = BlocklistStore{}
+
+func (store *BlocklistStore) Init(sources []BlocklistSource) {
+	store.mu = &sync.RWMutex{}
+
+	for _, source := range sources {
+		if source.Name == "" || source.Url == "" {
+			log.Println("Ignoring blocklist without a name or url")
+			continue
+		}
+		if source.Reason == "" {
+			source.Reason = "listed in " + source.Name
+		}
+
+		list := &blocklist{
+			Source:   source,
+			Prefixes: map[netip.Prefix]struct{}{},
+		}
+		store.lists = append(store.lists, list)
+		go store.refreshPeriodically(list)
+	}
+}
+
+func (store *BlocklistStore) refreshPeriodically(list *blocklist) {
+	for {
+		store.refresh(list)
+		if list.Source.RefreshInterval <= 0 {
+			return
+		}
+		time.Sleep(time.Minute * time.Duration(list.Source.RefreshInterval))
+	}
+}
+
+// Fetch and parse a source, the previous entries are kept if that fails or
+// if nothing valid was found (ex: a error page served with status 200)
+func (store *BlocklistStore) refresh(list *blocklist) {
+	prefixes, invalid, err := fetchBlocklist(list.Source)
+	if err == nil && len(prefixes) == 0 {
+		err = fmt.Errorf("no valid entries (%d invalid lines), keeping the previous ones", invalid)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err != nil {
+		list.LastError = err.Error()
+		log.Printf("Blocklist %s: %s\n", list.Source.Name, err)
+		return
+	}
+
+	list.Prefixes = prefixes
+	list.BitLens = prefixBitLens(prefixes)
+	list.UpdatedAt = time.Now()
+	list.LastError = ""
+	log.Printf("Blocklist %s: loaded %d entries (%d invalid lines skipped)\n",
+		list.Source.Name, len(prefixes), invalid)
+}
+
+func fetchBlocklist(source BlocklistSource) (prefixes map[netip.Prefix]struct{}, invalid int, err error) {
+	var data []byte
+
+	if strings.HasPrefix(source.Url, "http://") || strings.HasPrefix(source.Url, "https://") {
+		client := &http.Client{Timeout: BLOCKLIST_FETCH_TIMEOUT}
+		resp, herr := client.Get(source.Url)
+		if herr != nil {
+			return nil, 0, herr
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, BLOCKLIST_MAX_SIZE))
+	} else {
+		data, err = os.ReadFile(strings.TrimPrefix(source.Url, "file://"))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch source.Format {
+	case BLOCKLIST_FORMAT_PLAIN, BLOCKLIST_FORMAT_CIDR, "":
+		prefixes, invalid = parsePlainBlocklist(data)
+	case BLOCKLIST_FORMAT_JSON:
+		prefixes, invalid, err = parseJSONBlocklist(data)
+	default:
+		err = errors.New("unknown format " + source.Format)
+	}
+	return prefixes, invalid, err
+}
+
+// ex: Spamhaus DROP "1.10.16.0/20 ; SBL256894", Tor exit list "1.2.3.4"
+func parsePlainBlocklist(data []byte) (prefixes map[netip.Prefix]struct{}, invalid int) {
+	prefixes = map[netip.Prefix]struct{}{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		prefix, err := ParseAddrOrPrefix(fields[0])
+		if err != nil {
+			invalid++
+			continue
+		}
+		prefixes[prefix] = struct{}{}
+	}
+	return prefixes, invalid
+}
+
+func parseJSONBlocklist(data []byte) (prefixes map[netip.Prefix]struct{}, invalid int, err error) {
+	var entries []json.RawMessage
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, 0, err
+	}
+
+	prefixes = map[netip.Prefix]struct{}{}
+	for _, raw := range entries {
+		var entry string
+		if json.Unmarshal(raw, &entry) != nil {
+			object := struct {
+				Ip   string `json:"ip"`
+				Cidr string `json:"cidr"`
+			}{}
+			json.Unmarshal(raw, &object)
+			entry = object.Ip
+			if entry == "" {
+				entry = object.Cidr
+			}
+		}
+
+		prefix, perr := ParseAddrOrPrefix(entry)
+		if perr != nil {
+			invalid++
+			continue
+		}
+		prefixes[prefix] = struct{}{}
+	}
+	return prefixes, invalid, nil
+}
+
+func prefixBitLens(prefixes map[netip.Prefix]struct{}) []int {
+	seen := map[int]bool{}
+	bitLens := []int{}
+	for prefix := range prefixes {
+		if !seen[prefix.Bits()] {
+			seen[prefix.Bits()] = true
+			bitLens = append(bitLens, prefix.Bits())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(bitLens)))
+	return bitLens
+}
+
+// Find the first list containing the address, returns its name and reason
+func (store *BlocklistStore) Lookup(ip string) (isListed bool, source string, reason string) {
+	if store.mu == nil {
+		return false, "", ""
+	}
+
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return false, "", ""
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, list := range store.lists {
+		if _, ok := list.match(addr); ok {
+			list.Hits.Add(1)
+			list.LastHit.Store(time.Now().UnixNano())
+			return true, list.Source.Name, list.Source.Reason
+		}
+	}
+	return false, "", ""
+}
+
+// Returns the most specific matching entry
+func (list *blocklist) match(addr netip.Addr) (netip.Prefix, bool) {
+	for _, bits := range list.BitLens {
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue // IPv6 length on a IPv4 address or vice versa
+		}
+		if _, ok := list.Prefixes[prefix]; ok {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// Entries of the list named source ("all" for every list) as ban list entries,
+// if addr is valid only entries containing it are returned
+func (store *BlocklistStore) banListEntries(source string, addr netip.Addr) []BanListEntry {
+	entries := []BanListEntry{}
+	if store.mu == nil {
+		return entries
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	for _, list := range store.lists {
+		if source != "all" && source != list.Source.Name {
+			continue
+		}
+
+		entry := func(prefix netip.Prefix) BanListEntry {
+			ip := prefix.String()
+			if prefix.IsSingleIP() {
+				ip = prefix.Addr().String()
+			}
+			return BanListEntry{
+				Ip:     ip,
+				Source: list.Source.Name,
+				BanEntry: BanEntry{
+					Reason:    list.Source.Reason,
+					CreatedAt: list.UpdatedAt,
+					CreatedBy: BAN_SOURCE_BLOCKLIST,
+				},
+			}
+		}
+
+		if addr.IsValid() {
+			if prefix, ok := list.match(addr); ok {
+				entries = append(entries, entry(prefix))
+			}
+			continue
+		}
+
+		for prefix := range list.Prefixes {
+			entries = append(entries, entry(prefix))
+		}
+	}
+	return entries
+}
+
+type BlocklistStatus struct {
+	Name      string     `json:"name"`
+	Url       string     `json:"url"`
+	Format    string     `json:"format"`
+	Reason    string     `json:"reason"`
+	Entries   int        `json:"entries"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	LastError string     `json:"last_error,omitempty"`
+	Hits      int64      `json:"hits"`
+	LastHit   *time.Time `json:"last_hit,omitempty"`
+}
+
+func (sfui *SfUI) ListBlocklists(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+
+	if _, ok := sfui.authenticateAdmin(r); !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"status":"denied"}`))
+		return
+	}
+
+	statuses := []BlocklistStatus{}
+	if Blocklists.mu != nil {
+		Blocklists.mu.RLock()
+		for _, list := range Blocklists.lists {
+			var lastHit *time.Time
+			if nanos := list.LastHit.Load(); nanos != 0 {
+				hitTime := time.Unix(0, nanos)
+				lastHit = &hitTime
+			}
+			statuses = append(statuses, BlocklistStatus{
+				Name:      list.Source.Name,
+				Url:       list.Source.Url,
+				Format:    list.Source.Format,
+				Reason:    list.Source.Reason,
+				Entries:   len(list.Prefixes),
+				UpdatedAt: list.UpdatedAt,
+				LastError: list.LastError,
+				Hits:      list.Hits.Load(),
+				LastHit:   lastHit,
+			})
+		}
+		Blocklists.mu.RUnlock()
+	}
+
+	statusData, err := json.Marshal(statuses)
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(statusData)
+		return
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(`{"status":"error"}`))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func prefixStrings(prefixes map[netip.Prefix]struct{}) []string {
+	list := []string{}
+	for prefix := range prefixes {
+		list = append(list, prefix.String())
+	}
+	sort.Strings(list)
+	return list
+}
+
+func TestFetchBlocklist(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		data     string
+		prefixes []string
+		invalid  int
+		valid    bool
+	}{
+		{"plain", BLOCKLIST_FORMAT_PLAIN, "# tor exit nodes\n192.0.2.1\n2001:db8::1\n\n192.0.2.1\n",
+			[]string{"192.0.2.1/32", "2001:db8::1/128"}, 0, true},
+		{"cidr with comments", BLOCKLIST_FORMAT_CIDR, "; Spamhaus DROP\n198.51.100.0/24 ; SBL1\n203.0.113.7/16 # not masked\n",
+			[]string{"198.51.100.0/24", "203.0.0.0/16"}, 0, true},
+		{"invalid lines are counted", BLOCKLIST_FORMAT_CIDR, "198.51.100.0/24\nnot an address\n10.0.0.0/40\n",
+			[]string{"198.51.100.0/24"}, 2, true},
+		{"default format is plain", "", "192.0.2.1\n", []string{"192.0.2.1/32"}, 0, true},
+		{"json strings", BLOCKLIST_FORMAT_JSON, `["192.0.2.1", "198.51.100.0/24"]`,
+			[]string{"192.0.2.1/32", "198.51.100.0/24"}, 0, true},
+		{"json objects", BLOCKLIST_FORMAT_JSON, `[{"ip": "192.0.2.1"}, {"cidr": "198.51.100.0/24"}, {"other": 1}, 42]`,
+			[]string{"192.0.2.1/32", "198.51.100.0/24"}, 2, true},
+		{"json not an array", BLOCKLIST_FORMAT_JSON, `{"ip": "192.0.2.1"}`, nil, 0, false},
+		{"unknown format", "csv", "192.0.2.1\n", nil, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "list")
+			if err := os.WriteFile(path, []byte(test.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			prefixes, invalid, err := fetchBlocklist(BlocklistSource{Url: "file://" + path, Format: test.format})
+			if (err == nil) != test.valid {
+				t.Fatalf("fetchBlocklist() error = %v, want valid %v", err, test.valid)
+			}
+			if !test.valid {
+				return
+			}
+			if got := prefixStrings(prefixes); !reflect.DeepEqual(got, test.prefixes) {
+				t.Errorf("prefixes = %v, want %v", got, test.prefixes)
+			}
+			if invalid != test.invalid {
+				t.Errorf("invalid = %d, want %d", invalid, test.invalid)
+			}
+		})
+	}
+
+	if _, _, err := fetchBlocklist(BlocklistSource{Url: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("fetchBlocklist() of a missing file did not fail")
+	}
+}
+
+func TestBlocklistMatch(t *testing.T) {
+	prefixes, _ := parsePlainBlocklist([]byte("10.0.0.0/8\n10.1.0.0/16\n10.1.2.3\n2001:db8::/32\n"))
+	list := &blocklist{Prefixes: prefixes, BitLens: prefixBitLens(prefixes)}
+
+	// a length is tried once, whatever the address family
+	if !reflect.DeepEqual(list.BitLens, []int{32, 16, 8}) {
+		t.Errorf("BitLens = %v, want [32 16 8]", list.BitLens)
+	}
+
+	tests := []struct {
+		addr string
+		want string // empty if not listed
+	}{
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"10.1.2.4", "10.1.0.0/16"},
+		{"10.2.0.1", "10.0.0.0/8"},
+		{"11.0.0.1", ""},
+		{"2001:db8::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+		{"::ffff:10.1.2.3", "10.1.2.3/32"},
+	}
+
+	for _, test := range tests {
+		addr, _ := ParseAddr(test.addr)
+		prefix, ok := list.match(addr)
+		got := ""
+		if ok {
+			got = prefix.String()
+		}
+		if got != test.want {
+			t.Errorf("match(%s) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestBlocklistRefreshKeepsEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list")
+	store := &BlocklistStore{mu: &sync.RWMutex{}}
+	list := &blocklist{Source: BlocklistSource{Name: "test", Url: path, Reason: "listed in test"}}
+	store.lists = []*blocklist{list}
+
+	tests := []struct {
+		name    string
+		data    string
+		listed  bool // whether 192.0.2.1 is listed after the refresh
+		failing bool
+	}{
+		{"initial load", "192.0.2.1\n", true, false},
+		{"empty list keeps the entries", "", true, true},
+		{"error page keeps the entries", "<html>maintenance</html>\n", true, true},
+		{"new entries replace the old ones", "198.51.100.1\n", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(path, []byte(test.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			store.refresh(list)
+
+			if (list.LastError != "") != test.failing {
+				t.Errorf("LastError = %q, want failing %v", list.LastError, test.failing)
+			}
+			listed, source, _ := store.Lookup("192.0.2.1")
+			if listed != test.listed {
+				t.Errorf("Lookup() = %v, want %v", listed, test.listed)
+			}
+			if listed && source != "test" {
+				t.Errorf("Lookup() source = %q", source)
+			}
+		})
+	}
+
+	if list.Hits.Load() != 3 || list.LastHit.Load() == 0 {
+		t.Errorf("Hits = %d, LastHit = %d after three matching lookups", list.Hits.Load(), list.LastHit.Load())
+	}
+}
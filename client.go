@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -18,9 +18,11 @@ import (
 type Client struct {
 	ClientId                 string
 	ClientCountry            string
+	ClientGeo                GeoInfo // Empty if no geo database is loaded
 	ClientIp                 string
 	mu                       *sync.Mutex
 	TerminalsCount           *atomic.Int32
+	Terminals                *sync.Map    // Active terminals, *Terminal -> struct{}
 	DesktopActive            *atomic.Bool // Whether a active desktop ws connection exists
 	MaxTerms                 int32
 	MaxSharedDesktopConn     int32
@@ -50,7 +52,7 @@ var cmu = &sync.Mutex{}               // Synchronize access to the clients DB ab
 var randVal = RandomStr(10)           // Random str for deriving clientId, doesnt change unless sfui is restarted
 
 // Return a new client, prepare necessary sockets
-func (sfui *SfUI) NewClient(ClientSecret string, ClientIp string) (Client, error) {
+func (sfui *SfUI) NewClient(ctx context.Context, ClientSecret string, ClientIp string) (Client, error) {
 	isBanned, reason := BanDB.IsBanned(ClientIp)
 	if isBanned {
 		return Client{}, errors.New(reason)
@@ -58,10 +60,12 @@ func (sfui *SfUI) NewClient(ClientSecret string, ClientIp string) (Client, error
 
 	// Make and return a new client
 	tabId := ""
+	clientGeo, _ := Geo.Lookup(ClientIp)
 	client := Client{
 		ClientId:                 getClientId(ClientSecret),
 		mu:                       &sync.Mutex{},
 		TerminalsCount:           &atomic.Int32{},
+		Terminals:                &sync.Map{},
 		MaxTerms:                 int32(sfui.MaxWsTerminals),
 		MaxSharedDesktopConn:     int32(sfui.MaxSharedDesktopConn),
 		ClientConn:               make(chan interface{}), // Initially no active connections exist
@@ -75,6 +79,7 @@ func (sfui *SfUI) NewClient(ClientSecret string, ClientIp string) (Client, error
 		Deleted:                  &atomic.Bool{},
 		TabId:                    &tabId,
 		ClientCountry:            GetCountryByIp(ClientIp),
+		ClientGeo:                clientGeo,
 		ClientIp:                 ClientIp,
 		ConnectedOn:              time.Now(),
 		ClientAlive:              make(chan interface{}),
@@ -96,6 +101,7 @@ func (sfui *SfUI) NewClient(ClientSecret string, ClientIp string) (Client, error
 	endpointAddress, actualSecret := sfui.getEndpointAndSecret(ClientSecret)
 	sshConnection := SSHConnection{
 		Connected:             &atomic.Bool{},
+		ClientId:              client.ClientId,
 		Host:                  endpointAddress,
 		ControlTerminalActive: &atomic.Bool{},
 		Port:                  "22",
@@ -110,16 +116,23 @@ func (sfui *SfUI) NewClient(ClientSecret string, ClientIp string) (Client, error
 	}
 	client.SSHConnection = &sshConnection
 
+	// One proxy per client, connections to filebrowser are pooled and reused
+	fileBrowserProxy, perr := NewSSHReverseProxy(&sshConnection, sfui.FileBrowserPort)
+	if perr == nil {
+		client.FileBrowserProxy = fileBrowserProxy
+	}
+
 	clients[client.ClientId] = client
 
 	cmu.Unlock()
 
-	if cerr := sshConnection.StartSSHConnection(); cerr != nil {
+	if cerr := sshConnection.StartSSHConnection(ctx); cerr != nil {
 		sfui.RemoveClient(&client)
 		return client, cerr
 	}
 
 	client.ClientActive.Store(true)
+	Analytics.RecordSessionStart()
 
 	cmu.Lock()
 	clients[client.ClientId] = client
@@ -157,18 +170,21 @@ func (sfui *SfUI) RemoveClient(client *Client) {
 			close(client.ClientAlive) // Mark client as dead
 		}
 
+		CloseReverseProxy(client.FileBrowserProxy)
+		DownloadLinks.RevokeClient(client.ClientId)
+
 		if client.SSHConnection != nil {
+			// Connected is set once the master connection is established and never reset
+			if client.SSHConnection.Connected.Load() {
+				Analytics.RecordSessionEnd(client.ClientCountry, client.SSHConnection.Host, time.Since(client.ConnectedOn))
+			}
 			client.SSHConnection.StopSSHConnection()
 		}
 
-		if sfui.EnableMetricLogging {
-			go MLogger.AddLogEntry(&Metric{
-				Type:            "Logout",
-				UserUid:         getClientId(client.ClientIp),
-				Country:         client.ClientCountry,
-				SessionDuration: fmt.Sprintf("%.0f", time.Since(client.ConnectedOn).Minutes()),
-			})
-		}
+		MLogger.LogEvent(Metric{
+			Type:            METRIC_LOGOUT,
+			SessionDuration: time.Since(client.ConnectedOn).Minutes(),
+		}, client.ClientIp)
 
 		cmu.Lock()
 		delete(clients, client.ClientId)
@@ -207,15 +223,28 @@ func (sfui *SfUI) RemoveClientIfInactive(clientSecret string) {
 	}()
 }
 
-func (sfui *SfUI) GetExistingClientOrMakeNew(ClientSecret string, ClientIp string) (Client, error) {
-	client, cerr := sfui.GetClient(ClientSecret)
+func (sfui *SfUI) GetExistingClientOrMakeNew(ctx context.Context, ClientSecret string, ClientIp string) (client Client, cerr error) {
+	ctx, span := Tracer.StartSpan(ctx, "sfui.get_client", SPAN_KIND_INTERNAL)
+	span.SetAttribute(SPAN_ATTR_CLIENT_ID, getClientId(ClientSecret))
+	defer func() {
+		if cerr != nil {
+			span.SetOutcome("error")
+			span.SetError(cerr)
+		}
+		span.End()
+	}()
+
+	client, cerr = sfui.GetClient(ClientSecret)
 	if cerr != nil {
-		return sfui.NewClient(ClientSecret, ClientIp)
+		span.SetOutcome("created")
+		return sfui.NewClient(ctx, ClientSecret, ClientIp)
 	}
 
 	if client.SSHConnection == nil {
 		return client, errors.New("client does not exist")
 	}
+	span.SetAttribute(SPAN_ATTR_ENDPOINT, client.SSHConnection.Host)
+	span.SetOutcome("existing")
 
 	if !client.SSHConnection.Connected.Load() {
 		werr := client.SSHConnection.WaitForConnection(2, 5*time.Second)
@@ -488,17 +517,19 @@ type ClientStat struct {
 	IpId          string `json:"ip_id"`
 	Ip            string `json:"ip"`
 	Country       string `json:"country"`
+	City          string `json:"city,omitempty"`
+	ASN           uint   `json:"asn,omitempty"`
+	Org           string `json:"org,omitempty"`
 	ConnectedOn   string `json:"connected_on"`
 	Age           string `json:"age"`
 	TermCount     int    `json:"term_count"`
 	DesktopActive bool   `json:"desktop_active"`
+	DownloadLinks int    `json:"download_links"` // No of active public download links
 }
 
 func (sfui *SfUI) handleClientStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
-	MtSecret := r.Header.Get("X-Mt-Secret")
-
-	if MtSecret != sfui.MaintenanceSecret {
+	if _, ok := sfui.authenticateAdmin(r); !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`{"status":"denied"}`))
 		return
@@ -510,15 +541,20 @@ func (sfui *SfUI) handleClientStats(w http.ResponseWriter, r *http.Request) {
 
 	cmu.Lock()
 	for _, client := range clients {
+		ipId, _ := Privacy.Pseudonym(client.ClientIp) // same as UserUid in metric events
 		nClient := ClientStat{
 			ClientId:      client.ClientId,
-			IpId:          getClientId(client.ClientIp),
-			Ip:            client.ClientIp,
+			IpId:          ipId,
+			Ip:            Privacy.AdminIP(client.ClientIp),
 			TermCount:     int(client.TerminalsCount.Load()),
 			Country:       client.ClientCountry,
+			City:          client.ClientGeo.City,
+			ASN:           client.ClientGeo.ASN,
+			Org:           client.ClientGeo.Org,
 			ConnectedOn:   client.ConnectedOn.UTC().String(),
 			Age:           time.Since(client.ConnectedOn).String(),
 			DesktopActive: client.DesktopActive.Load(),
+			DownloadLinks: DownloadLinks.Count(client.ClientId),
 		}
 		stats.Clients = append(stats.Clients, nClient)
 		stats.ClientCount++
@@ -542,9 +578,8 @@ type AdminOp struct {
 
 func (sfui *SfUI) handleKillClient(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
-	MtSecret := r.Header.Get("X-Mt-Secret")
-
-	if MtSecret != sfui.MaintenanceSecret {
+	adminName, ok := sfui.authenticateAdmin(r)
+	if !ok {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`{"status":"denied"}`))
 		return
@@ -561,6 +596,7 @@ func (sfui *SfUI) handleKillClient(w http.ResponseWriter, r *http.Request) {
 				cmu.Unlock()
 				if ok {
 					sfui.RemoveClient(&client)
+					logAdminAction(adminName, "kill", adminRequest.ClientId)
 					w.WriteHeader(http.StatusOK)
 					w.Write([]byte(`{"status":"ok"}`))
 					return
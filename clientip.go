@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// Resolves the address of a client, forwarding headers (Forwarded, X-Forwarded-For)
+// are only honoured when the request comes from a trusted proxy. Hops are walked
+// from right to left, the first address that is not a trusted proxy is the client.
+type ClientIPResolver struct {
+	UseForwardingHeaders bool
+	TrustedProxies       []netip.Prefix
+	warnedUntrusted      atomic.Bool // forwarding headers from a untrusted peer were logged
+}
+
+func NewClientIPResolver(useForwardingHeaders bool, trustedProxies []string) (*ClientIPResolver, error) {
+	resolver := ClientIPResolver{
+		UseForwardingHeaders: useForwardingHeaders,
+	}
+
+	for _, proxy := range trustedProxies {
+		prefix, err := ParseAddrOrPrefix(proxy)
+		if err != nil {
+			return nil, err
+		}
+		resolver.TrustedProxies = append(resolver.TrustedProxies, prefix)
+	}
+
+	return &resolver, nil
+}
+
+func (resolver *ClientIPResolver) IsTrusted(addr netip.Addr) bool {
+	for _, prefix := range resolver.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (resolver *ClientIPResolver) onlyLoopbackTrusted() bool {
+	for _, prefix := range resolver.TrustedProxies {
+		if !prefix.Addr().IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the client address, peerAddr is the address of the directly connected peer
+func (resolver *ClientIPResolver) Resolve(r *http.Request, peerAddr netip.Addr) netip.Addr {
+	if !resolver.UseForwardingHeaders {
+		return peerAddr
+	}
+	if !resolver.IsTrusted(peerAddr) {
+		// Likely a proxy that is missing from trusted_proxies, ex: the docker
+		// bridge gateway, every client would then share its address
+		hasHeaders := r.Header.Get("Forwarded") != "" || r.Header.Get("X-Forwarded-For") != ""
+		if hasHeaders && resolver.warnedUntrusted.CompareAndSwap(false, true) {
+			log.Printf("Ignoring forwarding headers from %s, it is not in trusted_proxies\n", peerAddr)
+		}
+		return peerAddr
+	}
+
+	hops := parseForwardedHeader(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = parseXForwardedForHeader(r.Header.Values("X-Forwarded-For"))
+	}
+
+	clientAddr := peerAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := ParseAddr(hops[i])
+		if err != nil {
+			break // cant trust anything left of a garbled hop
+		}
+		clientAddr = hop
+		if !resolver.IsTrusted(hop) {
+			break
+		}
+	}
+
+	return clientAddr
+}
+
+// RFC 7239, returns the "for" parameter of every element, in order
+func parseForwardedHeader(values []string) []string {
+	hops := []string{}
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, strings.Trim(kv[1], `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+func parseXForwardedForHeader(values []string) []string {
+	hops := []string{}
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			hop = strings.TrimSpace(hop)
+			if hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// Parse a address in any of the forms seen in RemoteAddr and forwarding headers
+// ex: 1.2.3.4, 1.2.3.4:80, 2001:db8::1, [2001:db8::1]:80, ::ffff:1.2.3.4
+// IPv4-mapped IPv6 addresses are returned as IPv4, zones are dropped.
+func ParseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), nil
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, errors.New("invalid address " + s)
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// Parse a CIDR prefix, a plain address is treated as a single host prefix
+func ParseAddrOrPrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Whether the directly connected peer is one of the trusted_proxies
+func (sfui *SfUI) fromTrustedProxy(r *http.Request) bool {
+	peerAddr, err := ParseAddr(r.RemoteAddr)
+	if err != nil || sfui.ClientIPResolver == nil {
+		return false
+	}
+	return sfui.ClientIPResolver.IsTrusted(peerAddr)
+}
+
+func (sfui *SfUI) getClientAddr(r *http.Request) string {
+	peerAddr, err := ParseAddr(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	if sfui.ClientIPResolver == nil {
+		return peerAddr.String()
+	}
+
+	return sfui.ClientIPResolver.Resolve(r, peerAddr).String()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseForwardedHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"single", []string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, []string{"192.0.2.60"}},
+		{"several elements", []string{"for=192.0.2.43, for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"several headers", []string{"for=192.0.2.43", "for=198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"quoted ipv6 with port", []string{`for="[2001:db8:cafe::17]:4711"`}, []string{"[2001:db8:cafe::17]:4711"}},
+		{"case insensitive", []string{"For=192.0.2.60"}, []string{"192.0.2.60"}},
+		{"obfuscated", []string{"for=_hidden, for=192.0.2.60"}, []string{"_hidden", "192.0.2.60"}},
+		{"no for parameter", []string{"proto=https;by=203.0.113.43"}, []string{}},
+		{"empty", nil, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseForwardedHeader(test.values); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseForwardedHeader(%q) = %q, want %q", test.values, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseXForwardedForHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"single", []string{"192.0.2.60"}, []string{"192.0.2.60"}},
+		{"list", []string{"192.0.2.43, 198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"several headers", []string{"192.0.2.43", "198.51.100.17"}, []string{"192.0.2.43", "198.51.100.17"}},
+		{"empty hops", []string{" ,192.0.2.43,, "}, []string{"192.0.2.43"}},
+		{"empty", nil, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseXForwardedForHeader(test.values); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseXForwardedForHeader(%q) = %q, want %q", test.values, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // empty if invalid
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:80", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]:80", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:80", "192.0.2.1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{" 192.0.2.1 ", "192.0.2.1"},
+		{"unknown", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		addr, err := ParseAddr(test.input)
+		got := ""
+		if err == nil {
+			got = addr.String()
+		}
+		if got != test.want {
+			t.Errorf("ParseAddr(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseAddrOrPrefix(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string // empty if invalid
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"2001:db8::/32", "2001:db8::/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"::ffff:10.0.0.0/104", "10.0.0.0/8"},
+		{"10.0.0.0/33", ""},
+		{"not a prefix", ""},
+	}
+
+	for _, test := range tests {
+		prefix, err := ParseAddrOrPrefix(test.input)
+		got := ""
+		if err == nil {
+			got = prefix.String()
+		}
+		if got != test.want {
+			t.Errorf("ParseAddrOrPrefix(%q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestClientIPResolverResolve(t *testing.T) {
+	tests := []struct {
+		name       string
+		useHeaders bool
+		peer       string
+		forwarded  string
+		xForwarded string
+		want       string
+	}{
+		{"headers disabled", false, "10.0.0.1", "", "192.0.2.1", "10.0.0.1"},
+		{"untrusted peer", true, "198.51.100.1", "", "192.0.2.1", "198.51.100.1"},
+		{"trusted peer, x-forwarded-for", true, "10.0.0.1", "", "192.0.2.1", "192.0.2.1"},
+		{"trusted peer, forwarded", true, "10.0.0.1", "for=192.0.2.1", "", "192.0.2.1"},
+		{"forwarded takes precedence", true, "10.0.0.1", "for=192.0.2.1", "192.0.2.2", "192.0.2.1"},
+		{"trusted peer without headers", true, "10.0.0.1", "", "", "10.0.0.1"},
+		{"spoofed leftmost hop", true, "10.0.0.1", "", "203.0.113.9, 192.0.2.1", "192.0.2.1"},
+		{"chain of trusted proxies", true, "10.0.0.1", "", "192.0.2.1, 10.0.0.2, 10.0.0.3", "192.0.2.1"},
+		{"only trusted hops", true, "10.0.0.1", "", "10.0.0.2", "10.0.0.2"},
+		{"garbled hop", true, "10.0.0.1", "", "192.0.2.1, garbage", "10.0.0.1"},
+		{"garbled hop behind a proxy", true, "10.0.0.1", "", "garbage, 10.0.0.2", "10.0.0.2"},
+		{"ipv6 hop", true, "10.0.0.1", `for="[2001:db8::1]:4711"`, "", "2001:db8::1"},
+		{"mapped ipv4 peer", true, "::ffff:10.0.0.1", "", "192.0.2.1", "192.0.2.1"},
+	}
+
+	resolvers := map[bool]*ClientIPResolver{}
+	for _, useHeaders := range []bool{false, true} {
+		resolver, err := NewClientIPResolver(useHeaders, []string{"10.0.0.0/8", "2001:db8:ffff::/48"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolvers[useHeaders] = resolver
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.forwarded != "" {
+				r.Header.Set("Forwarded", test.forwarded)
+			}
+			if test.xForwarded != "" {
+				r.Header.Set("X-Forwarded-For", test.xForwarded)
+			}
+			peer, _ := ParseAddr(test.peer)
+
+			got := resolvers[test.useHeaders].Resolve(r, peer)
+			if got != netip.MustParseAddr(test.want) {
+				t.Errorf("Resolve() = %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	if _, err := NewClientIPResolver(true, []string{"10.0.0.0/99"}); err == nil {
+		t.Error("NewClientIPResolver() accepted an invalid trusted proxy")
+	}
+}
@@ -2,31 +2,315 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
 	"sync/atomic"
 
 	"gopkg.in/yaml.v2"
 )
 
-func ReadConfig() SfUI {
-	// Any options not present in config.yaml will have default values
-	sfuiConfig := getDefaultConfig()
+const CONFIG_PATH = "config.yaml"
+const CONFIG_ENV_PREFIX = "SFUI_"
+const CONFIG_REDACTED = "<redacted>"
 
-	data, err := os.ReadFile("config.yaml")
-	if err != nil {
-		log.Println("Failed to read file : ", err, ", Using default configs")
-	}
+// Set with -config, if empty config.yaml in the working directory is used
+// when it exists
+var ConfigPath string
 
-	err = yaml.Unmarshal(data, &sfuiConfig)
+// Options whose values are hidden by -check-config, at any depth
+var secretOptions = map[string]bool{
+	"segfault_ssh_password": true,
+	"maintenance_secret":    true,
+	"admin_tokens":          true,
+	"metrics_scrape_token":  true,
+	"access_token_key":      true,
+	"elastic_password":      true,
+	"tracing_headers":       true,
+	"password":              true, // metric_sinks auth
+	"token":                 true, // metric_sinks auth, secret_backend
+}
+
+// Load and validate the config, the server must not start if this fails
+func ReadConfig() (SfUI, error) {
+	// Any options not present in the config will have default values
+	sfuiConfig, err := loadConfig(getDefaultConfig())
 	if err != nil {
-		log.Println("Failed Unmarshal data", err)
+		return sfuiConfig, err
+	}
+	if verr := validateConfig(&sfuiConfig); verr != nil {
+		return sfuiConfig, verr
 	}
 
 	sfuiConfig.CompiledClientConfig = getcompiledClientConfig(sfuiConfig)
+	sfuiConfig.ClientIPResolver, _ = NewClientIPResolver(sfuiConfig.UseXForwardedForHeader, sfuiConfig.TrustedProxies) // validated
+
+	validator, generator, serr := NewSecretBackend(sfuiConfig.SecretBackend)
+	if serr != nil {
+		return sfuiConfig, fmt.Errorf("invalid secret_backend, %s", serr)
+	}
+	sfuiConfig.SecretValidator = validator
+	sfuiConfig.SecretGenerator = generator
 	sfuiConfig.NoOfEndpoints = int32(len(sfuiConfig.SfEndpoints))
-	return sfuiConfig
+	return sfuiConfig, nil
+}
+
+// Read the config file over base, then apply the SFUI_* environment variables
+// and the *_file options. Unknown keys are rejected.
+func loadConfig(base SfUI) (SfUI, error) {
+	path := ConfigPath
+	if path == "" {
+		path = CONFIG_PATH
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !(os.IsNotExist(err) && ConfigPath == "") {
+		return base, err
+	}
+	if err != nil {
+		log.Printf("No %s, using the default config and %s* variables\n", CONFIG_PATH, CONFIG_ENV_PREFIX)
+	} else {
+		// Strict on a empty config, it would take keys of the default maps
+		// (ex: rate_limits) for duplicates
+		if serr := yaml.UnmarshalStrict(data, &SfUI{}); serr != nil {
+			return base, fmt.Errorf("%s: %s", path, serr)
+		}
+		if uerr := yaml.Unmarshal(data, &base); uerr != nil {
+			return base, fmt.Errorf("%s: %s", path, uerr)
+		}
+	}
+
+	if eerr := applyEnvOverrides(&base); eerr != nil {
+		return base, eerr
+	}
+	return base, readSecretFiles(&base)
+}
+
+// yaml key of a SfUI field, empty for fields that are not options
+func configOption(field reflect.StructField) string {
+	option := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if option == "-" {
+		return ""
+	}
+	return option
+}
+
+// Every option can be set with SFUI_<OPTION>, ex: SFUI_MAX_WS_TERMINALS=5.
+// Strings are used as is, other values are parsed as yaml, ex:
+// SFUI_SF_ENDPOINTS='[8lgm.segfault.net, adm.segfault.net]'. Lists and maps
+// replace the configured value, unset keys of objects keep theirs.
+func applyEnvOverrides(sfui *SfUI) error {
+	options := map[string]bool{}
+	value := reflect.ValueOf(sfui).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		option := configOption(value.Type().Field(i))
+		if option == "" {
+			continue
+		}
+		name := CONFIG_ENV_PREFIX + strings.ToUpper(option)
+		options[name] = true
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		field := value.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(env)
+			continue
+		}
+		parsed := reflect.New(field.Type())
+		if field.Kind() == reflect.Struct {
+			parsed.Elem().Set(field)
+		}
+		if err := yaml.UnmarshalStrict([]byte(env), parsed.Interface()); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		field.Set(parsed.Elem())
+	}
+
+	// Catch typos, they would otherwise be ignored
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if strings.HasPrefix(name, CONFIG_ENV_PREFIX) && !options[name] {
+			return fmt.Errorf("%s is not a option", name)
+		}
+	}
+	return nil
+}
+
+// Secrets can be read from files, ex: docker or kubernetes secrets. A
+// trailing newline is removed, the file takes precedence over the option.
+func readSecretFiles(sfui *SfUI) error {
+	type secretFile struct {
+		option string
+		path   string
+		secret *string
+	}
+	secretFiles := []secretFile{
+		{"segfault_ssh_password_file", sfui.SegfaultSSHPasswordFile, &sfui.SegfaultSSHPassword},
+		{"maintenance_secret_file", sfui.MaintenanceSecretFile, &sfui.MaintenanceSecret},
+		{"elastic_password_file", sfui.ElasticPasswordFile, &sfui.ElasticPassword},
+	}
+	for i := range sfui.MetricSinks {
+		auth := &sfui.MetricSinks[i].Auth
+		secretFiles = append(secretFiles,
+			secretFile{fmt.Sprintf("metric_sinks[%d].auth.password_file", i), auth.PasswordFile, &auth.Password},
+			secretFile{fmt.Sprintf("metric_sinks[%d].auth.token_file", i), auth.TokenFile, &auth.Token})
+	}
+	for _, secretFile := range secretFiles {
+		if secretFile.path == "" {
+			continue
+		}
+		data, err := os.ReadFile(secretFile.path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", secretFile.option, err)
+		}
+		*secretFile.secret = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
+// The config as yaml, with the values of secretOptions replaced
+func redactedConfig(sfui *SfUI) ([]byte, error) {
+	options := yaml.MapSlice{}
+	value := reflect.ValueOf(sfui).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if option := configOption(value.Type().Field(i)); option != "" {
+			options = append(options, yaml.MapItem{Key: option, Value: value.Field(i).Interface()})
+		}
+	}
+
+	// Round trip to get the nested objects as MapSlices
+	data, err := yaml.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	generic := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(redactSecrets(generic))
+}
+
+func redactSecrets(node interface{}) interface{} {
+	switch node := node.(type) {
+	case yaml.MapSlice:
+		for i, item := range node {
+			if key, _ := item.Key.(string); secretOptions[key] {
+				node[i].Value = redactValue(item.Value)
+			} else {
+				node[i].Value = redactSecrets(item.Value)
+			}
+		}
+	case []interface{}:
+		for i, item := range node {
+			node[i] = redactSecrets(item)
+		}
+	}
+	return node
+}
+
+// Empty values are kept, they show that a secret is not set
+func redactValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case yaml.MapSlice:
+		for i := range value {
+			value[i].Value = redactValue(value[i].Value)
+		}
+		return value
+	case nil:
+		return nil
+	case string:
+		if value == "" {
+			return value
+		}
+	}
+	return CONFIG_REDACTED
+}
+
+// Reject values the running server can not work with, all problems are
+// reported at once
+func validateConfig(sfui *SfUI) error {
+	problems := []string{}
+	if len(sfui.SfEndpoints) == 0 {
+		problems = append(problems, "sf_endpoints is empty")
+	}
+	for _, endpoint := range sfui.SfEndpoints {
+		if strings.TrimSpace(endpoint) == "" {
+			problems = append(problems, "sf_endpoints has a empty entry")
+		}
+	}
+	if _, port, err := net.SplitHostPort(sfui.ServerBindAddress); err != nil {
+		problems = append(problems, "server_bind_address is not a host:port, ex: 127.0.0.1:7171")
+	} else if number, perr := strconv.ParseUint(port, 10, 16); perr != nil || number == 0 {
+		problems = append(problems, "server_bind_address has a invalid port")
+	}
+	if sfui.VNCPort == 0 {
+		problems = append(problems, "vnc_port must be set")
+	}
+	if sfui.FileBrowserPort == 0 {
+		problems = append(problems, "filebrowser_port must be set")
+	}
+	if sfui.MaxWsTerminals <= 0 {
+		problems = append(problems, "max_ws_terminals must be greater than 0")
+	}
+	if sfui.WSPingInterval <= 0 {
+		problems = append(problems, "ws_ping_interval must be greater than 0")
+	}
+	if sfui.WSTimeout <= 0 {
+		problems = append(problems, "ws_timeout must be greater than 0")
+	}
+	if !sfui.DisableOriginCheck {
+		if origin, err := url.Parse(sfui.SfUIOrigin); err != nil || origin.Scheme == "" || origin.Host == "" {
+			problems = append(problems, "sf_ui_origin is not a valid origin, ex: https://web.segfault.net")
+		}
+	}
+	if _, err := NewClientIPResolver(sfui.UseXForwardedForHeader, sfui.TrustedProxies); err != nil {
+		problems = append(problems, fmt.Sprint("invalid trusted_proxies entry ", err))
+	}
+	if sfui.RateLimitIPv4Prefix < 0 || sfui.RateLimitIPv4Prefix > 32 {
+		problems = append(problems, "rate_limit_ipv4_prefix must be between 0 and 32")
+	}
+	if sfui.RateLimitIPv6Prefix < 0 || sfui.RateLimitIPv6Prefix > 128 {
+		problems = append(problems, "rate_limit_ipv6_prefix must be between 0 and 128")
+	}
+	// A batch that does not fit in the queue is never complete, it would only be
+	// written on the flush interval while events are dropped
+	if sfui.MetricLoggerQueueSize < 1 {
+		problems = append(problems, "metric_logger_queue_size must be at least 1")
+	}
+	if sfui.MetricBatchSize < 1 || sfui.MetricBatchSize > sfui.MetricLoggerQueueSize {
+		problems = append(problems, "metric_batch_size must be between 1 and metric_logger_queue_size")
+	}
+	for i, sink := range sfui.MetricSinks {
+		if sink.BatchSize > sfui.MetricLoggerQueueSize {
+			problems = append(problems, fmt.Sprintf("metric_sinks[%d].batch_size must not exceed metric_logger_queue_size", i))
+		}
+	}
+	// The name is the source reported for a ban, it has to tell the lists apart
+	blocklistNames := map[string]bool{}
+	for _, source := range sfui.Blocklists {
+		if source.Name != "" && blocklistNames[source.Name] {
+			problems = append(problems, fmt.Sprintf("blocklists has more than one list named %q", source.Name))
+		}
+		blocklistNames[source.Name] = true
+	}
+	if sfui.PoWMaxDifficulty > POW_DIFFICULTY_LIMIT || sfui.PoWDifficulty > sfui.PoWMaxDifficulty {
+		problems = append(problems, fmt.Sprintf("pow_difficulty must not exceed pow_max_difficulty, which must not exceed %d", POW_DIFFICULTY_LIMIT))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
 }
 
 func getDefaultConfig() SfUI {
@@ -38,29 +322,98 @@ func getDefaultConfig() SfUI {
 		SfEndpoints: []string{
 			"8lgm.segfault.net",
 			"adm.segfault.net"},
-		SfUIOrigin:              "http://127.0.0.1:7171",
-		DisableOriginCheck:      true,
-		UseXForwardedForHeader:  false,
-		DisableDesktop:          false,
-		StartXpraCommand:        "[[ $(ss -lnt) == *2000* ]] || /sf/bin/startxweb \n",
-		StartVNCCommand:         "[[ $(ss -lnt) == *5900* ]] || /sf/bin/startxvnc \n",
-		StartFileBrowserCommand: "[[ $(ss -lnt) == *2900* ]] || /sf/bin/startfb \n",
-		ClientInactivityTimeout: 3,
-		WSPingInterval:          20,
-		WSTimeout:               1080, // 18 Hours
-		ValidSecret:             regexp.MustCompile(`^[a-zA-Z0-9-]{6,}$`).MatchString,
-		EndpointSelector:        &atomic.Int32{},
-		VNCPort:                 5900,
-		FileBrowserPort:         2900,
-		SegfaultSSHUsername:     "root",
-		SegfaultSSHPassword:     "segfault",
-		SegfaultUseSSHKey:       false,
-		SegfaultSSHKeyPath:      "",
-		MaintenanceSecret:       RandomStr(42),
-		EnableMetricLogging:     false,
-		MetricLoggerQueueSize:   500,
-		GeoIpDBPath:             "geo.mmdb",
-		OpenObserveCompatible:   false,
+		SfUIOrigin:                  "http://127.0.0.1:7171",
+		DisableOriginCheck:          true,
+		UseXForwardedForHeader:      false,
+		TrustedProxies:              []string{"127.0.0.1/32", "::1/128"},
+		DisableDesktop:              false,
+		StartXpraCommand:            "[[ $(ss -lnt) == *2000* ]] || /sf/bin/startxweb \n",
+		StartVNCCommand:             "[[ $(ss -lnt) == *5900* ]] || /sf/bin/startxvnc \n",
+		StartFileBrowserCommand:     "[[ $(ss -lnt) == *2900* ]] || /sf/bin/startfb \n",
+		ClientInactivityTimeout:     3,
+		WSPingInterval:              20,
+		WSTimeout:                   1080, // 18 Hours
+		ValidSecret:                 regexp.MustCompile(`^[a-zA-Z0-9-]{6,}$`).MatchString,
+		EndpointSelector:            &atomic.Int32{},
+		VNCPort:                     5900,
+		FileBrowserPort:             2900,
+		SegfaultSSHUsername:         "root",
+		SegfaultSSHPassword:         "segfault",
+		SegfaultUseSSHKey:           false,
+		SegfaultSSHKeyPath:          "",
+		MaintenanceSecret:           RandomStr(42),
+		EnableMetricLogging:         false,
+		MetricLoggerQueueSize:       500,
+		GeoIpDBPath:                 "geo.mmdb",
+		GeoIpASNDBPath:              "asn.mmdb",
+		OpenObserveCompatible:       false,
+		BanDBPath:                   "banDB.json",
+		AccessPolicyPath:            "accessPolicy.json",
+		TusMaxUploadSize:            4 << 30, // 4 GiB
+		TusClientQuota:              8 << 30, // 8 GiB
+		TusUploadExpiry:             1440,    // 24 Hours
+		AccessTokenKey:              "",
+		AccessTokenTTL:              900, // 15 Minutes
+		AllowSecretAuth:             false,
+		DownloadLinkMaxExpiry:       10080, // 7 Days
+		DownloadLinkMaxPerClient:    20,
+		ProxyProtocol:               false,
+		ProxyProtocolTrustedSources: []string{"127.0.0.1/32", "::1/128"},
+		ProxyProtocolHeaderTimeout:  5,
+		EnableRateLimits:            false,
+		RateLimits: map[string]RateLimit{
+			RATE_LIMIT_NEW_ACCOUNT:   {Limit: 10, PrefixLimit: 50, Window: 3600},
+			RATE_LIMIT_LOGIN:         {Limit: 30, PrefixLimit: 150, Window: 60},
+			RATE_LIMIT_WS_CONNECT:    {Limit: 60, PrefixLimit: 300, Window: 60},
+			RATE_LIMIT_SHARE_JOIN:    {Limit: 30, PrefixLimit: 150, Window: 60},
+			RATE_LIMIT_LINK_DOWNLOAD: {Limit: 60, PrefixLimit: 300, Window: 60},
+		},
+		RateLimitIPv4Prefix: 24,
+		RateLimitIPv6Prefix: 64,
+		AutoBanViolations:   20,
+		AutoBanWindow:       10,
+		AutoBanDuration:     30,
+		AutoBanMaxDuration:  1440, // 24 Hours
+		PoWEnabled:          false,
+		PoWDifficulty:       16,
+		PoWMaxDifficulty:    24,
+		PoWChallengeTTL:     300, // 5 Minutes
+		PoWScaleWindow:      60,
+		PoWScaleSteps: map[string]int{
+			POW_SCALE_PREFIX:  5,
+			POW_SCALE_ASN:     50,
+			POW_SCALE_COUNTRY: 200,
+		},
+		SecretBackend: SecretBackendConfig{
+			Type:     SECRET_BACKEND_LOCAL,
+			Timeout:  5,
+			CacheTTL: 60,
+		},
+		MetricFlushInterval:   60,
+		MetricBatchSize:       500,
+		MetricMaxRetries:      5,
+		MetricRetryBackoff:    1,
+		MetricSpoolDir:        "metricSpool",
+		MetricSpoolMaxSize:    64,
+		MetricShutdownTimeout: 10,
+		TracingEndpoint:       "http://127.0.0.1:4318",
+		TracingServiceName:    "sfui",
+		TracingSampleRatio:    1,
+		TracingTimeout:        10,
+		PseudonymKeyPath:      "pseudonymKeys.json",
+		PseudonymKeyRotation:  0,
+		PseudonymKeyHistory:   3,
+		AnonymizeIPs:          false,
+		AnonymizeIPv4Prefix:   24,
+		AnonymizeIPv6Prefix:   48,
+		AdminRawIPs:           true,
+		GeoIpCityDBPath:       "city.mmdb",
+		GeoIpReloadInterval:   60,
+		GeoIpCacheSize:        10000,
+		EnableAnalytics:       true,
+		AnalyticsPath:         "analytics.json",
+		AnalyticsSaveInterval: 5,
+		AnalyticsRetention:    90,
 	}
 }
 
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		check func(sfui *SfUI) bool
+		valid bool
+	}{
+		{"no overrides", map[string]string{},
+			func(sfui *SfUI) bool {
+				return sfui.MaxWsTerminals == 10 && len(sfui.SfEndpoints) == 2 && sfui.SecretBackend.Type == SECRET_BACKEND_LOCAL
+			}, true},
+		{"string used as is", map[string]string{"SFUI_SF_UI_ORIGIN": "https://[not yaml"},
+			func(sfui *SfUI) bool { return sfui.SfUIOrigin == "https://[not yaml" }, true},
+		{"int", map[string]string{"SFUI_MAX_WS_TERMINALS": "5"},
+			func(sfui *SfUI) bool { return sfui.MaxWsTerminals == 5 }, true},
+		{"bool", map[string]string{"SFUI_DEBUG": "true"},
+			func(sfui *SfUI) bool { return sfui.Debug }, true},
+		{"list replaces the default", map[string]string{"SFUI_SF_ENDPOINTS": "[a.example.net]"},
+			func(sfui *SfUI) bool { return reflect.DeepEqual(sfui.SfEndpoints, []string{"a.example.net"}) }, true},
+		{"map replaces the default", map[string]string{"SFUI_POW_SCALE_STEPS": "{prefix: 2}"},
+			func(sfui *SfUI) bool { return reflect.DeepEqual(sfui.PoWScaleSteps, map[string]int{"prefix": 2}) }, true},
+		{"object keeps unset keys", map[string]string{"SFUI_SECRET_BACKEND": "{type: http, validate_url: 'http://127.0.0.1/v'}"},
+			func(sfui *SfUI) bool {
+				return sfui.SecretBackend.Type == SECRET_BACKEND_HTTP &&
+					sfui.SecretBackend.ValidateUrl == "http://127.0.0.1/v" && sfui.SecretBackend.CacheTTL == 60
+			}, true},
+		{"several overrides", map[string]string{"SFUI_DEBUG": "true", "SFUI_MAX_WS_TERMINALS": "3"},
+			func(sfui *SfUI) bool { return sfui.Debug && sfui.MaxWsTerminals == 3 }, true},
+		{"invalid int", map[string]string{"SFUI_MAX_WS_TERMINALS": "five"}, nil, false},
+		{"unknown object key", map[string]string{"SFUI_SECRET_BACKEND": "{typo: http}"}, nil, false},
+		{"unknown option", map[string]string{"SFUI_MAX_WS_TERMINAL": "5"}, nil, false},
+		{"internal field", map[string]string{"SFUI_NOOFENDPOINTS": "5"}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			sfui := getDefaultConfig()
+			err := applyEnvOverrides(&sfui)
+			if (err == nil) != test.valid {
+				t.Fatalf("applyEnvOverrides() error = %v, want valid %v", err, test.valid)
+			}
+			if test.valid && !test.check(&sfui) {
+				t.Errorf("applyEnvOverrides() did not apply %v", test.env)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		check  func(sfui *SfUI) bool
+		valid  bool
+	}{
+		{"file", "max_ws_terminals: 7\n", nil,
+			func(sfui *SfUI) bool { return sfui.MaxWsTerminals == 7 && sfui.MaxSharedDesktopConn == 4 }, true},
+		{"env takes precedence over the file", "max_ws_terminals: 7\n", map[string]string{"SFUI_MAX_WS_TERMINALS": "2"},
+			func(sfui *SfUI) bool { return sfui.MaxWsTerminals == 2 }, true},
+		{"secret file", "elastic_password: plain\nelastic_password_file: " + passwordFile + "\n", nil,
+			func(sfui *SfUI) bool { return sfui.ElasticPassword == "s3cret" }, true},
+		{"metric sink secret file", "metric_sinks:\n  - type: webhook\n    auth: {type: basic, password_file: " + passwordFile + "}\n", nil,
+			func(sfui *SfUI) bool { return sfui.MetricSinks[0].Auth.Password == "s3cret" }, true},
+		{"secret file from env", "", map[string]string{"SFUI_ELASTIC_PASSWORD_FILE": passwordFile},
+			func(sfui *SfUI) bool { return sfui.ElasticPassword == "s3cret" }, true},
+		{"missing secret file", "elastic_password_file: " + filepath.Join(dir, "missing") + "\n", nil, nil, false},
+		{"unknown key", "max_ws_terminal: 7\n", nil, nil, false},
+		{"internal field", "noofendpoints: 5\n", nil, nil, false},
+		{"duplicate key", "debug: true\ndebug: false\n", nil, nil, false},
+	}
+
+	saved := ConfigPath
+	defer func() { ConfigPath = saved }()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ConfigPath = filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(ConfigPath, []byte(test.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			sfui, err := loadConfig(getDefaultConfig())
+			if (err == nil) != test.valid {
+				t.Fatalf("loadConfig() error = %v, want valid %v", err, test.valid)
+			}
+			if test.valid && !test.check(&sfui) {
+				t.Errorf("loadConfig() did not apply the config")
+			}
+		})
+	}
+
+	ConfigPath = filepath.Join(dir, "missing.yaml")
+	if _, err := loadConfig(getDefaultConfig()); err == nil {
+		t.Error("loadConfig() of a missing -config file did not fail")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(sfui *SfUI)
+		valid  bool
+	}{
+		{"defaults", func(sfui *SfUI) {}, true},
+		{"no endpoints", func(sfui *SfUI) { sfui.SfEndpoints = nil }, false},
+		{"batch larger than the queue", func(sfui *SfUI) { sfui.MetricBatchSize = sfui.MetricLoggerQueueSize + 1 }, false},
+		{"blocklists", func(sfui *SfUI) {
+			sfui.Blocklists = []BlocklistSource{{Name: "a", Url: "/a"}, {Name: "b", Url: "/b"}}
+		}, true},
+		{"duplicate blocklist name", func(sfui *SfUI) {
+			sfui.Blocklists = []BlocklistSource{{Name: "a", Url: "/a"}, {Name: "a", Url: "/b"}}
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sfui := getDefaultConfig()
+			test.change(&sfui)
+			if err := validateConfig(&sfui); (err == nil) != test.valid {
+				t.Errorf("validateConfig() error = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
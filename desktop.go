@@ -1,37 +1,65 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
 func (sfui *SfUI) handleDesktopWS(w http.ResponseWriter, r *http.Request) {
 	//Get Secret
 	queryVals := r.URL.Query()
-	clientSecret := queryVals.Get("secret")
+	credential := queryVals.Get("token")
+	if credential == "" {
+		credential = queryVals.Get("secret")
+	}
 	desktopType := queryVals.Get("type")
 
-	if !sfui.ValidSecret(clientSecret) {
+	ctx, span := Tracer.StartRequestSpan(r, "sfui.desktop_proxy")
+	defer span.End()
+
+	if !Throttle.Allow(RATE_LIMIT_WS_CONNECT, sfui.getClientAddr(r)) {
+		span.SetOutcome("throttled")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`too many requests`))
+		return
+	}
+
+	clientSecret, serr := sfui.resolveCredential(credential, TOKEN_SCOPE_DESKTOP, sfui.getClientAddr(r))
+	if serr != nil {
+		span.SetOutcome("unauthorized")
 		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(`unacceptable secret`))
+		w.Write([]byte(serr.Error()))
 		return
 	}
 
 	defer sfui.RemoveClientIfInactive(clientSecret)
 
+	span.SetAttribute(SPAN_ATTR_CLIENT_ID, getClientId(clientSecret))
+
 	// Get the  associated client or create a new one
 	// client variable below will get stale
-	client, cerr := sfui.GetExistingClientOrMakeNew(clientSecret, sfui.getClientAddr(r))
+	client, cerr := sfui.GetExistingClientOrMakeNew(ctx, clientSecret, sfui.getClientAddr(r))
 	if cerr != nil {
+		span.SetOutcome("error")
+		span.SetError(cerr)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(cerr.Error()))
 		return
 	}
 
+	span.SetAttribute(SPAN_ATTR_ENDPOINT, client.SSHConnection.Host)
+
 	if client.DesktopActive.Load() {
+		span.SetOutcome("duplicate")
 		w.WriteHeader(http.StatusNotAcceptable)
 		w.Write([]byte(`can only have one desktop connection active at a time`))
 		return
@@ -41,16 +69,33 @@ func (sfui *SfUI) handleDesktopWS(w http.ResponseWriter, r *http.Request) {
 	defer client.DeActivateDesktop()
 	defer client.DeactivateDesktopSharing() // Remove all shares when master VNC connection exits
 
-	sfui.startDesktopService(&client, desktopType, time.Second*3)
+	sfui.startDesktopService(ctx, &client, desktopType, time.Second*3)
 
-	conn, err := client.SSHConnection.ForwardRemotePort(sfui.VNCPort)
+	conn, err := client.SSHConnection.ForwardRemotePort(ctx, sfui.VNCPort)
 	if err != nil {
+		span.SetOutcome("error")
+		span.SetError(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 	defer (*conn).Close()
 
+	if desktopType != "xpra" {
+		desktopType = "novnc"
+	}
+	span.SetAttribute(SPAN_ATTR_DESKTOP_TYPE, desktopType)
+	span.SetOutcome("ok")
+	startedAt := time.Now()
+	MLogger.LogEvent(Metric{Type: METRIC_DESKTOP_START, DesktopType: desktopType}, client.ClientIp)
+	defer func() {
+		MLogger.LogEvent(Metric{
+			Type:        METRIC_DESKTOP_STOP,
+			DesktopType: desktopType,
+			Duration:    time.Since(startedAt).Seconds(),
+		}, client.ClientIp)
+	}()
+
 	vncWebSockify(
 		conn,
 		false, // not view only
@@ -61,7 +106,13 @@ func (sfui *SfUI) handleDesktopWS(w http.ResponseWriter, r *http.Request) {
 }
 
 // Issue appropriate desktop start command(Type) using Pty and Wait for a certain duration
-func (sfui *SfUI) startDesktopService(client *Client, desktoptype string, wait time.Duration) {
+func (sfui *SfUI) startDesktopService(ctx context.Context, client *Client, desktoptype string, wait time.Duration) {
+	_, span := Tracer.StartSpan(ctx, "sfui.start_desktop", SPAN_KIND_INTERNAL)
+	span.SetAttribute(SPAN_ATTR_CLIENT_ID, client.ClientId)
+	span.SetAttribute(SPAN_ATTR_ENDPOINT, client.SSHConnection.Host)
+	span.SetAttribute(SPAN_ATTR_DESKTOP_TYPE, desktoptype)
+	defer span.End()
+
 	startCmd := ""
 	switch desktoptype {
 	case "xpra":
@@ -70,7 +121,12 @@ func (sfui *SfUI) startDesktopService(client *Client, desktoptype string, wait t
 		startCmd = sfui.StartVNCCommand
 	}
 
-	client.SSHConnection.RunControlCommand(startCmd)
+	if err := client.SSHConnection.RunControlCommand(startCmd); err != nil {
+		span.SetOutcome("error")
+		span.SetError(err)
+	} else {
+		span.SetOutcome("ok")
+	}
 
 	time.Sleep(wait)
 }
@@ -82,7 +138,31 @@ func (sfui *SfUI) handleSharedDesktopWS(w http.ResponseWriter, r *http.Request)
 	clientId := queryVals.Get("client_id")
 	shareSecret := queryVals.Get("secret")
 
+	ctx, span := Tracer.StartRequestSpan(r, "sfui.shared_desktop_proxy")
+	defer span.End()
+
+	if !Throttle.Allow(RATE_LIMIT_SHARE_JOIN, sfui.getClientAddr(r)) {
+		span.SetOutcome("throttled")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`too many requests`))
+		return
+	}
+
+	// A share token (issued on "verify") replaces client_id and secret
+	shareRef := ""
+	if shareToken := queryVals.Get("token"); shareToken != "" {
+		var terr error
+		clientId, shareRef, terr = verifyShareToken(shareToken, sfui.getClientAddr(r))
+		if terr != nil {
+			span.SetOutcome("unauthorized")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(terr.Error()))
+			return
+		}
+	}
+
 	if !sfui.ValidSecret(clientId) {
+		span.SetOutcome("unauthorized")
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`unacceptable secret`))
 		return
@@ -90,14 +170,26 @@ func (sfui *SfUI) handleSharedDesktopWS(w http.ResponseWriter, r *http.Request)
 
 	// Get the  associated client
 	// client variable below will get stale
+	span.SetAttribute(SPAN_ATTR_CLIENT_ID, clientId)
+
 	client, cerr := sfui.GetClientById(clientId)
 	if cerr != nil {
+		span.SetOutcome("inactive")
 		w.WriteHeader(http.StatusGone)
 		w.Write([]byte(`{"status":"desktop is not active"}`))
 		return
 	}
 
-	if client.SharedDesktopSecret != shareSecret {
+	span.SetAttribute(SPAN_ATTR_ENDPOINT, client.SSHConnection.Host)
+
+	if shareRef != "" {
+		shareSecret = client.SharedDesktopSecret
+		if subtle.ConstantTimeCompare([]byte(shareSecretRef(shareSecret)), []byte(shareRef)) != 1 {
+			shareSecret = ""
+		}
+	}
+	if shareSecret == "" || client.SharedDesktopSecret != shareSecret {
+		span.SetOutcome("unauthorized")
 		w.WriteHeader(http.StatusNotAcceptable)
 		w.Write([]byte(`unacceptable secret`))
 		return
@@ -105,20 +197,29 @@ func (sfui *SfUI) handleSharedDesktopWS(w http.ResponseWriter, r *http.Request)
 
 	serr := client.IncSharedDesktopConnCount()
 	if serr != nil {
+		span.SetOutcome("limit_reached")
 		w.WriteHeader(http.StatusTooManyRequests)
 		w.Write([]byte(`{"status":"maximum shares active"}`))
 		return
 	}
 	defer client.DecSharedDesktopConnCount()
 
-	conn, err := client.SSHConnection.ForwardRemotePort(sfui.VNCPort)
+	conn, err := client.SSHConnection.ForwardRemotePort(ctx, sfui.VNCPort)
 	if err != nil {
+		span.SetOutcome("error")
+		span.SetError(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 	defer (*conn).Close()
 
+	span.SetOutcome("ok")
+	MLogger.LogEvent(Metric{
+		Type:     METRIC_SHARE_JOINED,
+		ViewOnly: client.SharedDesktopIsViewOnly.Load(),
+	}, sfui.getClientAddr(r))
+
 	vncWebSockify(
 		conn,
 		client.SharedDesktopIsViewOnly.Load(),
@@ -130,11 +231,37 @@ func (sfui *SfUI) handleSharedDesktopWS(w http.ResponseWriter, r *http.Request)
 
 type DesktopShareRequest struct {
 	Secret   string `json:"secret"`
+	Token    string `json:"token"` // desktop token, replaces secret on activate and deactivate
 	ClientId string `json:"client_id"`
 	Action   string `json:"action"`
 	ViewOnly bool   `json:"view_only"`
 }
 
+// Share tokens carry a hash of the share secret, the payload of a token is
+// readable by its holder.
+func shareSecretRef(shareSecret string) string {
+	sum := sha256.Sum256([]byte(shareSecret))
+	return hex.EncodeToString(sum[:12])
+}
+
+// Return the client id and share secret reference from a share scoped token
+func verifyShareToken(token string, clientIp string) (clientId string, shareRef string, err error) {
+	accessToken, err := Tokens.Parse(token, clientIp)
+	if err != nil {
+		return "", "", err
+	}
+
+	if !strings.HasPrefix(accessToken.Scope, TOKEN_SCOPE_SHARE+":") {
+		return "", "", errors.New("token not valid for this resource")
+	}
+
+	if time.Now().After(accessToken.Expiry) {
+		return "", "", errors.New("token expired")
+	}
+
+	return accessToken.ClientId, strings.TrimPrefix(accessToken.Scope, TOKEN_SCOPE_SHARE+":"), nil
+}
+
 func (sfui *SfUI) handleSetupDesktopSharing(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
 	data, err := io.ReadAll(io.LimitReader(r.Body, 2048))
@@ -146,9 +273,24 @@ func (sfui *SfUI) handleSetupDesktopSharing(w http.ResponseWriter, r *http.Reque
 			var cerr error
 
 			if desktopShareReq.Action == "verify" {
+				if !Throttle.Allow(RATE_LIMIT_SHARE_JOIN, sfui.getClientAddr(r)) {
+					w.WriteHeader(http.StatusTooManyRequests)
+					w.Write([]byte(`{"status":"Too Many Requests"}`))
+					return
+				}
 				client, cerr = sfui.GetClientById(desktopShareReq.ClientId)
 			} else {
-				client, cerr = sfui.GetClient(desktopShareReq.Secret)
+				credential := desktopShareReq.Token
+				if credential == "" {
+					credential = desktopShareReq.Secret
+				}
+				clientSecret, serr := sfui.resolveCredential(credential, TOKEN_SCOPE_DESKTOP, sfui.getClientAddr(r))
+				if serr != nil {
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(`{"status":"unacceptable secret"}`))
+					return
+				}
+				client, cerr = sfui.GetClient(clientSecret)
 			}
 
 			if cerr != nil {
@@ -175,6 +317,8 @@ func (sfui *SfUI) handleSetupDesktopSharing(w http.ResponseWriter, r *http.Reque
 				alreadyShared := client.ActivateDesktopSharing(desktopShareReq.ViewOnly, sharedSecret)
 				if alreadyShared {
 					sharedSecret = client.SharedDesktopSecret
+				} else {
+					MLogger.LogEvent(Metric{Type: METRIC_SHARE_CREATED, ViewOnly: desktopShareReq.ViewOnly}, client.ClientIp)
 				}
 				w.WriteHeader(http.StatusOK)
 				w.Write([]byte(fmt.Sprintf(`{"status":"OK","client_id":"%s","share_secret":"%s"}`,
@@ -182,13 +326,16 @@ func (sfui *SfUI) handleSetupDesktopSharing(w http.ResponseWriter, r *http.Reque
 				return
 			case "deactivate":
 				client.DeactivateDesktopSharing()
+				MLogger.LogEvent(Metric{Type: METRIC_SHARE_REVOKED}, client.ClientIp)
 				w.WriteHeader(http.StatusOK)
 				w.Write([]byte(`{"status":"OK"}`))
 				return
 			case "verify":
 				if client.ShareDesktop.Load() && (client.SharedDesktopSecret == desktopShareReq.Secret) {
+					shareToken := Tokens.Issue(TOKEN_SCOPE_SHARE+":"+shareSecretRef(desktopShareReq.Secret), client.ClientId,
+						sfui.getClientAddr(r), time.Now().Add(time.Second*time.Duration(sfui.AccessTokenTTL)))
 					w.WriteHeader(http.StatusOK)
-					w.Write([]byte(`{"status":"OK"}`))
+					w.Write([]byte(fmt.Sprintf(`{"status":"OK","token":"%s"}`, shareToken)))
 				} else {
 					w.WriteHeader(http.StatusForbidden)
 					w.Write([]byte(`{"status":"Desktop Not Shared"}`))
@@ -73,7 +73,7 @@ export function download(format, ...files) {
 
   if (store.state.jwt) {
     url += `auth=${store.state.jwt}&`;
-    url += `sf-secret=${window.SfUiSecret}&`;
+    url += `sf-token=${window.SfUiToken}&`;
   }
 
   window.open(url);
@@ -113,7 +113,7 @@ async function postResources(url, content = "", overwrite = false, onupload) {
       true
     );
     request.setRequestHeader("X-Auth", store.state.jwt);
-    request.setRequestHeader("X-SfUi-Token", window.SfUiSecret);
+    request.setRequestHeader("X-SfUi-Token", window.SfUiToken);
 
     if (typeof onupload === "function") {
       request.upload.onprogress = onupload;
@@ -168,7 +168,7 @@ export async function checksum(url, algo) {
 export function getDownloadURL(file, inline) {
   const params = {
     ...(inline && { inline: "true" }),
-    ...{ "sf-secret": window.SfUiSecret }
+    ...{ "sf-token": window.SfUiToken }
   };
 
   return createURL("api/raw" + file.path, params);
@@ -178,7 +178,7 @@ export function getPreviewURL(file, size) {
   const params = {
     inline: "true",
     key: Date.parse(file.modified),
-    "sf-secret": window.SfUiSecret,
+    "sf-token": window.SfUiToken,
   };
 
   return createURL("api/preview/" + size + file.path, params);
@@ -33,7 +33,7 @@ export async function upload(
       storeFingerprintForResuming: false,
       headers: {
         "X-Auth": store.state.jwt,
-        "X-SfUi-Token" : window.SfUiSecret,
+        "X-SfUi-Token" : window.SfUiToken,
       },
       onError: function (error) {
         delete CURRENT_UPLOAD_LIST[filePath];
@@ -13,7 +13,7 @@ export async function fetchURL(url, opts, auth = true) {
     res = await fetch(`${baseURL}${url}`, {
       headers: {
         "X-Auth": store.state.jwt,
-        "X-SfUi-Token" : window.SfUiSecret,
+        "X-SfUi-Token" : window.SfUiToken,
         ...headers,
       },
       ...rest,
@@ -38,7 +38,7 @@ export async function login(username, password, recaptcha) {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
-        "X-SfUi-Token" : window.SfUiSecret,
+        "X-SfUi-Token" : window.SfUiToken,
       },
       body: JSON.stringify(data),
     },
@@ -59,7 +59,7 @@ export async function renew(jwt) {
     method: "POST",
     headers: {
       "X-Auth": jwt,
-      "X-SfUi-Token" : window.SfUiSecret,
+      "X-SfUi-Token" : window.SfUiToken,
     },
   });
 
@@ -81,7 +81,7 @@ export async function signup(username, password) {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
-        "X-SfUi-Token" : window.SfUiSecret,
+        "X-SfUi-Token" : window.SfUiToken,
       },
       body: JSON.stringify(data),
     },
@@ -14,46 +14,55 @@ func (sfui *SfUI) handleFileBrowser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientSecret := r.Header.Get("X-SfUi-Token")
-	if clientSecret == "" {
-		clientSecret = r.URL.Query().Get("sf-secret")
-	}
+	ctx, span := Tracer.StartRequestSpan(r, "sfui.filebrowser_proxy")
+	defer span.End()
 
-	if !sfui.ValidSecret(clientSecret) {
+	clientSecret, serr := sfui.resolveCredential(getFilesCredential(r), TOKEN_SCOPE_FILES, sfui.getClientAddr(r))
+	if serr != nil {
+		span.SetOutcome("unauthorized")
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte(`{"status":"Invalid Secret"}`))
 		return
 	}
 
+	span.SetAttribute(SPAN_ATTR_CLIENT_ID, getClientId(clientSecret))
+
 	client, err := sfui.GetClient(clientSecret)
 	if err != nil {
+		span.SetOutcome("inactive")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(fmt.Sprintf(`{"status":"%s"}`, err.Error())))
 		return
 	}
 
-	conn, err := client.SSHConnection.ForwardRemotePort(sfui.FileBrowserPort)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf(`{"status":"%s"}`, err.Error())))
-		return
-	}
-	defer (*conn).Close()
+	span.SetAttribute(SPAN_ATTR_ENDPOINT, client.SSHConnection.Host)
 
-	FileBrowserProxy, perr := NewHttpToNetConnProxy(conn)
-	if perr != nil {
+	if client.FileBrowserProxy == nil {
+		span.SetOutcome("error")
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf(`{"status":"%s"}`, perr.Error())))
+		w.Write([]byte(`{"status":"filebrowser proxy unavailable"}`))
 		return
 	}
 
 	r.URL.Path = strings.Replace(r.URL.Path, "/filebrowser", "", 1)
-	FileBrowserProxy.ServeHTTP(w, r)
+	if r.Body != nil {
+		r.Body = io.NopCloser(&promCountingReader{Reader: r.Body, channel: PROM_CHANNEL_FILEBROWSER, direction: PROM_DIRECTION_IN})
+	}
+	writer := &promCountingResponseWriter{ResponseWriter: w, channel: PROM_CHANNEL_FILEBROWSER}
+	client.FileBrowserProxy.ServeHTTP(writer, r.WithContext(ctx)) // ctx carries the span to ForwardRemotePort
+
+	span.SetAttribute(SPAN_ATTR_HTTP_STATUS, writer.Status())
+	if writer.Status() >= http.StatusInternalServerError {
+		span.SetOutcome("error")
+	} else {
+		span.SetOutcome("ok")
+	}
 }
 
 type setupFileBrowser struct {
 	DesktopType  string `json:"desktop_type"` // xpra,novnc
 	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"` // files token, replaces client_secret
 }
 
 // start the GUI service on the instance(ex: startfb), use the master connection
@@ -64,14 +73,19 @@ func (sfui *SfUI) handleSetupFileBrowser(w http.ResponseWriter, r *http.Request)
 	if err == nil {
 		setupFileBrowserReq := setupFileBrowser{}
 		if json.Unmarshal(data, &setupFileBrowserReq) == nil {
-			if !sfui.ValidSecret(setupFileBrowserReq.ClientSecret) {
+			credential := setupFileBrowserReq.Token
+			if credential == "" {
+				credential = setupFileBrowserReq.ClientSecret
+			}
+			clientSecret, serr := sfui.resolveCredential(credential, TOKEN_SCOPE_FILES, sfui.getClientAddr(r))
+			if serr != nil {
 				w.Write([]byte(`unacceptable secret`))
 				return
 			}
 
 			// Get the  associated client
 			// client variable below will get stale
-			client, cerr := sfui.GetClient(setupFileBrowserReq.ClientSecret)
+			client, cerr := sfui.GetClient(clientSecret)
 			if cerr != nil {
 				w.WriteHeader(http.StatusUnavailableForLegalReasons)
 				w.Write([]byte(fmt.Sprintf(`{"status":"%s"}`, cerr.Error())))
@@ -91,7 +105,7 @@ func (sfui *SfUI) handleSetupFileBrowser(w http.ResponseWriter, r *http.Request)
 				defer client.mu.Unlock()
 
 				// master SSH socket is now active, grab a fresh copy of the client
-				client, _ = sfui.GetClient(setupFileBrowserReq.ClientSecret)
+				client, _ = sfui.GetClient(clientSecret)
 			}
 
 			rerr := client.SSHConnection.RunControlCommand(sfui.StartFileBrowserCommand)
@@ -103,6 +117,8 @@ func (sfui *SfUI) handleSetupFileBrowser(w http.ResponseWriter, r *http.Request)
 
 			time.Sleep(time.Second * 3) // :-) elite strategy to make sure that filebrowser is active
 
+			MLogger.LogEvent(Metric{Type: METRIC_FILEBROWSER_SETUP}, client.ClientIp)
+
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte(`{"status":"OK"}`))
 			return
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Native file api, operates on the instance using the SFTP subsystem of the
+// master SSH connection, does not depend on the remote filebrowser.
+//
+//	GET    /files/list?path=       list a directory
+//	GET    /files/stat?path=       stat a file or directory
+//	POST   /files/mkdir?path=      create a directory (and parents)
+//	POST   /files/rename?path=&to= rename / move
+//	POST   /files/delete?path=     delete a file or a directory (recursive)
+//	GET    /files/download?path=   download a file, supports Range requests
+//	POST   /files/upload?path=     upload request body to path (PUT also accepted)
+//	GET    /files/zip?path=        download a directory as a zip archive
+//	*      /files/links/*          public download links, see links.go
+var isFilesPath = regexp.MustCompile(`(?m)^/files/.*`).MatchString
+
+type FileInfo struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	Mode    string `json:"mode"`
+	ModTime string `json:"mod_time"`
+	IsDir   bool   `json:"is_dir"`
+}
+
+type FileListResponse struct {
+	Status string     `json:"status"`
+	Path   string     `json:"path"`
+	Files  []FileInfo `json:"files"`
+}
+
+func newFileInfo(dir string, fi os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    fi.Name(),
+		Path:    path.Join(dir, fi.Name()),
+		Size:    fi.Size(),
+		Mode:    fi.Mode().String(),
+		ModTime: fi.ModTime().UTC().Format(time.RFC3339),
+		IsDir:   fi.IsDir(),
+	}
+}
+
+func (sfui *SfUI) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	clientSecret, serr := sfui.resolveCredential(getFilesCredential(r), TOKEN_SCOPE_FILES, sfui.getClientAddr(r))
+	if serr != nil {
+		writeFilesError(w, http.StatusForbidden, serr.Error())
+		return
+	}
+
+	client, err := sfui.GetClient(clientSecret)
+	if err != nil {
+		writeFilesError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	sftpClient, err := client.SSHConnection.GetSFTPClient()
+	if err != nil {
+		writeFilesError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	filePath := cleanFilePath(r.URL.Query().Get("path"))
+	operation := strings.TrimPrefix(r.URL.Path, "/files/")
+
+	// /files/links/*, public download links
+	if strings.HasPrefix(operation, "links/") {
+		sfui.handleDownloadLinks(w, r, strings.TrimPrefix(operation, "links/"), clientSecret, client, sftpClient)
+		return
+	}
+
+	switch operation {
+	case "list":
+		if r.Method != http.MethodGet {
+			break
+		}
+		handleFilesList(w, sftpClient, filePath)
+		return
+	case "stat":
+		if r.Method != http.MethodGet {
+			break
+		}
+		handleFilesStat(w, sftpClient, filePath)
+		return
+	case "mkdir":
+		if r.Method != http.MethodPost {
+			break
+		}
+		if err := sftpClient.MkdirAll(filePath); err != nil {
+			writeFilesError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeFilesOK(w)
+		return
+	case "rename":
+		if r.Method != http.MethodPost {
+			break
+		}
+		to := r.URL.Query().Get("to")
+		if to == "" {
+			writeFilesError(w, http.StatusBadRequest, "missing destination")
+			return
+		}
+		if err := sftpClient.Rename(filePath, cleanFilePath(to)); err != nil {
+			writeFilesError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeFilesOK(w)
+		return
+	case "delete":
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			break
+		}
+		if err := sftpClient.RemoveAll(filePath); err != nil {
+			writeFilesError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeFilesOK(w)
+		return
+	case "download":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			break
+		}
+		if size, complete := handleFilesDownload(w, r, sftpClient, filePath); complete {
+			MLogger.LogEvent(Metric{Type: METRIC_FILE_DOWNLOAD, Source: "files", Size: size}, client.ClientIp)
+		}
+		return
+	case "upload":
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			break
+		}
+		if size, complete := handleFilesUpload(w, r, sftpClient, filePath); complete {
+			MLogger.LogEvent(Metric{Type: METRIC_FILE_UPLOAD, Source: "files", Size: size}, client.ClientIp)
+		}
+		return
+	case "zip":
+		if r.Method != http.MethodGet {
+			break
+		}
+		if size, complete := handleFilesZip(w, sftpClient, filePath); complete {
+			MLogger.LogEvent(Metric{Type: METRIC_FILE_DOWNLOAD, Source: "zip", Size: size}, client.ClientIp)
+		}
+		return
+	default:
+		writeFilesError(w, http.StatusNotFound, "unknown operation")
+		return
+	}
+
+	writeFilesError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func handleFilesList(w http.ResponseWriter, sftpClient *sftp.Client, dir string) {
+	entries, err := sftpClient.ReadDir(dir)
+	if err != nil {
+		writeFilesError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	listing := FileListResponse{
+		Status: "OK",
+		Path:   dir,
+		Files:  make([]FileInfo, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		listing.Files = append(listing.Files, newFileInfo(dir, entry))
+	}
+
+	writeFilesJSON(w, listing)
+}
+
+func handleFilesStat(w http.ResponseWriter, sftpClient *sftp.Client, filePath string) {
+	fi, err := sftpClient.Stat(filePath)
+	if err != nil {
+		writeFilesError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeFilesJSON(w, newFileInfo(path.Dir(filePath), fi))
+}
+
+// Stream a file from the instance, http.ServeContent takes care of Range requests
+// complete is true for a full (not ranged) GET of the file, size is its size
+func handleFilesDownload(w http.ResponseWriter, r *http.Request, sftpClient *sftp.Client, filePath string) (size int64, complete bool) {
+	file, err := sftpClient.Open(filePath)
+	if err != nil {
+		writeFilesError(w, http.StatusNotFound, err.Error())
+		return 0, false
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		writeFilesError(w, http.StatusInternalServerError, err.Error())
+		return 0, false
+	}
+
+	if fi.IsDir() {
+		writeFilesError(w, http.StatusBadRequest, "is a directory, use /files/zip")
+		return 0, false
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": fi.Name()}))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), file)
+	return fi.Size(), r.Method == http.MethodGet && r.Header.Get("Range") == ""
+}
+
+// Stream the request body into a file on the instance, returns the no of
+// bytes written and whether the upload succeeded
+func handleFilesUpload(w http.ResponseWriter, r *http.Request, sftpClient *sftp.Client, filePath string) (size int64, complete bool) {
+	file, err := sftpClient.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		writeFilesError(w, http.StatusInternalServerError, err.Error())
+		return 0, false
+	}
+	defer file.Close()
+
+	size, err = io.Copy(file, r.Body)
+	if err != nil {
+		writeFilesError(w, http.StatusInternalServerError, err.Error())
+		return size, false
+	}
+
+	writeFilesOK(w)
+	return size, true
+}
+
+// Walk a directory on the instance and write a zip archive on the fly,
+// nothing is buffered on either end. size is the no of (uncompressed)
+// bytes archived, complete is false if the client went away.
+func handleFilesZip(w http.ResponseWriter, sftpClient *sftp.Client, dir string) (size int64, complete bool) {
+	fi, err := sftpClient.Stat(dir)
+	if err != nil {
+		writeFilesError(w, http.StatusNotFound, err.Error())
+		return 0, false
+	}
+	if !fi.IsDir() {
+		writeFilesError(w, http.StatusBadRequest, "not a directory")
+		return 0, false
+	}
+
+	archiveName := path.Base(dir)
+	if archiveName == "/" || archiveName == "." {
+		archiveName = "files"
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": archiveName + ".zip"}))
+	w.WriteHeader(http.StatusOK)
+
+	zipWriter := zip.NewWriter(w)
+	defer zipWriter.Close()
+
+	walker := sftpClient.Walk(dir)
+	for walker.Step() {
+		if walker.Err() != nil {
+			continue // Unreadable entry, skip it
+		}
+
+		entry := walker.Stat()
+		relPath := zipRelPath(dir, walker.Path())
+		if relPath == "" || !(entry.Mode().IsRegular() || entry.IsDir()) {
+			continue
+		}
+
+		header, herr := zip.FileInfoHeader(entry)
+		if herr != nil {
+			continue
+		}
+		header.Name = path.Join(archiveName, relPath)
+		if entry.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+
+		entryWriter, zerr := zipWriter.CreateHeader(header)
+		if zerr != nil {
+			return size, false // client went away
+		}
+
+		if entry.IsDir() {
+			continue
+		}
+
+		file, ferr := sftpClient.Open(walker.Path())
+		if ferr != nil {
+			continue
+		}
+		written, cerr := io.Copy(entryWriter, file)
+		file.Close()
+		size += written
+		if cerr != nil {
+			return size, false
+		}
+	}
+	return size, true
+}
+
+// Path of a walked entry inside the archive, dir is cleaned. Walking "." yields
+// paths without a "./" prefix (ex: ".bashrc"), so there is nothing to strip.
+func zipRelPath(dir string, entryPath string) string {
+	if entryPath == dir {
+		return ""
+	}
+	if dir == "." {
+		return entryPath
+	}
+	return strings.TrimPrefix(entryPath, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// Access token (or secret) used by the filebrowser proxy and the file api
+func getFilesCredential(r *http.Request) string {
+	credential := r.Header.Get("X-SfUi-Token")
+	if credential == "" {
+		credential = r.URL.Query().Get("sf-token")
+	}
+	if credential == "" {
+		credential = r.URL.Query().Get("sf-secret")
+	}
+	return credential
+}
+
+// Paths are relative to the users home directory unless absolute
+func cleanFilePath(filePath string) string {
+	if filePath == "" {
+		return "."
+	}
+	return path.Clean(filePath)
+}
+
+func writeFilesJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	jb, err := json.Marshal(v)
+	if err != nil {
+		writeFilesError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(jb)
+}
+
+func writeFilesOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"OK"}`))
+}
+
+func writeFilesError(w http.ResponseWriter, code int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	statusBytes, _ := json.Marshal(status)
+	w.Write([]byte(fmt.Sprintf(`{"status":%s}`, statusBytes)))
+}
@@ -1,44 +1,259 @@
 package main
 
 import (
+	"container/list"
 	"errors"
+	"log"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/oschwald/maxminddb-golang"
 )
 
-var db *maxminddb.Reader
-var IsActive bool
+// Resolves addresses to a location and network using MaxMind databases
+// (GeoLite2 Country, City and ASN). The databases are read into memory and
+// reloaded when their files change, a reader is swapped atomically so lookups
+// are never blocked by a reload and never see a half written database.
+type GeoInfo struct {
+	Country string `json:"country,omitempty"` // ISO code
+	City    string `json:"city,omitempty"`    // English name
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"` // Organization the ASN is registered to
+}
+
+type geoDatabase struct {
+	path    string
+	reader  atomic.Pointer[maxminddb.Reader]
+	modTime time.Time
+}
+
+type GeoResolver struct {
+	country        *geoDatabase
+	city           *geoDatabase
+	asn            *geoDatabase
+	reloadInterval time.Duration
+	cache          *geoCache
+}
 
-func GeoIpInit(FilePath string) error {
-	var err error
-	db, err = maxminddb.Open(FilePath)
-	if err == nil {
-		IsActive = true
+var Geo = GeoResolver{}
+
+var errGeoUninitialized = errors.New("MMDB Uninitialized")
+
+// Load the databases that are present, the others are loaded once they
+// appear. A empty path disables a database.
+func (resolver *GeoResolver) Init(sfui *SfUI) {
+	resolver.country = &geoDatabase{path: sfui.GeoIpDBPath}
+	resolver.city = &geoDatabase{path: sfui.GeoIpCityDBPath}
+	resolver.asn = &geoDatabase{path: sfui.GeoIpASNDBPath}
+	resolver.reloadInterval = time.Second * time.Duration(sfui.GeoIpReloadInterval)
+	resolver.cache = newGeoCache(sfui.GeoIpCacheSize)
+
+	for _, database := range resolver.databases() {
+		if err := database.load(); err != nil && (!os.IsNotExist(err) || sfui.EnableMetricLogging) {
+			log.Println(err)
+		}
 	}
-	return err
+
+	if resolver.reloadInterval > 0 {
+		go resolver.watchFiles()
+	}
+}
+
+func (resolver *GeoResolver) databases() []*geoDatabase {
+	return []*geoDatabase{resolver.country, resolver.city, resolver.asn}
 }
 
-func GeoIpClose() error {
-	if db != nil {
-		return db.Close()
+// Read the database if its file was modified since it was last loaded, the
+// current reader is kept if the file can not be read or is invalid
+func (database *geoDatabase) load() error {
+	if database.path == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(database.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(database.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(database.path)
+	if err != nil {
+		return err
+	}
+	// FromBytes instead of Open, a mmap'd reader can not be closed while
+	// lookups may still be using it
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return err
+	}
+
+	previous := database.reader.Swap(reader)
+	database.modTime = fi.ModTime()
+	if previous != nil {
+		log.Printf("Reloaded %s from %s\n", reader.Metadata.DatabaseType, database.path)
+	} else {
+		log.Printf("Loaded %s from %s\n", reader.Metadata.DatabaseType, database.path)
 	}
 	return nil
 }
 
-func GeoIpLookup(IP string) (string, error) {
-	if IsActive {
-		ip := net.ParseIP(IP)
+func (resolver *GeoResolver) watchFiles() {
+	for {
+		time.Sleep(resolver.reloadInterval)
+		reloaded := false
+		for _, database := range resolver.databases() {
+			previous := database.reader.Load()
+			if err := database.load(); err != nil && !os.IsNotExist(err) {
+				log.Println("Failed to reload", database.path, err)
+			}
+			reloaded = reloaded || database.reader.Load() != previous
+		}
+		if reloaded {
+			resolver.cache.Purge()
+		}
+	}
+}
 
+// Lookup the location and network of a address, fails if no database is
+// loaded. Fields the loaded databases do not provide are left empty.
+func (resolver *GeoResolver) Lookup(ip string) (GeoInfo, error) {
+	if resolver.cache == nil {
+		return GeoInfo{}, errGeoUninitialized
+	}
+	if info, ok := resolver.cache.Get(ip); ok {
+		return info, nil
+	}
+
+	country := resolver.country.reader.Load()
+	city := resolver.city.reader.Load()
+	asn := resolver.asn.reader.Load()
+	if country == nil && city == nil && asn == nil {
+		return GeoInfo{}, errGeoUninitialized
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return GeoInfo{}, errors.New("invalid ip " + ip)
+	}
+
+	info := GeoInfo{}
+	if city != nil {
 		var record struct {
 			Country struct {
 				ISOCode string `maxminddb:"iso_code"`
 			} `maxminddb:"country"`
+			City struct {
+				Names map[string]string `maxminddb:"names"`
+			} `maxminddb:"city"`
 		}
+		if err := city.Lookup(addr, &record); err != nil {
+			return GeoInfo{}, err
+		}
+		info.Country = record.Country.ISOCode
+		info.City = record.City.Names["en"]
+	}
+	if country != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := country.Lookup(addr, &record); err != nil {
+			return GeoInfo{}, err
+		}
+		if record.Country.ISOCode != "" {
+			info.Country = record.Country.ISOCode
+		}
+	}
+	if asn != nil {
+		var record struct {
+			ASN          uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := asn.Lookup(addr, &record); err != nil {
+			return GeoInfo{}, err
+		}
+		info.ASN = record.ASN
+		info.Org = record.Organization
+	}
 
-		err := db.Lookup(ip, &record)
+	resolver.cache.Add(ip, info)
+	return info, nil
+}
 
-		return record.Country.ISOCode, err
+func GetCountryByIp(ip string) string {
+	info, err := Geo.Lookup(ip)
+	if err != nil {
+		return "WORLD"
 	}
-	return "", errors.New("MMDB Uninitialized")
+	if info.Country == "" {
+		return "LOCAL"
+	}
+	return info.Country
+}
+
+// Least recently used cache of lookups, a size of 0 disables it
+type geoCache struct {
+	size    int
+	mu      *sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is the most recently used
+}
+
+type geoCacheEntry struct {
+	ip   string
+	info GeoInfo
+}
+
+func newGeoCache(size int) *geoCache {
+	return &geoCache{
+		size:    size,
+		mu:      &sync.Mutex{},
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (cache *geoCache) Get(ip string) (GeoInfo, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.entries[ip]
+	if !ok {
+		return GeoInfo{}, false
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*geoCacheEntry).info, true
+}
+
+func (cache *geoCache) Add(ip string, info GeoInfo) {
+	if cache.size <= 0 {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if element, ok := cache.entries[ip]; ok {
+		element.Value.(*geoCacheEntry).info = info
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[ip] = cache.order.PushFront(&geoCacheEntry{ip: ip, info: info})
+	if cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*geoCacheEntry).ip)
+	}
+}
+
+func (cache *geoCache) Purge() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.entries = make(map[string]*list.Element)
+	cache.order.Init()
 }
@@ -6,8 +6,12 @@ require golang.org/x/net v0.11.0
 
 require (
 	github.com/oschwald/maxminddb-golang v1.12.0
+	github.com/pkg/sftp v1.13.6
 	golang.org/x/crypto v0.10.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require golang.org/x/sys v0.10.0 // indirect
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+)
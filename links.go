@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Public download links, let a user hand a file on their instance to someone
+// without a secret. The file is streamed over the owners SSH connection, a
+// link only works while the owner is connected and is revoked on logout.
+//
+//	POST /files/links/create  {"path":"...","expires_in":60,"password":"","max_downloads":0}
+//	GET  /files/links/list
+//	POST /files/links/revoke  {"id":"..."}
+//	GET  /dl/{id}             public, password via basic auth
+//
+// max_downloads is enforced on the bytes served, a link serves at most
+// max_downloads times the size of the file (at creation), however the
+// requests are split up into ranges.
+var isDownloadLinkPath = regexp.MustCompile(`(?m)^/dl/.*`).MatchString
+
+const (
+	LINK_PASSWORD_MAX_FAILURES = 5           // failed password attempts after which a link is locked
+	LINK_PASSWORD_LOCKOUT      = time.Minute // doubled on every further lock
+	LINK_PASSWORD_MAX_LOCKOUT  = time.Hour
+)
+
+var errLinkExpired = errors.New("link expired")
+var errLinkLocked = errors.New("too many failed password attempts, try again later")
+var errLinkExhausted = errors.New("download limit reached")
+
+type DownloadLink struct {
+	Id           string    `json:"id"`
+	ClientId     string    `json:"client_id"`
+	Path         string    `json:"path"`
+	CreatedOn    time.Time `json:"created_on"`
+	ExpiresOn    time.Time `json:"expires_on"`
+	MaxDownloads int       `json:"max_downloads"` // 0 for unlimited
+	Downloads    int       `json:"downloads"`     // full downloads served, bytes served / size
+	Size         int64     `json:"size"`
+	HasPassword  bool      `json:"has_password"`
+	passwordSalt string
+	passwordHash string
+	servedBytes  int64
+	failures     int // failed password attempts
+	lockedUntil  time.Time
+}
+
+func (link *DownloadLink) Expired() bool {
+	return time.Now().After(link.ExpiresOn)
+}
+
+type DownloadLinkStore struct {
+	mu    *sync.Mutex
+	Links map[string]*DownloadLink // Id -> Link
+}
+
+var DownloadLinks = DownloadLinkStore{}
+
+func (store *DownloadLinkStore) Init() {
+	store.mu = &sync.Mutex{}
+	store.Links = make(map[string]*DownloadLink)
+	go store.periodicCleanup()
+}
+
+func (store *DownloadLinkStore) periodicCleanup() {
+	for {
+		time.Sleep(time.Minute)
+		store.mu.Lock()
+		for id, link := range store.Links {
+			if link.Expired() {
+				delete(store.Links, id)
+			}
+		}
+		store.mu.Unlock()
+	}
+}
+
+func (store *DownloadLinkStore) Add(link *DownloadLink, maxPerClient int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if maxPerClient > 0 {
+		count := 0
+		for _, existing := range store.Links {
+			if existing.ClientId == link.ClientId && !existing.Expired() {
+				count++
+			}
+		}
+		if count >= maxPerClient {
+			return errors.New("too many active download links")
+		}
+	}
+
+	store.Links[link.Id] = link
+	return nil
+}
+
+// Return a copy of all active links, of a single client if clientId is not empty
+func (store *DownloadLinkStore) List(clientId string) []DownloadLink {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	links := []DownloadLink{}
+	for _, link := range store.Links {
+		if link.Expired() {
+			continue
+		}
+		if clientId == "" || link.ClientId == clientId {
+			links = append(links, *link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedOn.Before(links[j].CreatedOn)
+	})
+	return links
+}
+
+func (store *DownloadLinkStore) Count(clientId string) int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	count := 0
+	for _, link := range store.Links {
+		if link.ClientId == clientId && !link.Expired() {
+			count++
+		}
+	}
+	return count
+}
+
+// Remove a link, if clientId is not empty the link must belong to that client
+func (store *DownloadLinkStore) Revoke(id string, clientId string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	link, ok := store.Links[id]
+	if !ok || (clientId != "" && link.ClientId != clientId) {
+		return errors.New("no such link")
+	}
+	delete(store.Links, id)
+	return nil
+}
+
+// Returns a copy of a usable link
+// Revoke all links of a client, returns the no of links revoked
+func (store *DownloadLinkStore) RevokeClient(clientId string) int {
+	if store.mu == nil {
+		return 0
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	revoked := 0
+	for id, link := range store.Links {
+		if link.ClientId == clientId {
+			delete(store.Links, id)
+			revoked++
+		}
+	}
+	return revoked
+}
+
+func (store *DownloadLinkStore) Get(id string) (DownloadLink, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	link, ok := store.Links[id]
+	if !ok || link.Expired() {
+		return DownloadLink{}, errLinkExpired
+	}
+	return *link, nil
+}
+
+// Verify the password of a link, the link is locked for a while after
+// LINK_PASSWORD_MAX_FAILURES failed attempts
+func (store *DownloadLinkStore) CheckPassword(id string, password string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	link, ok := store.Links[id]
+	if !ok || link.Expired() {
+		return errLinkExpired
+	}
+	if !link.HasPassword {
+		return nil
+	}
+	if time.Now().Before(link.lockedUntil) {
+		return errLinkLocked
+	}
+
+	if hmac.Equal([]byte(hashLinkPassword(link.passwordSalt, password)), []byte(link.passwordHash)) {
+		link.failures = 0
+		return nil
+	}
+	link.failures++
+	if link.failures%LINK_PASSWORD_MAX_FAILURES == 0 {
+		lockout := LINK_PASSWORD_LOCKOUT << (link.failures/LINK_PASSWORD_MAX_FAILURES - 1)
+		if lockout > LINK_PASSWORD_MAX_LOCKOUT || lockout <= 0 {
+			lockout = LINK_PASSWORD_MAX_LOCKOUT
+		}
+		link.lockedUntil = time.Now().Add(lockout)
+	}
+	return errors.New("wrong password")
+}
+
+// Take up to n bytes from the budget of a link, returns the no of bytes that
+// may be served. The link is removed once its budget is used up.
+func (store *DownloadLinkStore) consume(id string, n int) int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	link, ok := store.Links[id]
+	if !ok || link.Expired() {
+		return 0 // revoked or expired while downloading
+	}
+	if link.MaxDownloads <= 0 || link.Size <= 0 {
+		link.servedBytes += int64(n)
+		if link.Size > 0 {
+			link.Downloads = int(link.servedBytes / link.Size)
+		}
+		return n
+	}
+
+	budget := int64(link.MaxDownloads) * link.Size
+	if remaining := budget - link.servedBytes; int64(n) > remaining {
+		n = int(remaining)
+	}
+	link.servedBytes += int64(n)
+	link.Downloads = int(link.servedBytes / link.Size)
+	if link.servedBytes >= budget {
+		delete(store.Links, id)
+	}
+	return n
+}
+
+// Response writer that stops once the budget of a link is used up, the
+// headers are sent by then so the response is aborted
+type linkBudgetWriter struct {
+	http.ResponseWriter
+	linkId    string
+	truncated bool
+}
+
+func (writer *linkBudgetWriter) Write(data []byte) (int, error) {
+	allowed := DownloadLinks.consume(writer.linkId, len(data))
+	n, err := writer.ResponseWriter.Write(data[:allowed])
+	if err == nil && allowed < len(data) {
+		writer.truncated = true
+		err = errLinkExhausted
+	}
+	return n, err
+}
+
+func hashLinkPassword(salt string, password string) string {
+	h := sha256.New()
+	h.Write([]byte(salt))
+	h.Write([]byte(password))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type DownloadLinkRequest struct {
+	Id           string `json:"id"`
+	Path         string `json:"path"`
+	ExpiresIn    int    `json:"expires_in"` // minutes
+	Password     string `json:"password"`
+	MaxDownloads int    `json:"max_downloads"`
+}
+
+type DownloadLinkResponse struct {
+	Status string         `json:"status"`
+	Url    string         `json:"url,omitempty"`
+	Link   *DownloadLink  `json:"link,omitempty"`
+	Links  []DownloadLink `json:"links,omitempty"`
+}
+
+// Called from handleFiles, the caller is already authenticated
+func (sfui *SfUI) handleDownloadLinks(w http.ResponseWriter, r *http.Request, operation string,
+	clientSecret string, client Client, sftpClient *sftp.Client) {
+	switch operation {
+	case "list":
+		if r.Method != http.MethodGet {
+			break
+		}
+		writeFilesJSON(w, DownloadLinkResponse{
+			Status: "OK",
+			Links:  DownloadLinks.List(client.ClientId),
+		})
+		return
+	case "create", "revoke":
+		if r.Method != http.MethodPost {
+			break
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, 2048))
+		linkReq := DownloadLinkRequest{}
+		if err != nil || json.Unmarshal(data, &linkReq) != nil {
+			writeFilesError(w, http.StatusBadRequest, "invalid request")
+			return
+		}
+
+		if operation == "revoke" {
+			if rerr := DownloadLinks.Revoke(linkReq.Id, client.ClientId); rerr != nil {
+				writeFilesError(w, http.StatusNotFound, rerr.Error())
+				return
+			}
+			writeFilesOK(w)
+			return
+		}
+
+		sfui.createDownloadLink(w, &linkReq, client, sftpClient)
+		return
+	default:
+		writeFilesError(w, http.StatusNotFound, "unknown operation")
+		return
+	}
+
+	writeFilesError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func (sfui *SfUI) createDownloadLink(w http.ResponseWriter, linkReq *DownloadLinkRequest,
+	client Client, sftpClient *sftp.Client) {
+	filePath := cleanFilePath(linkReq.Path)
+	fi, err := sftpClient.Stat(filePath)
+	if err != nil {
+		writeFilesError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		writeFilesError(w, http.StatusBadRequest, "not a regular file")
+		return
+	}
+
+	// links are resolved against the instance later on, make the path absolute
+	if absPath, rerr := sftpClient.RealPath(filePath); rerr == nil {
+		filePath = absPath
+	}
+
+	expiresIn := linkReq.ExpiresIn
+	if expiresIn <= 0 || expiresIn > sfui.DownloadLinkMaxExpiry {
+		expiresIn = sfui.DownloadLinkMaxExpiry
+	}
+
+	link := DownloadLink{
+		Id:           RandomStr(33),
+		ClientId:     client.ClientId,
+		Path:         filePath,
+		CreatedOn:    time.Now(),
+		ExpiresOn:    time.Now().Add(time.Minute * time.Duration(expiresIn)),
+		MaxDownloads: linkReq.MaxDownloads,
+		Size:         fi.Size(),
+	}
+
+	if linkReq.Password != "" {
+		link.HasPassword = true
+		link.passwordSalt = RandomStr(16)
+		link.passwordHash = hashLinkPassword(link.passwordSalt, linkReq.Password)
+	}
+
+	linkCopy := link // link is shared once added to the store
+	if aerr := DownloadLinks.Add(&link, sfui.DownloadLinkMaxPerClient); aerr != nil {
+		writeFilesError(w, http.StatusTooManyRequests, aerr.Error())
+		return
+	}
+
+	writeFilesJSON(w, DownloadLinkResponse{
+		Status: "OK",
+		Url:    "/dl/" + linkCopy.Id,
+		Link:   &linkCopy,
+	})
+}
+
+// Public endpoint, /dl/{id}
+func (sfui *SfUI) handlePublicDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeFilesError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	clientIp := sfui.getClientAddr(r)
+	if isBanned, _ := BanDB.IsBanned(clientIp); isBanned {
+		writeFilesError(w, http.StatusUnavailableForLegalReasons, "banned")
+		return
+	}
+	if !Throttle.Allow(RATE_LIMIT_LINK_DOWNLOAD, clientIp) {
+		writeFilesError(w, http.StatusTooManyRequests, "too many requests")
+		return
+	}
+
+	linkId := strings.TrimPrefix(r.URL.Path, "/dl/")
+
+	link, err := DownloadLinks.Get(linkId)
+	if err != nil {
+		writeFilesError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if link.HasPassword {
+		// Basic auth only, a password in the url would end up in access logs
+		_, password, _ := r.BasicAuth()
+		if perr := DownloadLinks.CheckPassword(linkId, password); perr == errLinkLocked {
+			writeFilesError(w, http.StatusTooManyRequests, perr.Error())
+			return
+		} else if perr != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="download", charset="UTF-8"`)
+			writeFilesError(w, http.StatusUnauthorized, "password required")
+			return
+		}
+	}
+
+	// Served over the owners existing connection only, a link must not be
+	// able to log the owner back in
+	client, cerr := sfui.GetClientById(link.ClientId)
+	if cerr != nil {
+		writeFilesError(w, http.StatusServiceUnavailable, "instance unavailable")
+		return
+	}
+
+	sftpClient, serr := client.SSHConnection.GetSFTPClient()
+	if serr != nil {
+		writeFilesError(w, http.StatusServiceUnavailable, "instance unavailable")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	budgetWriter := &linkBudgetWriter{ResponseWriter: w, linkId: linkId}
+	if size, complete := handleFilesDownload(budgetWriter, r, sftpClient, path.Clean(link.Path)); complete && !budgetWriter.truncated {
+		MLogger.LogEvent(Metric{Type: METRIC_FILE_DOWNLOAD, Source: "link", Size: size}, clientIp)
+	}
+}
+
+type DownloadLinkAdminOp struct {
+	Id string `json:"id"`
+}
+
+func (sfui *SfUI) handleListDownloadLinks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	if _, ok := sfui.authenticateAdmin(r); !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"status":"denied"}`))
+		return
+	}
+
+	linkData, err := json.Marshal(DownloadLinkResponse{
+		Status: "OK",
+		Links:  DownloadLinks.List(""),
+	})
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(linkData)
+		return
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(`{"status":"error"}`))
+}
+
+func (sfui *SfUI) handleRevokeDownloadLink(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	adminName, ok := sfui.authenticateAdmin(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"status":"denied"}`))
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, 2048))
+	if err == nil {
+		adminRequest := DownloadLinkAdminOp{}
+		if json.Unmarshal(data, &adminRequest) == nil && adminRequest.Id != "" {
+			if DownloadLinks.Revoke(adminRequest.Id, "") == nil {
+				logAdminAction(adminName, "revoke_link", adminRequest.Id)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`{"status":"ok"}`))
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"status":"no such link"}`))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(`{"status":"error"}`))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLinkStore(links ...*DownloadLink) *DownloadLinkStore {
+	store := &DownloadLinkStore{mu: &sync.Mutex{}, Links: make(map[string]*DownloadLink)}
+	for _, link := range links {
+		store.Links[link.Id] = link
+	}
+	return store
+}
+
+func newTestLink(id string, password string) *DownloadLink {
+	link := &DownloadLink{
+		Id:        id,
+		ClientId:  "client",
+		Path:      "/sec/file",
+		CreatedOn: time.Now(),
+		ExpiresOn: time.Now().Add(time.Hour),
+	}
+	if password != "" {
+		link.HasPassword = true
+		link.passwordSalt = "salt"
+		link.passwordHash = hashLinkPassword("salt", password)
+	}
+	return link
+}
+
+func TestDownloadLinkExpiry(t *testing.T) {
+	expired := newTestLink("expired", "pass")
+	expired.ExpiresOn = time.Now().Add(-time.Second)
+	store := newTestLinkStore(newTestLink("active", ""), expired)
+
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"active", true},
+		{"expired", false},
+		{"missing", false},
+	}
+
+	for _, test := range tests {
+		if _, err := store.Get(test.id); (err == nil) != test.valid {
+			t.Errorf("Get(%s) error = %v, want valid %v", test.id, err, test.valid)
+		}
+		if err := store.CheckPassword(test.id, "pass"); (err == nil) != test.valid {
+			t.Errorf("CheckPassword(%s) error = %v, want valid %v", test.id, err, test.valid)
+		}
+	}
+
+	// expired links do not count against the limit per client
+	if err := store.Add(newTestLink("new", ""), 2); err != nil {
+		t.Errorf("Add() error = %v with one active link", err)
+	}
+	if err := store.Add(newTestLink("one too many", ""), 2); err == nil {
+		t.Error("Add() over the limit per client did not fail")
+	}
+}
+
+func TestDownloadLinkPasswordLockout(t *testing.T) {
+	store := newTestLinkStore(newTestLink("link", "correct"))
+	link := store.Links["link"]
+
+	for i := 0; i < LINK_PASSWORD_MAX_FAILURES; i++ {
+		if err := store.CheckPassword("link", "wrong"); err == nil || err == errLinkLocked {
+			t.Fatalf("attempt %d: CheckPassword() error = %v, want wrong password", i+1, err)
+		}
+	}
+	if err := store.CheckPassword("link", "correct"); err != errLinkLocked {
+		t.Fatalf("CheckPassword() after %d failures = %v, want locked", LINK_PASSWORD_MAX_FAILURES, err)
+	}
+	if lockout := time.Until(link.lockedUntil); lockout <= 0 || lockout > LINK_PASSWORD_LOCKOUT {
+		t.Errorf("locked for %s, want %s", lockout, LINK_PASSWORD_LOCKOUT)
+	}
+
+	// the lockout doubles on the next round of failures
+	link.lockedUntil = time.Time{}
+	for i := 0; i < LINK_PASSWORD_MAX_FAILURES; i++ {
+		store.CheckPassword("link", "wrong")
+	}
+	if lockout := time.Until(link.lockedUntil); lockout <= LINK_PASSWORD_LOCKOUT || lockout > 2*LINK_PASSWORD_LOCKOUT {
+		t.Errorf("locked for %s, want %s", lockout, 2*LINK_PASSWORD_LOCKOUT)
+	}
+
+	// capped at the max
+	link.lockedUntil = time.Time{}
+	link.failures = 100 * LINK_PASSWORD_MAX_FAILURES
+	for i := 0; i < LINK_PASSWORD_MAX_FAILURES; i++ {
+		store.CheckPassword("link", "wrong")
+	}
+	if lockout := time.Until(link.lockedUntil); lockout <= 0 || lockout > LINK_PASSWORD_MAX_LOCKOUT {
+		t.Errorf("locked for %s, want at most %s", lockout, LINK_PASSWORD_MAX_LOCKOUT)
+	}
+
+	link.lockedUntil = time.Time{}
+	if err := store.CheckPassword("link", "correct"); err != nil || link.failures != 0 {
+		t.Errorf("CheckPassword() = %v, failures %d after the lockout", err, link.failures)
+	}
+}
+
+func TestDownloadLinkBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxDownloads int
+		size         int64
+		writes       []int
+		allowed      []int
+		downloads    int
+		removed      bool
+	}{
+		{"unlimited", 0, 10, []int{10, 10, 5}, []int{10, 10, 5}, 2, false},
+		{"within the budget", 2, 10, []int{10, 5}, []int{10, 5}, 1, false},
+		{"ranges add up", 1, 10, []int{4, 4, 4}, []int{4, 4, 2}, 1, true},
+		{"exhausted", 2, 10, []int{15, 15, 1}, []int{15, 5, 0}, 2, true},
+		{"unknown size", 2, 0, []int{100, 100}, []int{100, 100}, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			link := newTestLink("link", "")
+			link.MaxDownloads = test.maxDownloads
+			link.Size = test.size
+			store := newTestLinkStore(link)
+
+			for i, n := range test.writes {
+				if got := store.consume("link", n); got != test.allowed[i] {
+					t.Errorf("write %d: consume(%d) = %d, want %d", i+1, n, got, test.allowed[i])
+				}
+			}
+			if link.Downloads != test.downloads {
+				t.Errorf("Downloads = %d, want %d", link.Downloads, test.downloads)
+			}
+			if _, ok := store.Links["link"]; ok == test.removed {
+				t.Errorf("link removed = %v, want %v", !ok, test.removed)
+			}
+		})
+	}
+}
+
+func TestLinkBudgetWriter(t *testing.T) {
+	link := newTestLink("link", "")
+	link.MaxDownloads = 1
+	link.Size = 8
+
+	saved := DownloadLinks
+	defer func() { DownloadLinks = saved }()
+	DownloadLinks = *newTestLinkStore(link)
+
+	recorder := httptest.NewRecorder()
+	writer := &linkBudgetWriter{ResponseWriter: recorder, linkId: "link"}
+	if n, err := writer.Write([]byte("12345")); n != 5 || err != nil {
+		t.Errorf("Write() = %d, %v within the budget", n, err)
+	}
+	if n, err := writer.Write([]byte("67890")); n != 3 || err != errLinkExhausted {
+		t.Errorf("Write() = %d, %v, want 3, %v", n, err, errLinkExhausted)
+	}
+	if !writer.truncated || recorder.Body.String() != "12345678" {
+		t.Errorf("body = %q, truncated %v, want the response cut at the budget", recorder.Body.String(), writer.truncated)
+	}
+}
+
+func TestDownloadLinkRevokeClient(t *testing.T) {
+	other := newTestLink("other", "")
+	other.ClientId = "other client"
+	store := newTestLinkStore(newTestLink("first", ""), newTestLink("second", ""), other)
+
+	if revoked := store.RevokeClient("client"); revoked != 2 {
+		t.Errorf("RevokeClient() = %d, want 2", revoked)
+	}
+	if _, err := store.Get("other"); err != nil || len(store.Links) != 1 {
+		t.Errorf("links of other clients were revoked")
+	}
+	if revoked := (&DownloadLinkStore{}).RevokeClient("client"); revoked != 0 {
+		t.Errorf("RevokeClient() on a uninitialized store = %d", revoked)
+	}
+}
+
+func TestPublicDownloadRefused(t *testing.T) {
+	savedLinks, savedBans, savedThrottle := DownloadLinks, BanDB, Throttle
+	defer func() { DownloadLinks, BanDB, Throttle = savedLinks, savedBans, savedThrottle }()
+
+	expired := newTestLink("expired", "")
+	expired.ExpiresOn = time.Now().Add(-time.Second)
+	DownloadLinks = *newTestLinkStore(newTestLink("link", ""), expired)
+	BanDB = *newTestBanDB(t.TempDir() + "/banDB.json")
+	BanDB.Add("192.0.2.66", "spam", 0, "test")
+
+	sfui := getDefaultConfig()
+	sfui.EnableRateLimits = true
+	sfui.RateLimits = map[string]RateLimit{RATE_LIMIT_LINK_DOWNLOAD: {Limit: 2, Window: 60}}
+	Throttle = AbuseThrottle{
+		mu:         &sync.Mutex{},
+		windows:    make(map[string]*slidingWindow),
+		violations: make(map[string]*slidingWindow),
+		autoBans:   make(map[string]int),
+	}
+	Throttle.Configure(&sfui)
+
+	tests := []struct {
+		name     string
+		clientIp string
+		link     string
+		status   int
+	}{
+		{"banned address", "192.0.2.66", "link", http.StatusUnavailableForLegalReasons},
+		{"expired link", "192.0.2.1", "expired", http.StatusNotFound},
+		{"owner not connected", "192.0.2.1", "link", http.StatusServiceUnavailable},
+		{"throttled", "192.0.2.1", "link", http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmu.Lock()
+			connected := len(clients)
+			cmu.Unlock()
+
+			r := httptest.NewRequest(http.MethodGet, "/dl/"+test.link, nil)
+			r.RemoteAddr = test.clientIp + ":4000"
+			w := httptest.NewRecorder()
+			sfui.handlePublicDownload(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			cmu.Lock()
+			defer cmu.Unlock()
+			if len(clients) != connected {
+				t.Error("a download through a link created a client")
+			}
+		})
+	}
+}
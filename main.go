@@ -7,12 +7,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 type SfUI struct {
@@ -29,18 +31,20 @@ type SfUI struct {
 	VNCPort                 uint16 `yaml:"vnc_port"`
 	FileBrowserPort         uint16 `yaml:"filebrowser_port"`
 
-	CompiledClientConfig   []byte   // Ui related config that has to be sent to client
-	SfEndpoints            []string `yaml:"sf_endpoints"` // Sf Endpoints To Use
-	NoEndpoints            int32    // No of available endpoints
+	CompiledClientConfig   []byte   `yaml:"-"`                          // Ui related config that has to be sent to client
+	SfEndpoints            []string `yaml:"sf_endpoints"`               // Sf Endpoints To Use
+	NoEndpoints            int32    `yaml:"-"`                          // No of available endpoints
 	SfUIOrigin             string   `yaml:"sf_ui_origin"`               // Where SFUI is deployed, for CSRF prevention, ex: https://web.segfault.net
 	UseXForwardedForHeader bool     `yaml:"use_x_forwarded_for_header"` // Use the X-Forwared-For HTTP header, usefull when behind a reverse proxy
+	TrustedProxies         []string `yaml:"trusted_proxies"`            // CIDRs of proxies whose Forwarded/X-Forwarded-For headers are trusted
 	DisableOriginCheck     bool     `yaml:"disable_origin_check"`       // Disable Origin Checking
 	DisableDesktop         bool     `yaml:"disable_desktop"`            // Disable websocket based GUI desktop access
 
 	ClientInactivityTimeout int                 `yaml:"client_inactivity_timeout"` // Minutes after which the clients master SSH connection is killed
-	ValidSecret             func(s string) bool // Secret Validator
-	EndpointSelector        *atomic.Int32       // Helps select a endpoint in RR fashion
-	NoOfEndpoints           int32               // No of available endpoints
+	ValidSecret             func(s string) bool `yaml:"-"`                         // Secret Validator
+	EndpointSelector        *atomic.Int32       `yaml:"-"`                         // Helps select a endpoint in RR fashion
+	ClientIPResolver        *ClientIPResolver   `yaml:"-"`                         // Built from UseXForwardedForHeader and TrustedProxies
+	NoOfEndpoints           int32               `yaml:"-"`                         // No of available endpoints
 
 	SegfaultSSHUsername string `yaml:"segfault_ssh_username"`
 	SegfaultSSHPassword string `yaml:"segfault_ssh_password"`
@@ -51,12 +55,97 @@ type SfUI struct {
 	EnableMetricLogging   bool   `yaml:"enable_metric_logging"` // collect metrics from sfui
 	MetricLoggerQueueSize int    `yaml:"metric_logger_queue_size"`
 
-	ElasticServerHost     string `yaml:"elastic_server_host"`
-	ElasticIndexName      string `yaml:"elastic_index_name"`
-	ElasticUsername       string `yaml:"elastic_username"`
-	ElasticPassword       string `yaml:"elastic_password"`
-	OpenObserveCompatible bool   `yaml:"open_observe_compatible"`
+	AdminTokens map[string]string `yaml:"admin_tokens"` // name->token, additional secrets for the maintenance apis
+	BanDBPath   string            `yaml:"ban_db_path"`  // File in which bans are stored
+
+	MetricsScrapeToken string `yaml:"metrics_scrape_token"` // Bearer token accepted on /metrics, besides the maintenance secret
+
+	Blocklists []BlocklistSource `yaml:"blocklists"` // External lists of banned addresses, merged into ban lookups
+
+	AccessPolicies   map[string]AccessPolicy `yaml:"access_policies"`    // scope (login, new_instance)->country/ASN policy
+	AccessPolicyPath string                  `yaml:"access_policy_path"` // File in which policies set through the admin api are stored
+
+	PoWEnabled       bool           `yaml:"pow_enabled"`        // Require a proof of work for new instances
+	PoWDifficulty    int            `yaml:"pow_difficulty"`     // Base difficulty, leading zero bits of the hash
+	PoWMaxDifficulty int            `yaml:"pow_max_difficulty"` // Upper bound for the scaled difficulty
+	PoWChallengeTTL  int            `yaml:"pow_challenge_ttl"`  // Seconds for which a challenge can be solved
+	PoWScaleWindow   int            `yaml:"pow_scale_window"`   // Minutes of new instances considered when scaling the difficulty
+	PoWScaleSteps    map[string]int `yaml:"pow_scale_steps"`    // prefix|asn|country->new instances per additional bit, 0 to not scale
+
+	SecretBackend   SecretBackendConfig `yaml:"secret_backend"` // Where secrets are validated and generated
+	SecretValidator SecretValidator     `yaml:"-"`              // Built from SecretBackend
+	SecretGenerator SecretGenerator     `yaml:"-"`              // Built from SecretBackend
+
+	MetricSinks []MetricSinkConfig `yaml:"metric_sinks"` // Destinations of metric events, replaces the elastic_* settings
+
+	MetricFlushInterval   int    `yaml:"metric_flush_interval"`   // Seconds between writes of partial batches, unless set per sink
+	MetricBatchSize       int    `yaml:"metric_batch_size"`       // Events per write, unless set per sink
+	MetricMaxRetries      int    `yaml:"metric_max_retries"`      // Retries of a failed write before the batch is spooled
+	MetricRetryBackoff    int    `yaml:"metric_retry_backoff"`    // Seconds before the first retry, doubled on every retry
+	MetricSpoolDir        string `yaml:"metric_spool_dir"`        // Directory for undelivered events, empty to drop them instead
+	MetricSpoolMaxSize    int    `yaml:"metric_spool_max_size"`   // MiB per sink
+	MetricShutdownTimeout int    `yaml:"metric_shutdown_timeout"` // Seconds to flush queued events on shutdown, the rest is spooled
+
+	TracingEnabled     bool              `yaml:"tracing_enabled"`      // Export OpenTelemetry spans over OTLP/HTTP
+	TracingEndpoint    string            `yaml:"tracing_endpoint"`     // Collector base url, spans are posted to <endpoint>/v1/traces
+	TracingHeaders     map[string]string `yaml:"tracing_headers"`      // Sent with every export, ex: authentication
+	TracingServiceName string            `yaml:"tracing_service_name"` // service.name of the exported spans
+	TracingSampleRatio float64           `yaml:"tracing_sample_ratio"` // Fraction of traces recorded (0-1), incoming sampled traceparents are always recorded
+	TracingTimeout     int               `yaml:"tracing_timeout"`      // Seconds per export request
+
+	PseudonymKeyPath     string `yaml:"pseudonym_key_path"`     // File holding the HMAC keys of pseudonyms (UserUid), created if missing
+	PseudonymKeyRotation int    `yaml:"pseudonym_key_rotation"` // Days after which a new key is generated, 0 to only rotate through the admin api
+	PseudonymKeyHistory  int    `yaml:"pseudonym_key_history"`  // Previous keys kept for lookups through /pseudonyms
+
+	AnonymizeIPs        bool `yaml:"anonymize_ips"`         // Truncate addresses written to logs and metric events
+	AnonymizeIPv4Prefix int  `yaml:"anonymize_ipv4_prefix"` // Prefix length IPv4 addresses are truncated to
+	AnonymizeIPv6Prefix int  `yaml:"anonymize_ipv6_prefix"` // Prefix length IPv6 addresses are truncated to
+	AdminRawIPs         bool `yaml:"admin_raw_ips"`         // Show full addresses in admin output, truncated ones otherwise
+
+	EnableAnalytics       bool   `yaml:"enable_analytics"`        // Keep usage aggregates, served on /admin/analytics
+	AnalyticsPath         string `yaml:"analytics_path"`          // File in which the aggregates are stored
+	AnalyticsSaveInterval int    `yaml:"analytics_save_interval"` // Minutes between saves
+	AnalyticsRetention    int    `yaml:"analytics_retention"`     // Days of hourly aggregates kept, 0 to keep them forever
+
+	ElasticServerHost     string `yaml:"elastic_server_host"`     // Deprecated, used if metric_sinks is empty
+	ElasticIndexName      string `yaml:"elastic_index_name"`      // Deprecated
+	ElasticUsername       string `yaml:"elastic_username"`        // Deprecated
+	ElasticPassword       string `yaml:"elastic_password"`        // Deprecated
+	OpenObserveCompatible bool   `yaml:"open_observe_compatible"` // Deprecated
 	GeoIpDBPath           string `yaml:"geo_ip_db_path"`
+	GeoIpASNDBPath        string `yaml:"geo_ip_asn_db_path"` // GeoLite2-ASN database, used by access policies
+
+	GeoIpCityDBPath     string `yaml:"geo_ip_city_db_path"`    // GeoLite2-City database, adds the city (and the country if geo_ip_db_path is missing)
+	GeoIpReloadInterval int    `yaml:"geo_ip_reload_interval"` // Seconds between checks for updated databases, 0 to never reload
+	GeoIpCacheSize      int    `yaml:"geo_ip_cache_size"`      // Addresses whose lookups are cached, 0 to disable the cache
+
+	TusMaxUploadSize int64 `yaml:"tus_max_upload_size"` // Max size (bytes) of a single resumable upload, 0 for no limit
+	TusClientQuota   int64 `yaml:"tus_client_quota"`    // Max bytes of unfinished resumable uploads per client, 0 for no limit
+	TusUploadExpiry  int   `yaml:"tus_upload_expiry"`   // Minutes after which a idle resumable upload is forgotten
+
+	AccessTokenKey  string `yaml:"access_token_key"`  // HMAC key for access tokens, random on every start if empty
+	AccessTokenTTL  int    `yaml:"access_token_ttl"`  // Seconds for which a access token is valid
+	AllowSecretAuth bool   `yaml:"allow_secret_auth"` // Also accept the raw secret where a access token is expected
+
+	DownloadLinkMaxExpiry    int `yaml:"download_link_max_expiry"`     // Max lifetime (minutes) of a public download link
+	DownloadLinkMaxPerClient int `yaml:"download_link_max_per_client"` // Max active download links per client, 0 for no limit
+
+	ProxyProtocol               bool     `yaml:"proxy_protocol"`                 // Accept PROXY protocol (v1/v2) headers on the listener
+	ProxyProtocolTrustedSources []string `yaml:"proxy_protocol_trusted_sources"` // CIDRs of load balancers allowed to send PROXY headers
+	ProxyProtocolHeaderTimeout  int      `yaml:"proxy_protocol_header_timeout"`  // Seconds to wait for the PROXY header
+
+	EnableRateLimits    bool                 `yaml:"enable_rate_limits"`     // Throttle new accounts, logins, ws connections, share joins and link downloads
+	RateLimits          map[string]RateLimit `yaml:"rate_limits"`            // action->limit, actions: new_account, login, ws_connect, share_join, link_download
+	RateLimitIPv4Prefix int                  `yaml:"rate_limit_ipv4_prefix"` // Prefix length used for per prefix limits of IPv4 clients
+	RateLimitIPv6Prefix int                  `yaml:"rate_limit_ipv6_prefix"` // Prefix length used for per prefix limits of IPv6 clients
+	AutoBanViolations   int                  `yaml:"auto_ban_violations"`    // Limit violations within auto_ban_window that trigger a ban, 0 to disable
+	AutoBanWindow       int                  `yaml:"auto_ban_window"`        // Minutes
+	AutoBanDuration     int                  `yaml:"auto_ban_duration"`      // Minutes, doubled on every repeated auto-ban
+	AutoBanMaxDuration  int                  `yaml:"auto_ban_max_duration"`  // Minutes
+
+	SegfaultSSHPasswordFile string `yaml:"segfault_ssh_password_file"` // Read segfault_ssh_password from a file, ex: a docker secret
+	MaintenanceSecretFile   string `yaml:"maintenance_secret_file"`    // Read maintenance_secret from a file
+	ElasticPasswordFile     string `yaml:"elastic_password_file"`      // Read elastic_password from a file
 }
 
 var buildTime string
@@ -71,7 +160,11 @@ func main() {
 		return
 	}
 
-	sfui := ReadConfig()
+	sfui, cerr := ReadConfig()
+	if cerr != nil {
+		log.Println("Invalid config,", cerr)
+		os.Exit(1)
+	}
 	log.Printf("SFUI [Version : %s] [Built on : %s]\n", SfuiVersion, buildTime)
 
 	rlErr := obtainRunLock()
@@ -81,23 +174,54 @@ func main() {
 	}
 	// release runLock in cleanUp()
 
+	RunningConfig.Store(&sfui)
 	sfui.handleSignals()
-	sfui.InitRouter()
+	InitRouter()
+
+	// The geo databases are needed for metrics and access policies, the latter
+	// can be set at runtime, so the databases are loaded whenever present
+	Geo.Init(&sfui)
 
+	Privacy.Init(&sfui)
+	Analytics.Init(&sfui)
 	if sfui.EnableMetricLogging {
-		gerr := GeoIpInit(sfui.GeoIpDBPath)
-		if gerr != nil {
-			log.Println(gerr)
-		}
-		MLogger.StartLogger(sfui.MetricLoggerQueueSize, 1,
-			sfui.ElasticServerHost, sfui.ElasticIndexName,
-			sfui.ElasticUsername, sfui.ElasticPassword, sfui.OpenObserveCompatible)
+		MLogger.StartLogger(&sfui)
 	}
 
-	BanDB.Init()
+	if _, derr := os.Stat("/.dockerenv"); derr == nil && sfui.UseXForwardedForHeader && sfui.ClientIPResolver.onlyLoopbackTrusted() {
+		log.Println("Running in docker with only loopback in trusted_proxies, forwarding headers from the proxy will be ignored, add the docker network to trusted_proxies")
+	}
+
+	Tracer.Init(&sfui)
+	BanDB.Init(sfui.BanDBPath)
+	Blocklists.Init(sfui.Blocklists)
+	Throttle.Init(&sfui)
+	Policies.Init(sfui.AccessPolicies, sfui.AccessPolicyPath)
+	PoW.Init(sfui.AccessTokenKey, &sfui)
+	TusUploads.Init(time.Minute * time.Duration(sfui.TusUploadExpiry))
+	DownloadLinks.Init()
+	Tokens.Init(sfui.AccessTokenKey, time.Second*time.Duration(sfui.AccessTokenTTL),
+		time.Minute*time.Duration(sfui.WSTimeout))
+
+	listener, lerr := net.Listen("tcp", sfui.ServerBindAddress)
+	if lerr != nil {
+		log.Println(lerr)
+		return
+	}
+
+	if sfui.ProxyProtocol {
+		proxyListener, perr := NewProxyProtocolListener(listener, sfui.ProxyProtocolTrustedSources,
+			time.Second*time.Duration(sfui.ProxyProtocolHeaderTimeout))
+		if perr != nil {
+			log.Println("Invalid proxy_protocol_trusted_sources entry", perr)
+			return
+		}
+		listener = proxyListener
+		log.Println("Accepting PROXY protocol headers from", sfui.ProxyProtocolTrustedSources)
+	}
 
 	log.Printf("Listening on http://%s ....\n", sfui.ServerBindAddress)
-	http.ListenAndServe(sfui.ServerBindAddress, http.HandlerFunc(sfui.requestHandler))
+	http.Serve(listener, http.HandlerFunc(serveRequest))
 }
 
 func (sfui *SfUI) handleSignals() {
@@ -111,10 +235,10 @@ func (sfui *SfUI) handleSignals() {
 			case syscall.SIGINT:
 				fallthrough
 			case syscall.SIGTERM:
-				fallthrough
-			case syscall.SIGHUP:
 				sfui.cleanUp()
 				os.Exit(0)
+			case syscall.SIGHUP:
+				reloadConfigAndLog()
 			}
 		}
 	}()
@@ -124,11 +248,29 @@ func handleCmdLineFlags() (ActionInvoked bool) {
 	// Handle CmdLine Flags
 	var install bool
 	var uninstall bool
+	var checkConfig bool
 
 	flag.BoolVar(&install, "install", false, "install SFUI")
 	flag.BoolVar(&uninstall, "uninstall", false, "uninstall SFUI")
+	flag.StringVar(&ConfigPath, "config", "", "path of the config file (default \"config.yaml\" if present)")
+	flag.BoolVar(&checkConfig, "check-config", false, "validate the config and print it, with secrets redacted")
 	flag.Parse()
 
+	if checkConfig {
+		sfui, cerr := ReadConfig()
+		if cerr != nil {
+			fmt.Fprintln(os.Stderr, "Invalid config,", cerr)
+			os.Exit(1)
+		}
+		data, merr := redactedConfig(&sfui)
+		if merr != nil {
+			fmt.Fprintln(os.Stderr, merr)
+			os.Exit(1)
+		}
+		fmt.Print(string(data))
+		return true
+	}
+
 	if install {
 		ierr := InstallService()
 		if ierr != nil {
@@ -154,31 +296,107 @@ func (sfui *SfUI) cleanUp() {
 	sfui.RemoveAllClients()
 	log.Println("Flushing Log Queue...")
 	if sfui.EnableMetricLogging {
-		MLogger.FlushQueue()
-		GeoIpClose()
+		MLogger.StopLogger()
 	}
+	Tracer.Stop()
+	Analytics.Save()
 	BanDB.Save()
 	releaseRunLock()
 }
 
+// Count a login attempt and record its outcome on the login span
+func loginOutcome(span *Span, outcome string) {
+	promLogins.Inc(outcome)
+	span.SetOutcome(outcome)
+}
+
 func (sfui *SfUI) handleLogin(w http.ResponseWriter, r *http.Request) {
+	ctx, span := Tracer.StartRequestSpan(r, "sfui.login")
+	defer span.End()
+
 	w.Header().Add("Content-Type", "application/json")
 	data, err := io.ReadAll(io.LimitReader(r.Body, 2048))
 	if err == nil {
 		clientIp := sfui.getClientAddr(r)
 		isBanned, reason := BanDB.IsBanned(clientIp)
 		if isBanned {
+			loginOutcome(span, "banned")
 			w.WriteHeader(http.StatusUnavailableForLegalReasons)
-			w.Write([]byte(fmt.Sprintf(`{"status":"Banned", "reason" : "%s"}`, reason)))
+			data, _ := json.Marshal(struct {
+				Status string `json:"status"`
+				Reason string `json:"reason"`
+			}{"Banned", reason})
+			w.Write(data)
 			return
 		}
 
 		loginReq := TermRequest{}
 		if json.Unmarshal(data, &loginReq) == nil {
 			loginReq.ClientIp = clientIp
+			action := RATE_LIMIT_LOGIN
+			if loginReq.NewInstance {
+				action = RATE_LIMIT_NEW_ACCOUNT
+			}
+			if !Throttle.Allow(action, clientIp) {
+				loginOutcome(span, "throttled")
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte(`{"status":"Too Many Requests"}`))
+				return
+			}
+
+			allowed, challengeReason := sfui.enforceAccessPolicy(w, POLICY_SCOPE_LOGIN, clientIp)
+			if !allowed {
+				loginOutcome(span, "policy_denied")
+				return
+			}
 			if loginReq.NewInstance {
-				secret := sfui.getEndpointNameRR() + "-"
-				secret += sfui.generateSecret(&loginReq)
+				var newInstanceChallenge string
+				if allowed, newInstanceChallenge = sfui.enforceAccessPolicy(w, POLICY_SCOPE_NEW_INSTANCE, clientIp); !allowed {
+					loginOutcome(span, "policy_denied")
+					return
+				}
+				if challengeReason == "" {
+					challengeReason = newInstanceChallenge
+				}
+				if challengeReason == "" && sfui.PoWEnabled {
+					challengeReason = "Solve the challenge to create a new instance"
+				}
+			}
+
+			if challengeReason != "" {
+				if perr := PoW.Verify(loginReq.Challenge, loginReq.Solution, clientIp); perr != nil {
+					if loginReq.Challenge != "" {
+						challengeReason = perr.Error()
+					}
+					loginOutcome(span, "challenged")
+					challenge := PoW.Issue(clientIp)
+					w.WriteHeader(http.StatusPreconditionRequired)
+					response, _ := json.Marshal(TermResponse{
+						Status:    "Challenge Required",
+						Reason:    challengeReason,
+						Challenge: &challenge,
+					})
+					w.Write(response)
+					return
+				}
+			}
+
+			if loginReq.NewInstance {
+				generatedSecret, gerr := sfui.generateSecret(&loginReq)
+				if gerr != nil {
+					loginOutcome(span, "error")
+					span.SetError(gerr)
+					w.WriteHeader(http.StatusServiceUnavailable)
+					response, _ := json.Marshal(TermResponse{Status: "Unavailable", Reason: gerr.Error()})
+					w.Write(response)
+					return
+				}
+				secret := sfui.getEndpointNameRR() + "-" + generatedSecret
+				span.SetAttribute(SPAN_ATTR_CLIENT_ID, getClientId(secret))
+				PoW.RecordCreation(clientIp)
+				newAccountEndpoint, _ := sfui.getEndpointAndSecret(secret)
+				Analytics.RecordNewAccount(GetCountryByIp(clientIp), newAccountEndpoint)
+				loginOutcome(span, "new_instance")
 
 				w.WriteHeader(http.StatusOK)
 				termRes := TermResponse{
@@ -188,20 +406,25 @@ func (sfui *SfUI) handleLogin(w http.ResponseWriter, r *http.Request) {
 				response, _ := json.Marshal(termRes)
 				w.Write(response)
 
-				if sfui.EnableMetricLogging {
-					go MLogger.AddLogEntry(&Metric{
-						Type:     "NewAccount",
-						Referrer: r.Header.Get("Referer"),
-						Country:  GetCountryByIp(loginReq.ClientIp),
-						UserUid:  getClientId(loginReq.ClientIp),
-						TimeZone: r.Header.Get("TimeZone"),
-					})
-				}
+				MLogger.LogEvent(Metric{
+					Type:     METRIC_NEW_ACCOUNT,
+					Referrer: r.Header.Get("Referer"),
+					TimeZone: r.Header.Get("TimeZone"),
+				}, loginReq.ClientIp)
 
 				return
 			}
 
 			if sfui.ValidSecret(loginReq.Secret) {
+				span.SetAttribute(SPAN_ATTR_CLIENT_ID, getClientId(loginReq.Secret))
+				if verr := sfui.secretValid(&loginReq); verr != nil {
+					loginOutcome(span, "secret_rejected")
+					w.WriteHeader(http.StatusForbidden)
+					response, _ := json.Marshal(TermResponse{Status: "Access Denied", Reason: verr.Error()})
+					w.Write(response)
+					return
+				}
+
 				client, cerr := sfui.GetClient(loginReq.Secret)
 				isDuplicate := false
 				if cerr == nil {
@@ -223,26 +446,29 @@ func (sfui *SfUI) handleLogin(w http.ResponseWriter, r *http.Request) {
 				} else {
 					// start a new client
 					go func() {
-						client, cerr := sfui.GetExistingClientOrMakeNew(loginReq.Secret, loginReq.ClientIp)
+						client, cerr := sfui.GetExistingClientOrMakeNew(ctx, loginReq.Secret, loginReq.ClientIp)
 						if cerr == nil {
 							client.SetTabId(loginReq.TabId)
 						}
 					}()
-					if sfui.EnableMetricLogging {
-						go MLogger.AddLogEntry(&Metric{
-							Type:     "Login",
-							Referrer: r.Header.Get("Referer"),
-							Country:  GetCountryByIp(loginReq.ClientIp),
-							UserUid:  getClientId(loginReq.ClientIp),
-							TimeZone: r.Header.Get("TimeZone"),
-						})
-					}
+					MLogger.LogEvent(Metric{
+						Type:     METRIC_LOGIN,
+						Referrer: r.Header.Get("Referer"),
+						TimeZone: r.Header.Get("TimeZone"),
+					}, loginReq.ClientIp)
 				}
 
+				loginOutcome(span, "ok")
+				loginEndpoint, _ := sfui.getEndpointAndSecret(loginReq.Secret)
+				Analytics.RecordLogin(GetCountryByIp(clientIp), loginEndpoint)
+				tokens, tokenExpiry := Tokens.StartSession(loginReq.Secret, loginReq.ClientIp)
+
 				w.WriteHeader(http.StatusOK)
 				termRes := TermResponse{
 					Status:      "OK",
 					IsDuplicate: isDuplicate,
+					Tokens:      tokens,
+					TokenExpiry: tokenExpiry.Unix(),
 				}
 				response, _ := json.Marshal(termRes)
 				w.Write(response)
@@ -250,6 +476,7 @@ func (sfui *SfUI) handleLogin(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	loginOutcome(span, "invalid")
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Write([]byte(`{"status":"Internal Server Error"}`))
 }
@@ -266,6 +493,8 @@ func (sfui *SfUI) handleLogout(w http.ResponseWriter, r *http.Request) {
 				if err == nil { // Client exists
 					sfui.RemoveClient(&client)
 				}
+				DownloadLinks.RevokeClient(getClientId(logoutReq.Secret))
+				Tokens.EndSession(logoutReq.Secret)
 
 				w.WriteHeader(http.StatusOK)
 				termRes := TermResponse{
@@ -2,103 +2,509 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
-	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	METRIC_MAX_RETRY_BACKOFF = time.Minute
+	METRIC_SAMPLE_WINDOW     = time.Minute // Repeated events are sent at most once per window
+
+	METRIC_DROP_QUEUE_FULL = "queue_full"
+	METRIC_DROP_SPOOL_FULL = "spool_full"
+	METRIC_DROP_FAILED     = "failed" // undeliverable and no spool
+)
+
 type MetricLogger struct {
-	LogQueue              chan Metric // Queue of Metrics that is to be flushed
-	LoggingActive         *atomic.Bool
-	FlushInterval         time.Duration
-	ElasticServerUrl      string
-	ElasticIndexName      string
-	ElasticEndpoint       string
-	LogMarshaller         func(logs []Metric) string
-	OpenObserveCompatible bool
+	LoggingActive   *atomic.Bool
+	Sinks           []*metricSinkQueue // Every sink has its own queue, a slow sink does not hold up the others
+	ShutdownTimeout time.Duration
+	sampler         *metricSampler
+}
+
+// Events that are emitted on every rejected request (BanHit, RateLimited) are
+// sent once per key and window, the ones in between are counted and reported
+// by the next event for the key, or when the key goes quiet.
+type metricSampler struct {
+	window time.Duration
+	mu     *sync.Mutex
+	keys   map[string]*sampledMetric
+}
+
+type sampledMetric struct {
+	lastSent   time.Time
+	suppressed int
+	event      Metric // last suppressed event
+	clientIp   string
+}
+
+// Queue of Metrics that is to be flushed to one sink
+type metricSinkQueue struct {
+	Sink          MetricSink
+	Config        MetricSinkConfig // as configured, zero values take the global defaults
+	LogQueue      chan Metric
+	BatchSize     atomic.Int64
+	FlushInterval atomic.Int64 // time.Duration, the ticker is reset through reschedule
+	MaxRetries    int
+	RetryBackoff  time.Duration // Doubled on every retry, up to METRIC_MAX_RETRY_BACKOFF
+	Spool         *metricSpool  // nil if spooling is disabled
+	overflow      chan Metric   // Metrics that did not fit in LogQueue, spooled by the flusher
+	flushNow      chan struct{}
+	reschedule    chan struct{}
+	mu            *sync.Mutex // serializes writes to the sink
 }
 
+// Bumped whenever a field changes meaning or type, so that consumers can
+// tell events of different versions apart. Version 1 had no SchemaVersion
+// field and SessionDuration was a string. Before version 3 UserUid changed on
+// every restart.
+const METRIC_SCHEMA_VERSION = 3
+
+// Event types, the comments list the fields set besides Type, Time,
+// UserUid and Country
+const (
+	METRIC_NEW_ACCOUNT = "NewAccount" // Referrer, TimeZone
+	METRIC_LOGIN       = "Login"      // Referrer, TimeZone
+	METRIC_LOGOUT      = "Logout"     // SessionDuration
+
+	METRIC_TERMINAL_OPEN  = "TerminalOpen"
+	METRIC_TERMINAL_CLOSE = "TerminalClose" // Duration, BytesIn, BytesOut
+
+	METRIC_DESKTOP_START = "DesktopStart" // DesktopType
+	METRIC_DESKTOP_STOP  = "DesktopStop"  // DesktopType, Duration
+	METRIC_SHARE_CREATED = "ShareCreated" // ViewOnly
+	METRIC_SHARE_JOINED  = "ShareJoined"  // ViewOnly, sent for the viewer
+	METRIC_SHARE_REVOKED = "ShareRevoked"
+
+	METRIC_FILEBROWSER_SETUP = "FileBrowserSetup"
+	METRIC_FILE_UPLOAD       = "FileUpload"   // Size, Source (files, tus)
+	METRIC_FILE_DOWNLOAD     = "FileDownload" // Size, Source (files, zip, link)
+
+	METRIC_SSH_DIAL_FAILURE = "SSHDialFailure" // Endpoint, Reason
+	METRIC_BAN_HIT          = "BanHit"         // Source, Reason, Count (sampled)
+	METRIC_RATE_LIMITED     = "RateLimited"    // Action, Count (sampled)
+	METRIC_AUTO_BAN         = "AutoBan"        // Duration, Reason
+	METRIC_ADMIN_ACTION     = "AdminAction"    // Admin, Action, Target (no UserUid/Country)
+)
+
 type Metric struct {
+	SchemaVersion   int
 	Type            string
 	Time            string
 	Country         string
 	TimeZone        string
 	Referrer        string
 	UserUid         string
-	SessionDuration string
+	PseudonymKey    string  `json:",omitempty"` // Id of the key UserUid was derived with
+	SessionDuration float64 `json:",omitempty"` // Minutes
+	Duration        float64 `json:",omitempty"` // Seconds
+	BytesIn         int64   `json:",omitempty"` // From the browser
+	BytesOut        int64   `json:",omitempty"` // To the browser
+	Size            int64   `json:",omitempty"` // Bytes
+	DesktopType     string  `json:",omitempty"`
+	ViewOnly        bool    `json:",omitempty"`
+	Endpoint        string  `json:",omitempty"`
+	Source          string  `json:",omitempty"`
+	Action          string  `json:",omitempty"`
+	Admin           string  `json:",omitempty"`
+	Target          string  `json:",omitempty"`
+	Reason          string  `json:",omitempty"`
+	Count           int     `json:",omitempty"` // Occurrences a sampled event stands for
+	City            string  `json:",omitempty"`
+	ASN             uint    `json:",omitempty"`
+	Org             string  `json:",omitempty"` // Organization the ASN is registered to
 }
 
 var MLogger = MetricLogger{}
 
-func (metricLogger *MetricLogger) StartLogger(queueSize int, flushInterval int,
-	elasticServerHost string, elasticIndexName string,
-	elasticUsername string, elasticPassword string, openObserveCompatible bool) {
-	metricLogger.LogQueue = make(chan Metric, queueSize)
+func (metricLogger *MetricLogger) StartLogger(sfui *SfUI) {
 	metricLogger.LoggingActive = &atomic.Bool{}
+	metricLogger.ShutdownTimeout = time.Second * time.Duration(sfui.MetricShutdownTimeout)
+	metricLogger.sampler = &metricSampler{
+		window: METRIC_SAMPLE_WINDOW,
+		mu:     &sync.Mutex{},
+		keys:   make(map[string]*sampledMetric),
+	}
+	go metricLogger.sampler.periodicCleanup(metricLogger)
+
+	names := map[string]bool{}
+	for _, config := range sfui.metricSinkConfigs() {
+		sink, err := NewMetricSink(config)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if names[sink.Name()] {
+			log.Printf("Ignoring metric sink %s, the name is already in use\n", sink.Name())
+			continue
+		}
+		names[sink.Name()] = true
+
+		queue := &metricSinkQueue{
+			Sink:         sink,
+			Config:       config,
+			LogQueue:     make(chan Metric, sfui.MetricLoggerQueueSize),
+			overflow:     make(chan Metric, sfui.MetricLoggerQueueSize),
+			MaxRetries:   sfui.MetricMaxRetries,
+			RetryBackoff: time.Second * time.Duration(sfui.MetricRetryBackoff),
+			flushNow:     make(chan struct{}, 1),
+			reschedule:   make(chan struct{}, 1),
+			mu:           &sync.Mutex{},
+		}
+		queue.setBatching(sfui)
+		if sfui.MetricSpoolDir != "" {
+			spool, serr := newMetricSpool(sfui.MetricSpoolDir, sink.Name(), int64(sfui.MetricSpoolMaxSize)<<20)
+			if serr != nil {
+				log.Printf("Metric sink %s: spooling disabled, %s\n", sink.Name(), serr)
+			}
+			queue.Spool = spool
+		}
+
+		metricLogger.Sinks = append(metricLogger.Sinks, queue)
+		go queue.periodicFlush()
+	}
+
+	if len(metricLogger.Sinks) == 0 {
+		log.Println("No usable metric sinks configured, metric logging is disabled")
+		return
+	}
 	metricLogger.LoggingActive.Store(true)
-	metricLogger.FlushInterval = time.Minute * time.Duration(flushInterval)
-	metricLogger.ElasticIndexName = elasticIndexName
-	metricLogger.ElasticServerUrl = fmt.Sprintf("https://%s:%s@%s", elasticUsername, elasticPassword, elasticServerHost)
-	metricLogger.ElasticEndpoint = metricLogger.ElasticServerUrl + "/" +
-		metricLogger.ElasticIndexName
-	metricLogger.OpenObserveCompatible = openObserveCompatible
+}
 
-	if openObserveCompatible {
-		metricLogger.ElasticEndpoint = metricLogger.ElasticEndpoint + "/_json"
-		metricLogger.LogMarshaller = openObserveGetLogString
-	} else {
-		metricLogger.ElasticEndpoint = metricLogger.ElasticEndpoint + "/_bulk"
-		metricLogger.LogMarshaller = elasticGetLogString
+// Apply retry and batching settings to the running sinks. A sink that is
+// writing picks them up once the write is done, so this does not wait for it.
+// Sinks keep the batch size and flush interval they set themselves, changes to
+// metric_sinks need a restart.
+func (metricLogger *MetricLogger) Configure(sfui *SfUI) {
+	for _, queue := range metricLogger.Sinks {
+		go func(queue *metricSinkQueue) {
+			queue.mu.Lock()
+			defer queue.mu.Unlock()
+			latest := RunningConfig.Load() // a later reload may have finished first
+			if latest == nil {
+				latest = sfui
+			}
+			queue.MaxRetries = latest.MetricMaxRetries
+			queue.RetryBackoff = time.Second * time.Duration(latest.MetricRetryBackoff)
+			queue.setBatching(latest)
+		}(queue)
+	}
+}
+
+// Batch size and flush interval of the sink, or the global ones
+func (queue *metricSinkQueue) setBatching(sfui *SfUI) {
+	batchSize := queue.Config.BatchSize
+	if batchSize <= 0 {
+		batchSize = sfui.MetricBatchSize
+	}
+	if batchSize > cap(queue.LogQueue) {
+		batchSize = cap(queue.LogQueue) // the queue size changes on restart only
+	}
+	queue.BatchSize.Store(int64(batchSize))
+
+	flushInterval := queue.Config.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = sfui.MetricFlushInterval
+	}
+	interval := int64(time.Second * time.Duration(flushInterval))
+	if queue.FlushInterval.Swap(interval) != interval {
+		select {
+		case queue.reschedule <- struct{}{}:
+		default: // already pending, the ticker picks up the latest interval
+		}
 	}
-	go metricLogger.periodicFlush()
 }
 
 func (metricLogger *MetricLogger) AddLogEntry(log *Metric) {
-	if metricLogger.LoggingActive.Load() {
+	if metricLogger.LoggingActive != nil && metricLogger.LoggingActive.Load() {
+		log.SchemaVersion = METRIC_SCHEMA_VERSION
 		log.Time = time.Now().Format(time.RFC3339)
-		select {
-		case metricLogger.LogQueue <- *log:
-		default: // Channel full
+		for _, queue := range metricLogger.Sinks {
+			select {
+			case queue.LogQueue <- *log:
+				if int64(len(queue.LogQueue)) >= queue.BatchSize.Load() {
+					queue.triggerFlush()
+				}
+			default: // Channel full, the sink is probably down. Spooling is left to
+				// the flusher, so that callers never wait for the disk
+				select {
+				case queue.overflow <- *log:
+					queue.triggerFlush()
+				default:
+					promMetricEventsDropped.Add(1, queue.Sink.Name(), METRIC_DROP_QUEUE_FULL)
+				}
+			}
+		}
+	}
+}
+
+// Record a event on behalf of a client, the ip is only used to derive
+// UserUid and the location/network fields. Does nothing if metric logging is disabled.
+func (metricLogger *MetricLogger) LogEvent(event Metric, clientIp string) {
+	if metricLogger.LoggingActive == nil || !metricLogger.LoggingActive.Load() {
+		return
+	}
+
+	go func() {
+		if clientIp != "" {
+			event.UserUid, event.PseudonymKey = Privacy.Pseudonym(clientIp)
+			event.Country = GetCountryByIp(clientIp)
+			if geo, err := Geo.Lookup(clientIp); err == nil { // cached by GetCountryByIp
+				event.City, event.ASN, event.Org = geo.City, geo.ASN, geo.Org
+			}
+		}
+		metricLogger.AddLogEntry(&event)
+	}()
+}
+
+// Record a event at most once per METRIC_SAMPLE_WINDOW for the key, the event
+// carries the no of occurrences it stands for in Count
+func (metricLogger *MetricLogger) LogSampledEvent(event Metric, clientIp string, key string) {
+	if metricLogger.LoggingActive == nil || !metricLogger.LoggingActive.Load() {
+		return
+	}
+
+	count, send := metricLogger.sampler.sample(key, event, clientIp)
+	if send {
+		event.Count = count
+		metricLogger.LogEvent(event, clientIp)
+	}
+}
+
+func (sampler *metricSampler) sample(key string, event Metric, clientIp string) (count int, send bool) {
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+
+	sampled, ok := sampler.keys[key]
+	if !ok || time.Since(sampled.lastSent) >= sampler.window {
+		count = 1
+		if ok {
+			count += sampled.suppressed
 		}
+		sampler.keys[key] = &sampledMetric{lastSent: time.Now()}
+		return count, true
 	}
+
+	sampled.suppressed++
+	sampled.event, sampled.clientIp = event, clientIp
+	return 0, false
 }
 
-func (metricLogger *MetricLogger) periodicFlush() {
+// Report the occurrences of keys that went quiet and forget them
+func (sampler *metricSampler) periodicCleanup(metricLogger *MetricLogger) {
 	for {
-		time.Sleep(metricLogger.FlushInterval)
-		metricLogger.FlushQueue()
+		time.Sleep(sampler.window)
+		pending := []*sampledMetric{}
+		sampler.mu.Lock()
+		for key, sampled := range sampler.keys {
+			if time.Since(sampled.lastSent) < sampler.window {
+				continue
+			}
+			if sampled.suppressed > 0 {
+				pending = append(pending, sampled)
+			}
+			delete(sampler.keys, key)
+		}
+		sampler.mu.Unlock()
+
+		for _, sampled := range pending {
+			sampled.event.Count = sampled.suppressed
+			metricLogger.LogEvent(sampled.event, sampled.clientIp)
+		}
 	}
 }
 
+// Flush all sinks, waits for as long as retries take
 func (metricLogger *MetricLogger) FlushQueue() {
-	logAvailable := false
-	logsToFlush := []Metric{}
-outer:
-	for { // Extract everything from the queue
+	for _, queue := range metricLogger.Sinks {
+		queue.flush(time.Time{})
+	}
+}
+
+// Stop accepting metrics and flush what is queued within ShutdownTimeout,
+// whatever is left after that is spooled
+func (metricLogger *MetricLogger) StopLogger() {
+	if metricLogger.LoggingActive == nil {
+		return
+	}
+	metricLogger.LoggingActive.Store(false)
+	deadline := time.Now().Add(metricLogger.ShutdownTimeout)
+
+	wg := sync.WaitGroup{}
+	for _, queue := range metricLogger.Sinks {
+		wg.Add(1)
+		go func(queue *metricSinkQueue) {
+			defer wg.Done()
+			queue.flush(deadline)
+		}(queue)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline) + time.Second): // flushes that are stuck in a write
+		log.Println("Metric flush deadline exceeded")
+	}
+
+	for _, queue := range metricLogger.Sinks {
+		queue.spoolOverflow()
+		queue.spool(queue.drain(), METRIC_DROP_FAILED)
+		if err := queue.Sink.Close(); err != nil {
+			log.Printf("Metric sink %s: %s\n", queue.Sink.Name(), err)
+		}
+	}
+}
+
+func (queue *metricSinkQueue) triggerFlush() {
+	select {
+	case queue.flushNow <- struct{}{}:
+	default: // a flush is already pending
+	}
+}
+
+func (queue *metricSinkQueue) periodicFlush() {
+	ticker := time.NewTicker(time.Duration(queue.FlushInterval.Load()))
+	for {
 		select {
-		case LogEntry, ok := <-metricLogger.LogQueue:
-			if !ok {
-				break
-			}
-			logsToFlush = append(logsToFlush, LogEntry)
-			logAvailable = true
+		case <-ticker.C:
+		case <-queue.flushNow:
+		case <-queue.reschedule:
+			ticker.Reset(time.Duration(queue.FlushInterval.Load()))
+			continue
+		}
+		queue.flush(time.Time{})
+	}
+}
+
+// Extract everything from the queue
+func (queue *metricSinkQueue) drain() []Metric {
+	return drainMetrics(queue.LogQueue)
+}
+
+func drainMetrics(channel chan Metric) []Metric {
+	logs := []Metric{}
+	for {
+		select {
+		case LogEntry := <-channel:
+			logs = append(logs, LogEntry)
 		default:
-			break outer
+			return logs
 		}
 	}
+}
+
+// Spool the metrics that did not fit in the queue, they were newer than the
+// queued ones but are replayed first, the sink was behind anyway
+func (queue *metricSinkQueue) spoolOverflow() {
+	queue.spool(drainMetrics(queue.overflow), METRIC_DROP_QUEUE_FULL)
+}
+
+// Replay the spool, then write the queue in batches. Metrics that cannot be
+// delivered (before the deadline, if set) are spooled.
+func (queue *metricSinkQueue) flush(deadline time.Time) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	queue.spoolOverflow()
+	if !queue.replaySpool(deadline) {
+		queue.spool(queue.drain(), METRIC_DROP_FAILED) // keep the order, the sink is down anyway
+		return
+	}
 
-	if logAvailable {
-		logString := metricLogger.LogMarshaller(logsToFlush)
-		lerr := metricLogger.Insert(logString)
-		if lerr != nil {
-			log.Println(lerr)
+	logsToFlush := queue.drain()
+	batchSize := int(queue.BatchSize.Load())
+	for start := 0; start < len(logsToFlush); start += batchSize {
+		end := start + batchSize
+		if end > len(logsToFlush) {
+			end = len(logsToFlush)
+		}
+		if !queue.deliver(logsToFlush[start:end], deadline) {
+			queue.spool(logsToFlush[start:], METRIC_DROP_FAILED)
+			return
 		}
 	}
 }
 
+// Returns true once the spool is empty
+func (queue *metricSinkQueue) replaySpool(deadline time.Time) bool {
+	if queue.Spool == nil {
+		return true
+	}
+
+	for !queue.Spool.Empty() {
+		logs, consumed, err := queue.Spool.Peek(int(queue.BatchSize.Load()))
+		if err != nil {
+			log.Printf("Metric sink %s: could not read spool, %s\n", queue.Sink.Name(), err)
+			return false
+		}
+		if consumed == 0 {
+			return true // only a incomplete line
+		}
+		if len(logs) > 0 && !queue.deliver(logs, deadline) {
+			return false
+		}
+		if err := queue.Spool.Discard(consumed); err != nil {
+			log.Printf("Metric sink %s: could not trim spool, %s\n", queue.Sink.Name(), err)
+			return false
+		}
+	}
+	return true
+}
+
+// Write a batch, retrying with exponential backoff
+func (queue *metricSinkQueue) deliver(logs []Metric, deadline time.Time) bool {
+	sinkName := queue.Sink.Name()
+	backoff := queue.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		lerr := queue.Sink.Write(logs)
+		if lerr == nil {
+			promMetricEventsDelivered.Add(float64(len(logs)), sinkName)
+			return true
+		}
+		log.Printf("Metric sink %s: %s\n", sinkName, lerr)
+
+		if attempt >= queue.MaxRetries || (!deadline.IsZero() && time.Now().Add(backoff).After(deadline)) {
+			return false
+		}
+		time.Sleep(backoff)
+		queue.spoolOverflow() // the queue keeps filling while the sink is retried
+		promMetricEventsRetried.Add(float64(len(logs)), sinkName)
+		if backoff *= 2; backoff > METRIC_MAX_RETRY_BACKOFF {
+			backoff = METRIC_MAX_RETRY_BACKOFF
+		}
+	}
+}
+
+// Spool metrics for a later replay, dropReason is recorded if that is not possible
+func (queue *metricSinkQueue) spool(logs []Metric, dropReason string) {
+	if len(logs) == 0 {
+		return
+	}
+	sinkName := queue.Sink.Name()
+
+	if queue.Spool == nil {
+		promMetricEventsDropped.Add(float64(len(logs)), sinkName, dropReason)
+		return
+	}
+
+	dropped, err := queue.Spool.Append(logs)
+	if err != nil {
+		log.Printf("Metric sink %s: could not spool, %s\n", sinkName, err)
+	}
+	if dropped > 0 {
+		promMetricEventsDropped.Add(float64(dropped), sinkName, METRIC_DROP_SPOOL_FULL)
+	}
+	promMetricEventsSpooled.Add(float64(len(logs)-dropped), sinkName)
+}
+
 func elasticGetLogString(logs []Metric) string {
 	logData := strings.Builder{}
 	for _, log := range logs {
@@ -133,22 +539,3 @@ func openObserveGetLogString(logs []Metric) string {
 
 	return logData.String()
 }
-
-func (metricLogger *MetricLogger) Insert(Data string) error {
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", metricLogger.ElasticEndpoint, strings.NewReader(Data))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		return nil
-	}
-
-	return fmt.Errorf("code:%d Insert Failed", resp.StatusCode)
-}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Destinations for metric events, any number of sinks can be enabled at once.
+// Every sink is fed from its own queue and flushed in its own batches.
+//
+//	elastic     : bulk api, POST <url>/<index>/_bulk
+//	openobserve : json api, POST <url>/<index>/_json (url includes /api/<organization>)
+//	loki        : push api, POST <url> (ex: http://loki:3100/loki/api/v1/push)
+//	webhook     : POST a json array of events to <url>
+//	file        : append json lines to <path>, rotated at max_size MiB
+//	stdout      : print json lines
+const (
+	METRIC_SINK_ELASTIC     = "elastic"
+	METRIC_SINK_OPENOBSERVE = "openobserve"
+	METRIC_SINK_LOKI        = "loki"
+	METRIC_SINK_WEBHOOK     = "webhook"
+	METRIC_SINK_FILE        = "file"
+	METRIC_SINK_STDOUT      = "stdout"
+
+	METRIC_SINK_AUTH_NONE   = "none"
+	METRIC_SINK_AUTH_BASIC  = "basic"
+	METRIC_SINK_AUTH_BEARER = "bearer"
+	METRIC_SINK_AUTH_HEADER = "header" // API key in a custom header, ex: Authorization: ApiKey <key>
+
+	METRIC_SINK_DEFAULT_TIMEOUT = 10 // Seconds
+)
+
+type MetricSinkConfig struct {
+	Name          string            `yaml:"name"`           // Used in logs, defaults to the type
+	Type          string            `yaml:"type"`           // elastic | openobserve | loki | webhook | file | stdout
+	Url           string            `yaml:"url"`            // Server (elastic, openobserve) or endpoint (loki, webhook) url
+	Index         string            `yaml:"index"`          // Elastic index or OpenObserve stream
+	Labels        map[string]string `yaml:"labels"`         // Loki stream labels, the event type is added as "type"
+	Path          string            `yaml:"path"`           // file
+	MaxSize       int               `yaml:"max_size"`       // file, MiB after which the file is rotated, 0 to never rotate
+	MaxFiles      int               `yaml:"max_files"`      // file, no of rotated files kept
+	Auth          MetricSinkAuth    `yaml:"auth"`           // http sinks
+	TLS           MetricSinkTLS     `yaml:"tls"`            // http sinks
+	Timeout       int               `yaml:"timeout"`        // Seconds, http sinks
+	BatchSize     int               `yaml:"batch_size"`     // Events per write, a full batch is written immediately, defaults to metric_batch_size
+	FlushInterval int               `yaml:"flush_interval"` // Seconds between writes of partial batches, defaults to metric_flush_interval
+}
+
+type MetricSinkAuth struct {
+	Type     string `yaml:"type"` // none | basic | bearer | header
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`  // bearer token, or the value of the header
+	Header   string `yaml:"header"` // header name, for type header
+
+	PasswordFile string `yaml:"password_file"` // Read Password from this file
+	TokenFile    string `yaml:"token_file"`    // Read Token from this file
+}
+
+type MetricSinkTLS struct {
+	CAFile             string `yaml:"ca_file"`              // PEM bundle used instead of the system roots
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Do not verify the server certificate
+}
+
+type MetricSink interface {
+	Name() string
+	Write(metrics []Metric) error
+	Close() error
+}
+
+func NewMetricSink(config MetricSinkConfig) (MetricSink, error) {
+	name := config.Name
+	if name == "" {
+		name = config.Type
+	}
+
+	switch config.Type {
+	case METRIC_SINK_ELASTIC, METRIC_SINK_OPENOBSERVE, METRIC_SINK_WEBHOOK, METRIC_SINK_LOKI:
+		if config.Url == "" {
+			return nil, fmt.Errorf("metric sink %s: url is required", name)
+		}
+		if (config.Type == METRIC_SINK_ELASTIC || config.Type == METRIC_SINK_OPENOBSERVE) && config.Index == "" {
+			return nil, fmt.Errorf("metric sink %s: index is required", name)
+		}
+		client, err := newMetricSinkHTTPClient(config)
+		if err != nil {
+			return nil, fmt.Errorf("metric sink %s: %s", name, err)
+		}
+		if err := validateMetricSinkAuth(config.Auth); err != nil {
+			return nil, fmt.Errorf("metric sink %s: %s", name, err)
+		}
+		sink := &HTTPMetricSink{
+			name:   name,
+			client: client,
+			auth:   config.Auth,
+		}
+		url := strings.TrimSuffix(config.Url, "/")
+		switch config.Type {
+		case METRIC_SINK_ELASTIC:
+			sink.url = url + "/" + config.Index + "/_bulk"
+			sink.contentType = "application/x-ndjson"
+			sink.marshal = elasticGetLogString
+		case METRIC_SINK_OPENOBSERVE:
+			sink.url = url + "/" + config.Index + "/_json"
+			sink.contentType = "application/json"
+			sink.marshal = openObserveGetLogString
+		case METRIC_SINK_LOKI:
+			sink.url = config.Url
+			sink.contentType = "application/json"
+			labels := config.Labels
+			sink.marshal = func(logs []Metric) string { return lokiGetLogString(logs, labels) }
+		case METRIC_SINK_WEBHOOK:
+			sink.url = config.Url
+			sink.contentType = "application/json"
+			sink.marshal = openObserveGetLogString // plain json array
+		}
+		return sink, nil
+	case METRIC_SINK_FILE:
+		if config.Path == "" {
+			return nil, fmt.Errorf("metric sink %s: path is required", name)
+		}
+		return &FileMetricSink{
+			name:     name,
+			path:     config.Path,
+			maxSize:  int64(config.MaxSize) << 20,
+			maxFiles: config.MaxFiles,
+			mu:       &sync.Mutex{},
+		}, nil
+	case METRIC_SINK_STDOUT:
+		return &WriterMetricSink{name: name, writer: os.Stdout, mu: &sync.Mutex{}}, nil
+	}
+	return nil, fmt.Errorf("metric sink %s: unknown type %s", name, config.Type)
+}
+
+func validateMetricSinkAuth(auth MetricSinkAuth) error {
+	switch auth.Type {
+	case METRIC_SINK_AUTH_NONE, "", METRIC_SINK_AUTH_BASIC, METRIC_SINK_AUTH_BEARER:
+		return nil
+	case METRIC_SINK_AUTH_HEADER:
+		if auth.Header == "" {
+			return errors.New("auth.header is required")
+		}
+		return nil
+	}
+	return errors.New("unknown auth type " + auth.Type)
+}
+
+func newMetricSinkHTTPClient(config MetricSinkConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.TLS.InsecureSkipVerify}
+	if config.TLS.CAFile != "" {
+		pem, err := os.ReadFile(config.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = METRIC_SINK_DEFAULT_TIMEOUT
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * time.Duration(timeout),
+	}, nil
+}
+
+// Builds sinks from the pre metric_sinks elastic_* settings, so that
+// existing configs keep working
+func (sfui *SfUI) metricSinkConfigs() []MetricSinkConfig {
+	if len(sfui.MetricSinks) > 0 || sfui.ElasticServerHost == "" {
+		return sfui.MetricSinks
+	}
+
+	sink := MetricSinkConfig{
+		Name:  "elastic",
+		Type:  METRIC_SINK_ELASTIC,
+		Url:   "https://" + sfui.ElasticServerHost,
+		Index: sfui.ElasticIndexName,
+		Auth: MetricSinkAuth{
+			Type:     METRIC_SINK_AUTH_BASIC,
+			Username: sfui.ElasticUsername,
+			Password: sfui.ElasticPassword,
+		},
+	}
+	if sfui.OpenObserveCompatible {
+		sink.Name = "openobserve"
+		sink.Type = METRIC_SINK_OPENOBSERVE
+	}
+	return []MetricSinkConfig{sink}
+}
+
+type HTTPMetricSink struct {
+	name        string
+	url         string
+	contentType string
+	auth        MetricSinkAuth
+	client      *http.Client
+	marshal     func(logs []Metric) string
+}
+
+func (sink *HTTPMetricSink) Name() string { return sink.name }
+
+func (sink *HTTPMetricSink) Write(metrics []Metric) error {
+	req, err := http.NewRequest(http.MethodPost, sink.url, strings.NewReader(sink.marshal(metrics)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", sink.contentType)
+	switch sink.auth.Type {
+	case METRIC_SINK_AUTH_BASIC:
+		req.SetBasicAuth(sink.auth.Username, sink.auth.Password)
+	case METRIC_SINK_AUTH_BEARER:
+		req.Header.Set("Authorization", "Bearer "+sink.auth.Token)
+	case METRIC_SINK_AUTH_HEADER:
+		req.Header.Set(sink.auth.Header, sink.auth.Token)
+	}
+
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // allow the connection to be reused
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return fmt.Errorf("code:%d Insert Failed", resp.StatusCode)
+}
+
+func (sink *HTTPMetricSink) Close() error {
+	sink.client.CloseIdleConnections()
+	return nil
+}
+
+// Loki expects the events grouped by stream, one stream per event type
+func lokiGetLogString(logs []Metric, labels map[string]string) string {
+	type lokiStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	streams := []*lokiStream{}
+	byType := map[string]*lokiStream{}
+	for _, log := range logs {
+		logBytes, err := json.Marshal(log)
+		if err != nil {
+			continue
+		}
+
+		stream, ok := byType[log.Type]
+		if !ok {
+			streamLabels := map[string]string{"type": log.Type}
+			for name, value := range labels {
+				streamLabels[name] = value
+			}
+			stream = &lokiStream{Stream: streamLabels}
+			byType[log.Type] = stream
+			streams = append(streams, stream)
+		}
+
+		timestamp := time.Now()
+		if t, terr := time.Parse(time.RFC3339, log.Time); terr == nil {
+			timestamp = t
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(timestamp.UnixNano(), 10), string(logBytes)})
+	}
+
+	data, _ := json.Marshal(map[string][]*lokiStream{"streams": streams})
+	return string(data)
+}
+
+// One json object per line
+func jsonLines(metrics []Metric) []byte {
+	data := bytes.Buffer{}
+	for _, metric := range metrics {
+		metricBytes, err := json.Marshal(metric)
+		if err == nil {
+			data.Write(metricBytes)
+			data.WriteString("\n")
+		}
+	}
+	return data.Bytes()
+}
+
+type WriterMetricSink struct {
+	name   string
+	writer io.Writer
+	mu     *sync.Mutex
+}
+
+func (sink *WriterMetricSink) Name() string { return sink.name }
+
+func (sink *WriterMetricSink) Write(metrics []Metric) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_, err := sink.writer.Write(jsonLines(metrics))
+	return err
+}
+
+func (sink *WriterMetricSink) Close() error { return nil }
+
+// Appends json lines to a file, once the file reaches maxSize it is renamed
+// to path.1 (path.1 to path.2 and so on), at most maxFiles old files are kept
+type FileMetricSink struct {
+	name     string
+	path     string
+	maxSize  int64
+	maxFiles int
+	mu       *sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+func (sink *FileMetricSink) Name() string { return sink.name }
+
+func (sink *FileMetricSink) Write(metrics []Metric) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	if sink.file == nil {
+		if err := sink.open(); err != nil {
+			return err
+		}
+	}
+
+	data := jsonLines(metrics)
+	if sink.maxSize > 0 && sink.size > 0 && sink.size+int64(len(data)) > sink.maxSize {
+		if err := sink.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := sink.file.Write(data)
+	sink.size += int64(n)
+	return err
+}
+
+func (sink *FileMetricSink) open() error {
+	file, err := os.OpenFile(sink.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = info.Size()
+	return nil
+}
+
+func (sink *FileMetricSink) rotate() error {
+	sink.file.Close()
+	sink.file = nil
+
+	if sink.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", sink.path, sink.maxFiles))
+		for i := sink.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", sink.path, i), fmt.Sprintf("%s.%d", sink.path, i+1))
+		}
+		if err := os.Rename(sink.path, sink.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(sink.path, 0); err != nil {
+		return err
+	}
+	return sink.open()
+}
+
+func (sink *FileMetricSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
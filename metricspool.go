@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics that could not be delivered to a sink are appended to a json lines
+// file, one per sink, and replayed before anything else once the sink
+// recovers. The file is bounded, metrics that do not fit are dropped.
+//
+// Replayed metrics are not cut from the file, the read offset is kept in
+// "<spool>.offset" instead. The file is removed once everything was replayed
+// and compacted once more than half of it was, so a replay is linear in the
+// size of the spool. A crash can replay a batch twice, but loses nothing.
+type metricSpool struct {
+	path    string
+	maxSize int64
+	mu      *sync.Mutex
+	size    int64 // of the file
+	offset  int64 // bytes already replayed
+}
+
+var spoolNameSanitizer = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+func newMetricSpool(dir string, sinkName string, maxSize int64) (*metricSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	spool := &metricSpool{
+		path:    filepath.Join(dir, spoolNameSanitizer.ReplaceAllString(sinkName, "_")+".jsonl"),
+		maxSize: maxSize,
+		mu:      &sync.Mutex{},
+	}
+	if info, err := os.Stat(spool.path); err == nil {
+		spool.size = info.Size() // left over from a previous run, replayed on the next flush
+		if data, rerr := os.ReadFile(spool.offsetPath()); rerr == nil {
+			offset, perr := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+			if perr == nil && offset >= 0 && offset <= spool.size {
+				spool.offset = offset
+			}
+		}
+	}
+	return spool, nil
+}
+
+func (spool *metricSpool) offsetPath() string {
+	return spool.path + ".offset"
+}
+
+func (spool *metricSpool) Empty() bool {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+	return spool.offset >= spool.size
+}
+
+// Append metrics, returns the no of metrics that did not fit
+func (spool *metricSpool) Append(metrics []Metric) (dropped int, err error) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	data := bytes.Buffer{}
+	for i, metric := range metrics {
+		line, merr := json.Marshal(metric)
+		if merr != nil {
+			dropped++
+			continue
+		}
+		if spool.maxSize > 0 && spool.size-spool.offset+int64(data.Len()+len(line)+1) > spool.maxSize {
+			dropped += len(metrics) - i
+			break
+		}
+		data.Write(line)
+		data.WriteString("\n")
+	}
+	if data.Len() == 0 {
+		return dropped, nil
+	}
+
+	file, err := os.OpenFile(spool.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return len(metrics), err
+	}
+	defer file.Close()
+
+	n, err := file.Write(data.Bytes())
+	spool.size += int64(n)
+	return dropped, err
+}
+
+// Read up to limit spooled metrics, consumed is the length of the data they
+// occupy and is to be passed to Discard once they are delivered
+func (spool *metricSpool) Peek(limit int) (metrics []Metric, consumed int64, err error) {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	file, err := os.Open(spool.path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	if _, serr := file.Seek(spool.offset, io.SeekStart); serr != nil {
+		return nil, 0, serr
+	}
+	reader := bufio.NewReader(file)
+	for len(metrics) < limit {
+		line, rerr := reader.ReadBytes('\n')
+		if rerr != nil {
+			break // a incomplete last line is left for later
+		}
+		consumed += int64(len(line))
+
+		metric := Metric{}
+		if json.Unmarshal(line, &metric) == nil {
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics, consumed, nil
+}
+
+// Skip the next n bytes of the spool, appends made since Peek are kept
+func (spool *metricSpool) Discard(n int64) error {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	spool.offset += n
+	if spool.offset >= spool.size {
+		spool.size, spool.offset = 0, 0
+		if err := os.Remove(spool.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(spool.offsetPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if spool.offset < spool.size/2 {
+		return writeFileAtomic(spool.offsetPath(), []byte(strconv.FormatInt(spool.offset, 10)), 0600)
+	}
+
+	// Compact, the offset is reset first so that a crash in between replays
+	// the spool again instead of skipping part of it
+	data, err := os.ReadFile(spool.path)
+	if err != nil {
+		return err
+	}
+	if spool.offset > int64(len(data)) {
+		spool.offset = int64(len(data)) // truncated behind our back
+	}
+	if err := os.Remove(spool.offsetPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := writeFileAtomic(spool.path, data[spool.offset:], 0600); err != nil {
+		return err
+	}
+	spool.size = int64(len(data)) - spool.offset
+	spool.offset = 0
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func spoolTestMetrics(from int, to int) []Metric {
+	metrics := []Metric{}
+	for i := from; i < to; i++ {
+		metrics = append(metrics, Metric{Type: "Test", Target: "m" + strconv.Itoa(i)})
+	}
+	return metrics
+}
+
+func spoolTargets(metrics []Metric) []string {
+	targets := []string{}
+	for _, metric := range metrics {
+		targets = append(targets, metric.Target)
+	}
+	return targets
+}
+
+// Length of a spooled metric from spoolTestMetrics(0, 10)
+func spoolLineLength() int64 {
+	line, _ := json.Marshal(Metric{Type: "Test", Target: "m0"})
+	return int64(len(line) + 1)
+}
+
+func TestMetricSpoolReplay(t *testing.T) {
+	spool, err := newMetricSpool(t.TempDir(), "sink", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spool.Empty() {
+		t.Fatal("new spool is not empty")
+	}
+	if _, err := spool.Append(spoolTestMetrics(0, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		limit      int
+		want       []string
+		offsetFile bool  // a offset is recorded after the discard
+		size       int64 // of the spool file after the discard, in lines
+	}{
+		{"first batch", 3, []string{"m0", "m1", "m2"}, true, 10},
+		{"compacted past half", 3, []string{"m3", "m4", "m5"}, false, 4},
+		{"rest", 10, []string{"m6", "m7", "m8", "m9"}, false, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics, consumed, err := spool.Peek(test.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := spoolTargets(metrics); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("Peek() = %v, want %v", got, test.want)
+			}
+			if consumed != int64(len(test.want))*spoolLineLength() {
+				t.Errorf("consumed = %d, want %d lines", consumed, len(test.want))
+			}
+			if err := spool.Discard(consumed); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, serr := os.Stat(spool.offsetPath()); (serr == nil) != test.offsetFile {
+				t.Errorf("offset file exists = %v, want %v", serr == nil, test.offsetFile)
+			}
+			info, serr := os.Stat(spool.path)
+			switch {
+			case test.size < 0 && serr == nil:
+				t.Error("spool file left after everything was replayed")
+			case test.size >= 0 && (serr != nil || info.Size() != test.size*spoolLineLength()):
+				t.Errorf("spool file size = %v, want %d lines", info, test.size)
+			}
+		})
+	}
+
+	if !spool.Empty() {
+		t.Error("spool not empty after everything was replayed")
+	}
+}
+
+func TestMetricSpoolMaxSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxLines int64
+		first    int // metrics appended and partly replayed before
+		replayed int
+		append   int
+		dropped  int
+	}{
+		{"no limit", 0, 0, 0, 20, 0},
+		{"fits", 10, 0, 0, 10, 0},
+		{"overflow", 10, 0, 0, 14, 4},
+		{"full", 10, 10, 0, 3, 3},
+		{"replayed bytes do not count", 10, 10, 4, 6, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spool, err := newMetricSpool(t.TempDir(), "sink", test.maxLines*spoolLineLength())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// single digit targets, so every line has the same length
+			spool.Append(spoolTestMetrics(0, test.first))
+			_, consumed, _ := spool.Peek(test.replayed)
+			spool.Discard(consumed)
+
+			metrics := make([]Metric, test.append)
+			for i := range metrics {
+				metrics[i] = Metric{Type: "Test", Target: "m" + strconv.Itoa(i%10)}
+			}
+			dropped, err := spool.Append(metrics)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dropped != test.dropped {
+				t.Errorf("Append() dropped %d, want %d", dropped, test.dropped)
+			}
+		})
+	}
+}
+
+func TestMetricSpoolReopen(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset string // content of the offset file, none if empty
+		want   string // first metric replayed after the reopen
+	}{
+		{"no offset file", "", "m0"},
+		{"recorded offset", strconv.FormatInt(2*spoolLineLength(), 10), "m2"},
+		{"garbled offset", "garbage", "m0"},
+		{"negative offset", "-5", "m0"},
+		{"offset past the end", "100000", "m0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			spool, _ := newMetricSpool(dir, "sink/../name", 0)
+			spool.Append(spoolTestMetrics(0, 5))
+			if test.offset != "" {
+				os.WriteFile(spool.offsetPath(), []byte(test.offset), 0600)
+			}
+
+			reopened, err := newMetricSpool(dir, "sink/../name", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reopened.path != spool.path {
+				t.Fatalf("reopened %s, want %s", reopened.path, spool.path)
+			}
+			metrics, _, _ := reopened.Peek(1)
+			if len(metrics) != 1 || metrics[0].Target != test.want {
+				t.Errorf("Peek() after reopen = %v, want %s", spoolTargets(metrics), test.want)
+			}
+		})
+	}
+}
+
+func TestMetricSpoolSkipsBrokenLines(t *testing.T) {
+	spool, _ := newMetricSpool(t.TempDir(), "sink", 0)
+	spool.Append(spoolTestMetrics(0, 1))
+	file, _ := os.OpenFile(spool.path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString("not json\n{\"Target\":\"incomplete")
+	file.Close()
+	spool.size += int64(len("not json\n{\"Target\":\"incomplete"))
+
+	metrics, consumed, err := spool.Peek(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := spoolTargets(metrics); !reflect.DeepEqual(got, []string{"m0"}) {
+		t.Errorf("Peek() = %v, want [m0]", got)
+	}
+	if consumed != spoolLineLength()+int64(len("not json\n")) {
+		t.Errorf("consumed = %d, the incomplete last line should be left", consumed)
+	}
+}
+
+func TestMetricSpoolAppendWhileReplaying(t *testing.T) {
+	spool, _ := newMetricSpool(t.TempDir(), "sink", 0)
+	spool.Append(spoolTestMetrics(0, 2))
+	_, consumed, _ := spool.Peek(10)
+
+	spool.Append(spoolTestMetrics(2, 3))
+	if err := spool.Discard(consumed); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, _, _ := spool.Peek(10)
+	if got := spoolTargets(metrics); !reflect.DeepEqual(got, []string{"m2"}) {
+		t.Errorf("Peek() = %v, want the metric appended during the replay", got)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Country and ASN based access policies, evaluated on login (login scope)
+// and additionally on new instance creation (new_instance scope). A ASN rule
+// takes precedence over a country rule, the default applies if neither matches.
+// Policies can be replaced through the admin api, changes are persisted to
+// AccessPolicyPath and take precedence over the config on the next start.
+const (
+	ACCESS_ALLOW     = "allow"
+	ACCESS_DENY      = "deny"
+	ACCESS_CHALLENGE = "challenge"
+
+	POLICY_SCOPE_LOGIN        = "login"
+	POLICY_SCOPE_NEW_INSTANCE = "new_instance"
+)
+
+type AccessPolicy struct {
+	Default   string            `yaml:"default" json:"default"`     // allow | deny | challenge, empty for allow
+	Countries map[string]string `yaml:"countries" json:"countries"` // ISO country code->action
+	ASNs      map[uint]string   `yaml:"asns" json:"asns"`           // AS number->action
+}
+
+type AccessPolicyStore struct {
+	mu       *sync.RWMutex
+	policies map[string]AccessPolicy // scope->policy
+	path     string
+}
+
+var Policies = AccessPolicyStore{}
+
+func (store *AccessPolicyStore) Init(policies map[string]AccessPolicy, path string) {
+	store.mu = &sync.RWMutex{}
+	store.path = path
+
+	if data, err := os.ReadFile(path); err == nil {
+		saved := map[string]AccessPolicy{}
+		if jerr := json.Unmarshal(data, &saved); jerr == nil && validateAccessPolicies(saved) == nil {
+			if len(policies) > 0 {
+				// The file holds the last policies set through /policy, they
+				// are kept over the config until the file is removed
+				log.Printf("Access policies in %s take precedence over access_policies in the config, remove the file to use the config\n", path)
+			}
+			policies = saved
+			log.Printf("Loaded access policies from %s\n", path)
+		} else {
+			log.Printf("Ignoring invalid access policies in %s\n", path)
+		}
+	}
+
+	if err := validateAccessPolicies(policies); err != nil {
+		log.Println("Ignoring invalid access policies:", err)
+		policies = nil
+	}
+	store.policies = normalizeAccessPolicies(policies)
+}
+
+func validateAccessPolicies(policies map[string]AccessPolicy) error {
+	validAction := func(action string) bool {
+		return action == ACCESS_ALLOW || action == ACCESS_DENY || action == ACCESS_CHALLENGE
+	}
+
+	for scope, policy := range policies {
+		if scope != POLICY_SCOPE_LOGIN && scope != POLICY_SCOPE_NEW_INSTANCE {
+			return fmt.Errorf("unknown scope %s", scope)
+		}
+		if policy.Default != "" && !validAction(policy.Default) {
+			return fmt.Errorf("invalid default action %s", policy.Default)
+		}
+		for country, action := range policy.Countries {
+			if len(country) != 2 || !validAction(action) {
+				return fmt.Errorf("invalid country rule %s: %s", country, action)
+			}
+		}
+		for asn, action := range policy.ASNs {
+			if !validAction(action) {
+				return fmt.Errorf("invalid asn rule %d: %s", asn, action)
+			}
+		}
+	}
+	return nil
+}
+
+func normalizeAccessPolicies(policies map[string]AccessPolicy) map[string]AccessPolicy {
+	normalized := map[string]AccessPolicy{}
+	for scope, policy := range policies {
+		countries := map[string]string{}
+		for country, action := range policy.Countries {
+			countries[strings.ToUpper(country)] = action
+		}
+		policy.Countries = countries
+		if policy.ASNs == nil {
+			policy.ASNs = map[uint]string{}
+		}
+		if policy.Default == "" {
+			policy.Default = ACCESS_ALLOW
+		}
+		normalized[scope] = policy
+	}
+	return normalized
+}
+
+// Returns the action for a ip and the reason for it
+func (store *AccessPolicyStore) Evaluate(scope string, ip string) (action string, reason string) {
+	if store.mu == nil {
+		return ACCESS_ALLOW, ""
+	}
+
+	store.mu.RLock()
+	policy, ok := store.policies[scope]
+	store.mu.RUnlock()
+	if !ok {
+		return ACCESS_ALLOW, ""
+	}
+
+	geo, err := Geo.Lookup(ip)
+	if err == nil && geo.ASN != 0 {
+		if action, ok := policy.ASNs[geo.ASN]; ok {
+			return action, fmt.Sprintf("%s from network AS%d (%s) is not permitted", scopeDescription(scope), geo.ASN, geo.Org)
+		}
+	}
+
+	if err == nil && geo.Country != "" {
+		if action, ok := policy.Countries[geo.Country]; ok {
+			return action, fmt.Sprintf("%s from country %s is not permitted", scopeDescription(scope), geo.Country)
+		}
+	}
+
+	return policy.Default, fmt.Sprintf("%s from your location is not permitted", scopeDescription(scope))
+}
+
+func scopeDescription(scope string) string {
+	if scope == POLICY_SCOPE_NEW_INSTANCE {
+		return "Creating new instances"
+	}
+	return "Logging in"
+}
+
+func (store *AccessPolicyStore) Get() map[string]AccessPolicy {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.policies
+}
+
+// Replace all policies, the new policies are persisted
+func (store *AccessPolicyStore) Set(policies map[string]AccessPolicy) error {
+	if err := validateAccessPolicies(policies); err != nil {
+		return err
+	}
+	policies = normalizeAccessPolicies(policies)
+
+	store.mu.Lock()
+	store.policies = policies
+	store.mu.Unlock()
+
+	data, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.path, data, 0600)
+}
+
+// Enforce the policies of a scope, writes the refusal and returns false if
+// the request must not proceed. A challenged request may proceed once it
+// carries a proof of work, challengeReason is set in that case.
+func (sfui *SfUI) enforceAccessPolicy(w http.ResponseWriter, scope string, clientIp string) (allowed bool, challengeReason string) {
+	action, reason := Policies.Evaluate(scope, clientIp)
+
+	switch action {
+	case ACCESS_DENY:
+		w.WriteHeader(http.StatusForbidden)
+		response, _ := json.Marshal(TermResponse{Status: "Access Denied", Reason: reason})
+		w.Write(response)
+		return false, ""
+	case ACCESS_CHALLENGE:
+		return true, reason + " without a challenge"
+	}
+
+	return true, ""
+}
+
+func (sfui *SfUI) handleAccessPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	adminName, ok := sfui.authenticateAdmin(r)
+
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"status":"denied"}`))
+		return
+	}
+
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		policies := map[string]AccessPolicy{}
+		if err == nil {
+			err = json.Unmarshal(data, &policies)
+		}
+		if err == nil {
+			err = validateAccessPolicies(policies)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			response, _ := json.Marshal(map[string]string{"status": err.Error()})
+			w.Write(response)
+			return
+		}
+
+		if serr := Policies.Set(policies); serr != nil {
+			log.Println("Could not save access policies:", serr)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status":"policies applied but could not be saved"}`))
+			return
+		}
+		log.Printf("%s updated the access policies\n", adminName)
+		logAdminAction(adminName, "set_policy", "")
+	}
+
+	policyData, err := json.Marshal(Policies.Get())
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write(policyData)
+		return
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(`{"status":"error"}`))
+}
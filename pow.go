@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hashcash style proof of work, required for new instances (if enabled) and
+// for requests challenged by a access policy. A challenge is signed and bound
+// to the ip it was issued to, the server only remembers solved challenges
+// (until they expire) to prevent replays.
+//
+// Format : base64url("pow" "." nonce "." difficulty "." expiry) "." base64url(HMAC(payload "." ip))
+// A solution is any string for which sha256(challenge ":" solution) starts
+// with difficulty zero bits.
+const (
+	POW_MAX_SOLUTION_LENGTH = 64
+	POW_DIFFICULTY_LIMIT    = 24 // ~16M hashes on average, a browser needs up to a minute for that
+
+	POW_SCALE_PREFIX  = "prefix"
+	POW_SCALE_ASN     = "asn"
+	POW_SCALE_COUNTRY = "country"
+)
+
+type PoWChallenge struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"` // Leading zero bits
+	Expiry     int64  `json:"expiry"`     // Unix time
+}
+
+type PoWIssuer struct {
+	key      []byte
+	mu       *sync.Mutex
+	settings powSettings
+	solved   map[string]time.Time      // replay cache, nonce->expiry
+	volume   map[string]*slidingWindow // prefix|asn|country key->recent creations
+}
+
+// Options from the config, replaced as a whole on a reload
+type powSettings struct {
+	ttl            time.Duration
+	baseDifficulty int
+	maxDifficulty  int
+	scaleWindow    time.Duration
+	scaleSteps     map[string]int // prefix|asn|country -> creations per additional bit
+	ipv4PrefixBits int
+	ipv6PrefixBits int
+}
+
+var PoW = PoWIssuer{}
+
+// key is the access token key, challenges are signed with a key derived from
+// it so that a challenge can never pass as a token or the other way around
+func (issuer *PoWIssuer) Init(key string, sfui *SfUI) {
+	if key == "" {
+		issuer.key = []byte(RandomStr(42)) // challenges do not survive a restart
+	} else {
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte("sfui proof of work"))
+		issuer.key = mac.Sum(nil)
+	}
+	issuer.mu = &sync.Mutex{}
+	issuer.solved = make(map[string]time.Time)
+	issuer.volume = make(map[string]*slidingWindow)
+	issuer.Configure(sfui)
+	go issuer.periodicCleanup()
+}
+
+// Apply the pow options, on start and on a config reload. Recent creations
+// are kept, challenges already issued keep their difficulty and expiry.
+func (issuer *PoWIssuer) Configure(sfui *SfUI) {
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+
+	issuer.settings = powSettings{
+		ttl:            time.Second * time.Duration(sfui.PoWChallengeTTL),
+		baseDifficulty: sfui.PoWDifficulty,
+		maxDifficulty:  sfui.PoWMaxDifficulty,
+		scaleWindow:    time.Minute * time.Duration(sfui.PoWScaleWindow),
+		scaleSteps:     sfui.PoWScaleSteps,
+		ipv4PrefixBits: sfui.RateLimitIPv4Prefix,
+		ipv6PrefixBits: sfui.RateLimitIPv6Prefix,
+	}
+}
+
+func (issuer *PoWIssuer) currentSettings() powSettings {
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	return issuer.settings
+}
+
+func (issuer *PoWIssuer) periodicCleanup() {
+	for {
+		time.Sleep(time.Minute)
+		issuer.mu.Lock()
+		for nonce, expiry := range issuer.solved {
+			if time.Now().After(expiry) {
+				delete(issuer.solved, nonce)
+			}
+		}
+		for key, window := range issuer.volume {
+			if time.Since(window.lastSeen) > 2*issuer.settings.scaleWindow {
+				delete(issuer.volume, key)
+			}
+		}
+		issuer.mu.Unlock()
+	}
+}
+
+func (issuer *PoWIssuer) Issue(clientIp string) PoWChallenge {
+	settings := issuer.currentSettings()
+	difficulty := issuer.difficulty(clientIp, settings)
+	expiry := time.Now().Add(settings.ttl).Unix()
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte("pow." + RandomStr(16) + "." +
+		strconv.Itoa(difficulty) + "." + strconv.FormatInt(expiry, 10)))
+
+	return PoWChallenge{
+		Challenge:  payload + "." + issuer.sign(payload, clientIp),
+		Difficulty: difficulty,
+		Expiry:     expiry,
+	}
+}
+
+func (issuer *PoWIssuer) sign(payload string, clientIp string) string {
+	mac := hmac.New(sha256.New, issuer.key)
+	mac.Write([]byte(payload + "." + clientIp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (issuer *PoWIssuer) Verify(challenge string, solution string, clientIp string) error {
+	if challenge == "" || solution == "" {
+		return errors.New("solve the challenge to continue")
+	}
+	if len(solution) > POW_MAX_SOLUTION_LENGTH || issuer.key == nil {
+		return errors.New("invalid solution")
+	}
+
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(issuer.sign(parts[0], clientIp)), []byte(parts[1])) {
+		return errors.New("invalid challenge")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	fields := strings.Split(string(payload), ".")
+	if err != nil || len(fields) != 4 || fields[0] != "pow" {
+		return errors.New("invalid challenge")
+	}
+	nonce := fields[1]
+	difficulty, derr := strconv.Atoi(fields[2])
+	expiry, eerr := strconv.ParseInt(fields[3], 10, 64)
+	if derr != nil || eerr != nil {
+		return errors.New("invalid challenge")
+	}
+
+	expiresAt := time.Unix(expiry, 0)
+	if time.Now().After(expiresAt) {
+		return errors.New("challenge expired")
+	}
+
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+solution))) < difficulty {
+		return errors.New("invalid solution")
+	}
+
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	if _, used := issuer.solved[nonce]; used {
+		return errors.New("challenge already used")
+	}
+	issuer.solved[nonce] = expiresAt
+
+	return nil
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	zeros := 0
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// Record a new instance, creations raise the difficulty for the same
+// prefix, ASN and country
+func (issuer *PoWIssuer) RecordCreation(clientIp string) {
+	if issuer.mu == nil {
+		return
+	}
+
+	keys := issuer.volumeKeys(clientIp, issuer.currentSettings())
+	now := time.Now()
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	for _, key := range keys {
+		window, ok := issuer.volume[key]
+		if !ok {
+			window = &slidingWindow{}
+			issuer.volume[key] = window
+		}
+		window.add(now, issuer.settings.scaleWindow)
+	}
+}
+
+// Base difficulty, plus a bit for every scale step worth of recent creations
+// from the busiest of the clients prefix, ASN and country
+func (issuer *PoWIssuer) difficulty(clientIp string, settings powSettings) int {
+	extra := 0
+
+	if settings.scaleWindow > 0 {
+		keys := issuer.volumeKeys(clientIp, settings)
+		now := time.Now()
+		issuer.mu.Lock()
+		for _, key := range keys {
+			window, ok := issuer.volume[key]
+			step := settings.scaleSteps[strings.SplitN(key, ":", 2)[0]]
+			if !ok || step <= 0 {
+				continue
+			}
+			if extraBits := int(window.estimate(now, settings.scaleWindow)) / step; extraBits > extra {
+				extra = extraBits
+			}
+		}
+		issuer.mu.Unlock()
+	}
+
+	difficulty := settings.baseDifficulty + extra
+	if difficulty > settings.maxDifficulty {
+		difficulty = settings.maxDifficulty
+	}
+	return difficulty
+}
+
+func (issuer *PoWIssuer) volumeKeys(clientIp string, settings powSettings) []string {
+	keys := []string{}
+	if addr, err := ParseAddr(clientIp); err == nil {
+		keys = append(keys, POW_SCALE_PREFIX+":"+addrPrefix(addr, settings.ipv4PrefixBits, settings.ipv6PrefixBits).String())
+	}
+	if geo, err := Geo.Lookup(clientIp); err == nil {
+		if geo.ASN != 0 {
+			keys = append(keys, POW_SCALE_ASN+":"+strconv.FormatUint(uint64(geo.ASN), 10))
+		}
+		if geo.Country != "" {
+			keys = append(keys, POW_SCALE_COUNTRY+":"+geo.Country)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestPoWIssuer(difficulty int) *PoWIssuer {
+	issuer := &PoWIssuer{
+		key:    []byte("test key"),
+		mu:     &sync.Mutex{},
+		solved: make(map[string]time.Time),
+		volume: make(map[string]*slidingWindow),
+	}
+	issuer.Configure(&SfUI{
+		PoWDifficulty:       difficulty,
+		PoWMaxDifficulty:    difficulty,
+		PoWChallengeTTL:     60,
+		RateLimitIPv4Prefix: 24,
+		RateLimitIPv6Prefix: 48,
+	})
+	return issuer
+}
+
+// A challenge with arbitrary fields, signed by the issuer
+func signedChallenge(issuer *PoWIssuer, fields string, clientIp string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fields))
+	return payload + "." + issuer.sign(payload, clientIp)
+}
+
+func solvePoW(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+solution))) >= difficulty {
+			return solution
+		}
+	}
+}
+
+func TestPoWVerify(t *testing.T) {
+	issuer := newTestPoWIssuer(8)
+	expiry := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+
+	issued := issuer.Issue("192.0.2.1").Challenge
+	expired := signedChallenge(issuer, "pow.nonce1.8."+past, "192.0.2.1")
+	otherKind := signedChallenge(issuer, "tok.nonce2.8."+expiry, "192.0.2.1")
+	badDifficulty := signedChallenge(issuer, "pow.nonce3.x."+expiry, "192.0.2.1")
+	otherIssuer := newTestPoWIssuer(8)
+	otherIssuer.key = []byte("other key")
+	forged := otherIssuer.Issue("192.0.2.1").Challenge
+
+	tests := []struct {
+		name      string
+		challenge string
+		solution  string
+		ip        string
+		valid     bool
+	}{
+		{"solved", issued, solvePoW(issued, 8), "192.0.2.1", true},
+		{"replayed", issued, solvePoW(issued, 8), "192.0.2.1", false},
+		{"other ip", issuer.Issue("192.0.2.1").Challenge, "0", "192.0.2.2", false},
+		{"expired", expired, solvePoW(expired, 8), "192.0.2.1", false},
+		{"not a pow challenge", otherKind, solvePoW(otherKind, 8), "192.0.2.1", false},
+		{"malformed difficulty", badDifficulty, solvePoW(badDifficulty, 8), "192.0.2.1", false},
+		{"signed with another key", forged, solvePoW(forged, 8), "192.0.2.1", false},
+		{"oversized solution", issuer.Issue("192.0.2.1").Challenge, strings.Repeat("0", POW_MAX_SOLUTION_LENGTH+1), "192.0.2.1", false},
+		{"missing solution", issuer.Issue("192.0.2.1").Challenge, "", "192.0.2.1", false},
+		{"missing challenge", "", "0", "192.0.2.1", false},
+		{"missing signature", strings.Split(issued, ".")[0], "0", "192.0.2.1", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := issuer.Verify(test.challenge, test.solution, test.ip)
+			if (err == nil) != test.valid {
+				t.Errorf("Verify() error = %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestPoWVerifyWrongSolution(t *testing.T) {
+	issuer := newTestPoWIssuer(16)
+	challenge := issuer.Issue("192.0.2.1").Challenge
+
+	// a solution with fewer zero bits than required
+	var wrong string
+	for i := 0; ; i++ {
+		wrong = strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+wrong))) < 16 {
+			break
+		}
+	}
+	if err := issuer.Verify(challenge, wrong, "192.0.2.1"); err == nil {
+		t.Error("Verify() accepted a solution below the difficulty")
+	}
+
+	// a failed attempt does not use up the challenge
+	if err := issuer.Verify(challenge, solvePoW(challenge, 16), "192.0.2.1"); err != nil {
+		t.Errorf("Verify() error = %v after a failed attempt", err)
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		prefix []byte
+		want   int
+	}{
+		{[]byte{0x80}, 0},
+		{[]byte{0x01}, 7},
+		{[]byte{0x00, 0x40}, 9},
+		{[]byte{0x00, 0x00, 0x0F}, 20},
+	}
+
+	for _, test := range tests {
+		var hash [sha256.Size]byte
+		for i := range hash {
+			hash[i] = 0xFF
+		}
+		copy(hash[:], test.prefix)
+		if got := leadingZeroBits(hash); got != test.want {
+			t.Errorf("leadingZeroBits(%x...) = %d, want %d", test.prefix, got, test.want)
+		}
+	}
+
+	if got := leadingZeroBits([sha256.Size]byte{}); got != 256 {
+		t.Errorf("leadingZeroBits(zero hash) = %d, want 256", got)
+	}
+}
+
+func TestPoWDifficultyScaling(t *testing.T) {
+	tests := []struct {
+		name      string
+		creations int
+		clientIp  string
+		want      int
+	}{
+		{"no creations", 0, "192.0.2.1", 4},
+		{"below a step", 1, "192.0.2.1", 4},
+		{"one step", 2, "192.0.2.1", 5},
+		{"capped at the max", 20, "192.0.2.1", 6},
+		{"other prefix", 20, "198.51.100.1", 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := newTestPoWIssuer(4)
+			issuer.Configure(&SfUI{
+				PoWDifficulty:       4,
+				PoWMaxDifficulty:    6,
+				PoWChallengeTTL:     60,
+				PoWScaleWindow:      10,
+				PoWScaleSteps:       map[string]int{POW_SCALE_PREFIX: 2},
+				RateLimitIPv4Prefix: 24,
+				RateLimitIPv6Prefix: 48,
+			})
+			for i := 0; i < test.creations; i++ {
+				issuer.RecordCreation("192.0.2.2") // same /24 as 192.0.2.1
+			}
+
+			if got := issuer.Issue(test.clientIp).Difficulty; got != test.want {
+				t.Errorf("difficulty = %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Prometheus metrics in the text exposition format (0.0.4), served on /metrics.
+// Only counters, gauges and histograms are needed, so they are implemented
+// here instead of pulling in the client library.
+type promCollector interface {
+	writeTo(sb *strings.Builder)
+}
+
+var promRegistry = []promCollector{}
+
+var (
+	promClientsActive = newPromGaugeFunc("sfui_clients_active", "Clients with a master SSH connection", func() float64 {
+		cmu.Lock()
+		defer cmu.Unlock()
+		return float64(len(clients))
+	})
+	promTerminalsActive     = newPromGauge("sfui_terminals_active", "Open terminal websockets")
+	promDesktopsActive      = newPromGauge("sfui_desktops_active", "Open desktop websockets")
+	promSharedViewersActive = newPromGauge("sfui_shared_desktop_viewers_active", "Open shared desktop websockets")
+	promBytes               = newPromCounterVec("sfui_bytes_total", "Bytes relayed, in is from the browser, out is to the browser", "channel", "direction")
+	promSSHDialSeconds      = newPromHistogramVec("sfui_ssh_dial_duration_seconds", "Time taken to establish master SSH connections", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "endpoint")
+	promSSHDialFailures     = newPromCounterVec("sfui_ssh_dial_failures_total", "Failed master SSH connection attempts", "endpoint")
+	promLogins              = newPromCounterVec("sfui_logins_total", "Requests to /secret by outcome", "outcome")
+	promBanHits             = newPromCounterVec("sfui_ban_hits_total", "Requests rejected due to a ban", "source")
+
+	promMetricEventsDelivered = newPromCounterVec("sfui_metric_events_delivered_total", "Metric events written to a sink", "sink")
+	promMetricEventsRetried   = newPromCounterVec("sfui_metric_events_retried_total", "Metric events whose write to a sink was retried", "sink")
+	promMetricEventsSpooled   = newPromCounterVec("sfui_metric_events_spooled_total", "Metric events spooled to disk for a later replay", "sink")
+	promMetricEventsDropped   = newPromCounterVec("sfui_metric_events_dropped_total", "Metric events lost, by reason", "sink", "reason")
+)
+
+const (
+	PROM_CHANNEL_TERMINAL       = "terminal"
+	PROM_CHANNEL_DESKTOP        = "desktop"
+	PROM_CHANNEL_SHARED_DESKTOP = "shared_desktop"
+	PROM_CHANNEL_FILEBROWSER    = "filebrowser"
+
+	PROM_DIRECTION_IN  = "in"
+	PROM_DIRECTION_OUT = "out"
+)
+
+func promEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func promFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Label values are joined with a separator that cannot occur in them
+const promLabelSeparator = "\xff"
+
+func promLabels(names []string, key string, extra ...string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, promLabelSeparator) {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], promEscape(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func promHeader(sb *strings.Builder, name string, help string, promType string) {
+	sb.WriteString("# HELP " + name + " " + help + "\n")
+	sb.WriteString("# TYPE " + name + " " + promType + "\n")
+}
+
+type promCounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     *sync.Mutex
+	values map[string]float64
+}
+
+func newPromCounterVec(name string, help string, labels ...string) *promCounterVec {
+	counter := &promCounterVec{name: name, help: help, labels: labels, mu: &sync.Mutex{}, values: map[string]float64{}}
+	promRegistry = append(promRegistry, counter)
+	return counter
+}
+
+func (counter *promCounterVec) Add(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, promLabelSeparator)
+	counter.mu.Lock()
+	counter.values[key] += value
+	counter.mu.Unlock()
+}
+
+func (counter *promCounterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *promCounterVec) writeTo(sb *strings.Builder) {
+	promHeader(sb, counter.name, counter.help, "counter")
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+
+	if len(counter.labels) == 0 && len(counter.values) == 0 {
+		sb.WriteString(counter.name + " 0\n")
+		return
+	}
+
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sb.WriteString(counter.name + promLabels(counter.labels, key) + " " + promFloat(counter.values[key]) + "\n")
+	}
+}
+
+type promGauge struct {
+	name  string
+	help  string
+	value *atomic.Int64
+	fn    func() float64 // if set, the value is computed on every scrape
+}
+
+func newPromGauge(name string, help string) *promGauge {
+	gauge := &promGauge{name: name, help: help, value: &atomic.Int64{}}
+	promRegistry = append(promRegistry, gauge)
+	return gauge
+}
+
+func newPromGaugeFunc(name string, help string, fn func() float64) *promGauge {
+	gauge := newPromGauge(name, help)
+	gauge.fn = fn
+	return gauge
+}
+
+func (gauge *promGauge) Inc() { gauge.value.Add(1) }
+func (gauge *promGauge) Dec() { gauge.value.Add(-1) }
+
+func (gauge *promGauge) writeTo(sb *strings.Builder) {
+	promHeader(sb, gauge.name, gauge.help, "gauge")
+	value := float64(gauge.value.Load())
+	if gauge.fn != nil {
+		value = gauge.fn()
+	}
+	sb.WriteString(gauge.name + " " + promFloat(value) + "\n")
+}
+
+type promHistogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type promHistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      *sync.Mutex
+	values  map[string]*promHistogram
+}
+
+func newPromHistogramVec(name string, help string, buckets []float64, labels ...string) *promHistogramVec {
+	histogram := &promHistogramVec{name: name, help: help, labels: labels, buckets: buckets,
+		mu: &sync.Mutex{}, values: map[string]*promHistogram{}}
+	promRegistry = append(promRegistry, histogram)
+	return histogram
+}
+
+func (histogram *promHistogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, promLabelSeparator)
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	h, ok := histogram.values[key]
+	if !ok {
+		h = &promHistogram{counts: make([]uint64, len(histogram.buckets))}
+		histogram.values[key] = h
+	}
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (histogram *promHistogramVec) writeTo(sb *strings.Builder) {
+	promHeader(sb, histogram.name, histogram.help, "histogram")
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	keys := make([]string, 0, len(histogram.values))
+	for key := range histogram.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := histogram.values[key]
+		cumulative := uint64(0)
+		for i, bound := range histogram.buckets {
+			cumulative += h.counts[i]
+			sb.WriteString(histogram.name + "_bucket" + promLabels(histogram.labels, key, "le", promFloat(bound)) +
+				" " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		sb.WriteString(histogram.name + "_bucket" + promLabels(histogram.labels, key, "le", "+Inf") +
+			" " + strconv.FormatUint(h.count, 10) + "\n")
+		sb.WriteString(histogram.name + "_sum" + promLabels(histogram.labels, key) + " " + promFloat(h.sum) + "\n")
+		sb.WriteString(histogram.name + "_count" + promLabels(histogram.labels, key) + " " + strconv.FormatUint(h.count, 10) + "\n")
+	}
+}
+
+// Counts bytes passing through a reader
+type promCountingReader struct {
+	io.Reader
+	channel   string
+	direction string
+}
+
+func (reader *promCountingReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	if n > 0 {
+		promBytes.Add(float64(n), reader.channel, reader.direction)
+	}
+	return n, err
+}
+
+// Counts bytes written to a response, flushes and hijacks are passed on for
+// streaming and upgraded responses
+type promCountingResponseWriter struct {
+	http.ResponseWriter
+	channel string
+	status  int
+}
+
+func (writer *promCountingResponseWriter) WriteHeader(status int) {
+	writer.status = status
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+// Status code sent to the client, 200 if none was set explicitly
+func (writer *promCountingResponseWriter) Status() int {
+	if writer.status == 0 {
+		return http.StatusOK
+	}
+	return writer.status
+}
+
+func (writer *promCountingResponseWriter) Write(p []byte) (int, error) {
+	n, err := writer.ResponseWriter.Write(p)
+	if n > 0 {
+		promBytes.Add(float64(n), writer.channel, PROM_DIRECTION_OUT)
+	}
+	return n, err
+}
+
+func (writer *promCountingResponseWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// The proxied filebrowser may upgrade a request to a websocket, bytes on
+// the hijacked connection are not counted
+func (writer *promCountingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := writer.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (writer *promCountingResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+func (sfui *SfUI) handlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	_, isAdmin := sfui.authenticateAdmin(r)
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	isScraper := sfui.MetricsScrapeToken != "" &&
+		subtle.ConstantTimeCompare([]byte(bearer), []byte(sfui.MetricsScrapeToken)) == 1
+
+	if !isAdmin && !isScraper {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"status":"denied"}`))
+		return
+	}
+
+	sb := strings.Builder{}
+	for _, collector := range promRegistry {
+		collector.writeTo(&sb)
+	}
+
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(sb.String()))
+}
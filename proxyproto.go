@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol (v1 and v2) support for the listener, lets a L4 load balancer
+// (ex: HAProxy in TCP mode) pass on the original client address.
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+//
+// The header is only parsed on connections from TrustedSources, the recovered
+// source address is returned by RemoteAddr() and so ends up in getClientAddr().
+const (
+	PROXY_V1_MAX_LENGTH = 107
+	PROXY_V2_HDR_LENGTH = 16
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type ProxyProtocolListener struct {
+	net.Listener
+	TrustedSources []netip.Prefix
+	HeaderTimeout  time.Duration
+}
+
+func NewProxyProtocolListener(listener net.Listener, trustedSources []string, headerTimeout time.Duration) (*ProxyProtocolListener, error) {
+	proxyListener := ProxyProtocolListener{
+		Listener:      listener,
+		HeaderTimeout: headerTimeout,
+	}
+
+	for _, source := range trustedSources {
+		prefix, err := ParseAddrOrPrefix(source)
+		if err != nil {
+			return nil, err
+		}
+		proxyListener.TrustedSources = append(proxyListener.TrustedSources, prefix)
+	}
+
+	return &proxyListener, nil
+}
+
+func (listener *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+
+	peerAddr, perr := ParseAddr(conn.RemoteAddr().String())
+	if perr != nil || !listener.isTrusted(peerAddr) {
+		return conn, nil // not from a load balancer, passthrough
+	}
+
+	// The header is read lazily (on the connections own goroutine), so that
+	// a slow peer cannot stall Accept()
+	return &proxyProtocolConn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: listener.HeaderTimeout,
+	}, nil
+}
+
+func (listener *ProxyProtocolListener) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range listener.TrustedSources {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+	once          sync.Once
+	headerErr     error
+	sourceAddr    net.Addr // nil if the header did not carry a address (LOCAL/UNKNOWN)
+}
+
+func (conn *proxyProtocolConn) readHeader() {
+	conn.once.Do(func() {
+		if conn.headerTimeout > 0 {
+			conn.Conn.SetReadDeadline(time.Now().Add(conn.headerTimeout))
+			defer conn.Conn.SetReadDeadline(time.Time{})
+		}
+
+		conn.sourceAddr, conn.headerErr = readProxyHeader(conn.reader)
+		if conn.headerErr != nil {
+			remoteIp, _, _ := net.SplitHostPort(conn.Conn.RemoteAddr().String())
+			log.Println("proxy protocol:", conn.headerErr, "from", Privacy.LogIP(remoteIp))
+			conn.Conn.Close()
+		}
+	})
+}
+
+func (conn *proxyProtocolConn) Read(b []byte) (int, error) {
+	conn.readHeader()
+	if conn.headerErr != nil {
+		return 0, conn.headerErr
+	}
+	return conn.reader.Read(b)
+}
+
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	conn.readHeader()
+	if conn.sourceAddr != nil {
+		return conn.sourceAddr
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+// Read a v1 or v2 header, a connection without a header is passed on as is
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	prefix, err := reader.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case string(prefix) == "PROXY":
+		return readProxyHeaderV1(reader)
+	case bytes.Equal(prefix, proxyV2Signature[:5]):
+		return readProxyHeaderV2(reader)
+	}
+
+	return nil, nil
+}
+
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, PROXY_V1_MAX_LENGTH)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= PROXY_V1_MAX_LENGTH {
+			return nil, errors.New("v1 header too long")
+		}
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("malformed v1 header")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, errors.New("malformed v1 header")
+		}
+		addr, aerr := netip.ParseAddr(fields[2])
+		port, perr := strconv.ParseUint(fields[4], 10, 16)
+		if aerr != nil || perr != nil {
+			return nil, errors.New("malformed v1 address")
+		}
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr.Unmap(), uint16(port))), nil
+	}
+
+	return nil, errors.New("unsupported v1 protocol " + fields[1])
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, PROXY_V2_HDR_LENGTH)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errors.New("malformed v2 signature")
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, errors.New("unsupported v2 version")
+	}
+	command := header[12] & 0x0F
+	family := header[13] >> 4
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	if command == 0 { // LOCAL, health checks from the proxy itself
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, errors.New("unsupported v2 command")
+	}
+
+	switch family {
+	case 1: // AF_INET, src(4) dst(4) sport(2) dport(2)
+		if len(payload) < 12 {
+			return nil, errors.New("short v2 address")
+		}
+		var src [4]byte
+		copy(src[:], payload[0:4])
+		addr := netip.AddrFrom4(src)
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr,
+			binary.BigEndian.Uint16(payload[8:10]))), nil
+	case 2: // AF_INET6, src(16) dst(16) sport(2) dport(2)
+		if len(payload) < 36 {
+			return nil, errors.New("short v2 address")
+		}
+		var src [16]byte
+		copy(src[:], payload[0:16])
+		addr := netip.AddrFrom16(src).Unmap()
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr,
+			binary.BigEndian.Uint16(payload[32:34]))), nil
+	}
+
+	return nil, nil // AF_UNSPEC / AF_UNIX, keep the peer address
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Build a v2 header, the payload holds the addresses and ports
+func proxyV2Header(command byte, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4Payload := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0x01, 0xBB}
+	ipv6Src := netip.MustParseAddr("2001:db8::1").As16()
+	ipv6Dst := netip.MustParseAddr("2001:db8::2").As16()
+	ipv6Payload := append(append(ipv6Src[:], ipv6Dst[:]...), 0xDC, 0x04, 0x01, 0xBB)
+
+	tests := []struct {
+		name  string
+		input []byte
+		addr  string // empty when the peer address is kept
+		valid bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", true},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", true},
+		{"v1 tcp6 mapped ipv4", []byte("PROXY TCP6 ::ffff:192.0.2.1 ::ffff:198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", true},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", true},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1\r\n"), "", false},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n"), "", false},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n"), "", false},
+		{"v1 unsupported protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "", false},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", PROXY_V1_MAX_LENGTH) + "\r\n"), "", false},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1"), "", false},
+		{"v2 ipv4", proxyV2Header(1, 1, ipv4Payload), "192.0.2.1:56324", true},
+		{"v2 ipv6", proxyV2Header(1, 2, ipv6Payload), "[2001:db8::1]:56324", true},
+		{"v2 local", proxyV2Header(0, 0, nil), "", true},
+		{"v2 unspec family", proxyV2Header(1, 0, nil), "", true},
+		{"v2 short ipv4 address", proxyV2Header(1, 1, ipv4Payload[:8]), "", false},
+		{"v2 short ipv6 address", proxyV2Header(1, 2, ipv6Payload[:32]), "", false},
+		{"v2 unsupported command", proxyV2Header(2, 1, ipv4Payload), "", false},
+		{"v2 truncated payload", proxyV2Header(1, 1, ipv4Payload)[:20], "", false},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00XXXXXXX"), 0x21, 0x11, 0, 0), "", false},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(test.input)))
+			if (err == nil) != test.valid {
+				t.Fatalf("readProxyHeader() error = %v, want valid %v", err, test.valid)
+			}
+			if !test.valid {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != test.addr {
+				t.Errorf("readProxyHeader() = %q, want %q", got, test.addr)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderKeepsPayload(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n"))
+	if _, err := readProxyHeader(reader); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(reader)
+	if string(rest) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("data after the header = %q", rest)
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		addr    string // expected RemoteAddr ip, the loopback peer if untrusted
+	}{
+		{"trusted source", []string{"127.0.0.0/8"}, "192.0.2.1"},
+		{"untrusted source", []string{"10.0.0.1"}, "127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer inner.Close()
+			listener, err := NewProxyProtocolListener(inner, test.trusted, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nping"))
+
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			remoteIp, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if remoteIp != test.addr {
+				t.Errorf("RemoteAddr() = %s, want %s", remoteIp, test.addr)
+			}
+		})
+	}
+
+	if _, err := NewProxyProtocolListener(nil, []string{"not an address"}, 0); err == nil {
+		t.Error("NewProxyProtocolListener() accepted an invalid trusted source")
+	}
+}
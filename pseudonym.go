@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pseudonyms (UserUid in metrics, ip_id in /client/stats) are a HMAC of the
+// client ip, keyed with a secret that is persisted so that they stay the same
+// across restarts. Keys can be rotated, the previous keys are kept so that an
+// admin can still map a address to the pseudonyms it had before a rotation.
+//
+// Addresses can also be anonymized (truncated to a prefix, ex: /24 and /48)
+// wherever they end up in logs, metric events or admin output.
+const PSEUDONYM_KEY_CHECK_INTERVAL = time.Hour
+
+type PseudonymKey struct {
+	Id        string    `json:"id"`
+	Key       string    `json:"key"` // hex
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type pseudonymKeyFile struct {
+	Keys []PseudonymKey `json:"keys"` // newest first, Keys[0] is in use
+}
+
+type PrivacyGuard struct {
+	path         string
+	rotation     time.Duration // 0 to never rotate automatically
+	history      int           // previous keys kept
+	anonymize    bool
+	ipv4Bits     int
+	ipv6Bits     int
+	adminRawIps  bool
+	mu           *sync.Mutex
+	keys         []PseudonymKey
+	currentKey   []byte
+	currentKeyId string
+}
+
+var Privacy = PrivacyGuard{adminRawIps: true}
+
+func (guard *PrivacyGuard) Init(sfui *SfUI) {
+	guard.path = sfui.PseudonymKeyPath
+	guard.rotation = time.Hour * 24 * time.Duration(sfui.PseudonymKeyRotation)
+	guard.history = sfui.PseudonymKeyHistory
+	guard.anonymize = sfui.AnonymizeIPs
+	guard.ipv4Bits = sfui.AnonymizeIPv4Prefix
+	guard.ipv6Bits = sfui.AnonymizeIPv6Prefix
+	guard.adminRawIps = sfui.AdminRawIPs
+	guard.mu = &sync.Mutex{}
+
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	// rotate() below would overwrite a file that could not be loaded
+	if data, err := os.ReadFile(guard.path); err == nil {
+		keyFile := pseudonymKeyFile{}
+		if jerr := json.Unmarshal(data, &keyFile); jerr != nil {
+			if aside, merr := moveAside(guard.path); merr != nil {
+				log.Fatalln("Failed to parse pseudonym keys,", jerr, ", and to move them aside,", merr)
+			} else {
+				log.Println("Failed to parse pseudonym keys, pseudonyms will change, the file was moved to", aside, jerr)
+			}
+		}
+		guard.keys = keyFile.Keys
+	} else if !os.IsNotExist(err) {
+		log.Fatalln("Failed to read pseudonym keys,", err)
+	}
+
+	if len(guard.keys) == 0 || guard.rotationDue() {
+		if err := guard.rotate(); err != nil {
+			log.Println("Failed to save pseudonym keys, pseudonyms will change on restart", err)
+		}
+	} else {
+		guard.useKey(guard.keys[0])
+	}
+
+	if guard.rotation > 0 {
+		go guard.periodicRotation()
+	}
+}
+
+// caller must hold the lock
+func (guard *PrivacyGuard) rotationDue() bool {
+	return guard.rotation > 0 && len(guard.keys) > 0 && time.Since(guard.keys[0].CreatedAt) >= guard.rotation
+}
+
+func (guard *PrivacyGuard) periodicRotation() {
+	for {
+		time.Sleep(PSEUDONYM_KEY_CHECK_INTERVAL)
+		guard.mu.Lock()
+		if guard.rotationDue() {
+			if err := guard.rotate(); err != nil {
+				log.Println("Failed to save pseudonym keys", err)
+			}
+		}
+		guard.mu.Unlock()
+	}
+}
+
+func (guard *PrivacyGuard) Rotate() (keyId string, err error) {
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+	err = guard.rotate()
+	return guard.currentKeyId, err
+}
+
+// Generate a new key and drop the ones beyond the history, the new key is
+// used even if it could not be persisted. caller must hold the lock
+func (guard *PrivacyGuard) rotate() error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	id := make([]byte, 4)
+	rand.Read(id)
+
+	newKey := PseudonymKey{Id: hex.EncodeToString(id), Key: hex.EncodeToString(key), CreatedAt: time.Now().UTC()}
+	guard.keys = append([]PseudonymKey{newKey}, guard.keys...)
+	if len(guard.keys) > guard.history+1 {
+		guard.keys = guard.keys[:guard.history+1]
+	}
+	guard.useKey(newKey)
+	log.Printf("Using pseudonym key %s\n", newKey.Id)
+
+	data, err := json.MarshalIndent(pseudonymKeyFile{Keys: guard.keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(guard.path, data, 0600)
+}
+
+// caller must hold the lock
+func (guard *PrivacyGuard) useKey(key PseudonymKey) {
+	guard.currentKey = key.bytes()
+	guard.currentKeyId = key.Id
+}
+
+// Keys edited by hand that are not hex are used as is
+func (key PseudonymKey) bytes() []byte {
+	decoded, err := hex.DecodeString(key.Key)
+	if err != nil || len(decoded) == 0 {
+		return []byte(key.Key)
+	}
+	return decoded
+}
+
+func pseudonymOf(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Pseudonym of a value (ex: a client ip) under the current key, falls back to
+// getClientId, which changes on every restart, if Init was not called
+func (guard *PrivacyGuard) Pseudonym(value string) (pseudonym string, keyId string) {
+	if guard.mu == nil {
+		return getClientId(value), ""
+	}
+	guard.mu.Lock()
+	key, keyId := guard.currentKey, guard.currentKeyId
+	guard.mu.Unlock()
+	return pseudonymOf(key, value), keyId
+}
+
+// Address to write to logs and metric events, truncated to the configured
+// prefix if anonymization is enabled. Prefixes are truncated too, values that
+// are not a address or prefix are returned as is.
+func (guard *PrivacyGuard) LogIP(ip string) string {
+	if !guard.anonymize {
+		return ip
+	}
+	return guard.truncate(ip)
+}
+
+// Address to show in admin output, anonymized unless admin_raw_ips is set
+func (guard *PrivacyGuard) AdminIP(ip string) string {
+	if guard.adminRawIps {
+		return ip
+	}
+	return guard.truncate(ip)
+}
+
+func (guard *PrivacyGuard) truncate(ip string) string {
+	prefix, err := ParseAddrOrPrefix(ip)
+	if err != nil {
+		return ip
+	}
+	bits := guard.ipv6Bits
+	if prefix.Addr().Is4() {
+		bits = guard.ipv4Bits
+	}
+	if prefix.Bits() <= bits {
+		return prefix.String()
+	}
+	return addrPrefix(prefix.Addr(), guard.ipv4Bits, guard.ipv6Bits).String()
+}
+
+type PseudonymLookup struct {
+	KeyId     string    `json:"key_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Pseudonym string    `json:"pseudonym"`
+}
+
+// GET : pseudonyms of ?ip= under the current and the previous keys
+// POST : rotate the key
+func (sfui *SfUI) handlePseudonyms(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	adminName, ok := sfui.authenticateAdmin(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"status":"denied"}`))
+		return
+	}
+	if Privacy.mu == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"pseudonyms not initialized"}`))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		addr, err := ParseAddr(r.URL.Query().Get("ip"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"invalid ip"}`))
+			return
+		}
+
+		lookups := []PseudonymLookup{}
+		Privacy.mu.Lock()
+		for _, key := range Privacy.keys {
+			lookups = append(lookups, PseudonymLookup{KeyId: key.Id, CreatedAt: key.CreatedAt, Pseudonym: pseudonymOf(key.bytes(), addr.String())})
+		}
+		Privacy.mu.Unlock()
+
+		data, _ := json.Marshal(lookups)
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+	case http.MethodPost:
+		keyId, err := Privacy.Rotate()
+		logAdminAction(adminName, "rotate_pseudonym_key", keyId)
+		if err != nil {
+			log.Println("Failed to save pseudonym keys", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf(`{"status":"rotated, but not saved","key_id":"%s"}`, keyId)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf(`{"status":"ok","key_id":"%s"}`, keyId)))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"status":"method not allowed"}`))
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Per action rate limiting, every action is limited per ip and per network
+// prefix (/24 for IPv4, /64 for IPv6 by default) using a sliding window counter.
+// Clients that keep running into a limit are temporarily banned, the ban
+// duration doubles on every repeated auto-ban up to AutoBanMaxDuration.
+const (
+	RATE_LIMIT_NEW_ACCOUNT   = "new_account"
+	RATE_LIMIT_LOGIN         = "login"
+	RATE_LIMIT_WS_CONNECT    = "ws_connect"
+	RATE_LIMIT_SHARE_JOIN    = "share_join"
+	RATE_LIMIT_LINK_DOWNLOAD = "link_download"
+
+	AUTO_BAN_CREATOR = "auto-ban"
+)
+
+type RateLimit struct {
+	Limit       int `yaml:"limit"`        // Max events per window from a single ip, 0 for no limit
+	PrefixLimit int `yaml:"prefix_limit"` // Max events per window from a single prefix, 0 for no limit
+	Window      int `yaml:"window"`       // Seconds
+}
+
+// Approximates a sliding window using the counts of the current and the
+// previous fixed window, the previous count is weighted by its overlap.
+type slidingWindow struct {
+	start    time.Time
+	previous int
+	current  int
+	lastSeen time.Time
+}
+
+// Estimated no of events within the last window
+func (sw *slidingWindow) estimate(now time.Time, window time.Duration) float64 {
+	elapsed := now.Sub(sw.start)
+	if elapsed >= 2*window {
+		sw.start = now.Truncate(window)
+		sw.previous = 0
+		sw.current = 0
+	} else if elapsed >= window {
+		sw.start = sw.start.Add(window)
+		sw.previous = sw.current
+		sw.current = 0
+	}
+	sw.lastSeen = now
+
+	overlap := 1 - float64(now.Sub(sw.start))/float64(window)
+	return float64(sw.previous)*overlap + float64(sw.current)
+}
+
+// Count a event if it does not exceed the limit, returns whether it was counted
+func (sw *slidingWindow) hit(now time.Time, window time.Duration, limit int) bool {
+	if sw.estimate(now, window)+1 > float64(limit) {
+		return false
+	}
+	sw.current++
+	return true
+}
+
+// Count a event unconditionally
+func (sw *slidingWindow) add(now time.Time, window time.Duration) {
+	sw.estimate(now, window)
+	sw.current++
+}
+
+type AbuseThrottle struct {
+	mu                 *sync.Mutex
+	limits             map[string]RateLimit
+	windows            map[string]*slidingWindow // action|key -> window, key is a ip or prefix
+	violations         map[string]*slidingWindow // key -> window of limit violations
+	autoBans           map[string]int            // key -> no of auto-bans so far
+	ipv4PrefixBits     int
+	ipv6PrefixBits     int
+	autoBanViolations  int
+	autoBanWindow      time.Duration
+	autoBanDuration    time.Duration
+	autoBanMaxDuration time.Duration
+	onAutoBan          func(key string, reason string, duration time.Duration)
+	neverBan           []netip.Prefix // trusted proxies and loopback
+}
+
+var Throttle = AbuseThrottle{}
+
+func (throttle *AbuseThrottle) Init(sfui *SfUI) {
+	throttle.mu = &sync.Mutex{}
+	throttle.windows = make(map[string]*slidingWindow)
+	throttle.violations = make(map[string]*slidingWindow)
+	throttle.autoBans = make(map[string]int)
+	throttle.Configure(sfui)
+	go throttle.periodicCleanup()
+}
+
+// Apply limits from config, existing counters are kept
+func (throttle *AbuseThrottle) Configure(sfui *SfUI) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+
+	throttle.limits = map[string]RateLimit{}
+	if sfui.EnableRateLimits {
+		for action, limit := range sfui.RateLimits {
+			if limit.Window > 0 {
+				throttle.limits[action] = limit
+			}
+		}
+	}
+	throttle.ipv4PrefixBits = sfui.RateLimitIPv4Prefix
+	throttle.ipv6PrefixBits = sfui.RateLimitIPv6Prefix
+	throttle.autoBanViolations = sfui.AutoBanViolations
+	throttle.autoBanWindow = time.Minute * time.Duration(sfui.AutoBanWindow)
+	throttle.autoBanDuration = time.Minute * time.Duration(sfui.AutoBanDuration)
+	throttle.autoBanMaxDuration = time.Minute * time.Duration(sfui.AutoBanMaxDuration)
+	throttle.onAutoBan = sfui.autoBan
+
+	// Behind a proxy that is not configured as trusted, or whose headers are
+	// ignored, every client shares the proxies address. Banning it would lock
+	// out everyone.
+	throttle.neverBan = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	for _, proxy := range sfui.TrustedProxies {
+		if prefix, err := ParseAddrOrPrefix(proxy); err == nil {
+			throttle.neverBan = append(throttle.neverBan, prefix)
+		}
+	}
+}
+
+// Forget counters that have been idle for a while
+func (throttle *AbuseThrottle) periodicCleanup() {
+	for {
+		time.Sleep(time.Minute)
+		throttle.mu.Lock()
+		for key, window := range throttle.windows {
+			if time.Since(window.lastSeen) > time.Hour*24 {
+				delete(throttle.windows, key)
+			}
+		}
+		for key, window := range throttle.violations {
+			if time.Since(window.lastSeen) > time.Hour*24 {
+				delete(throttle.violations, key)
+				delete(throttle.autoBans, key)
+			}
+		}
+		throttle.mu.Unlock()
+	}
+}
+
+// Check and count a action from a ip, returns false if the action must be refused
+func (throttle *AbuseThrottle) Allow(action string, ip string) bool {
+	if throttle.mu == nil {
+		return true
+	}
+
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return true
+	}
+
+	throttle.mu.Lock()
+
+	limit, ok := throttle.limits[action]
+	if !ok {
+		throttle.mu.Unlock()
+		return true
+	}
+
+	now := time.Now()
+	window := time.Second * time.Duration(limit.Window)
+	violator := ""
+
+	if limit.Limit > 0 {
+		ipKey := addr.String()
+		if !throttle.window(action, ipKey).hit(now, window, limit.Limit) {
+			violator = ipKey
+		}
+	}
+
+	if violator == "" && limit.PrefixLimit > 0 {
+		prefixKey := throttle.prefixOf(addr).String()
+		if !throttle.window(action, prefixKey).hit(now, window, limit.PrefixLimit) {
+			violator = prefixKey
+		}
+	}
+
+	if violator == "" {
+		throttle.mu.Unlock()
+		return true
+	}
+
+	banDuration, shouldBan := throttle.recordViolation(violator, now)
+	onAutoBan := throttle.onAutoBan
+	throttle.mu.Unlock()
+
+	MLogger.LogSampledEvent(Metric{Type: METRIC_RATE_LIMITED, Action: action}, ip, METRIC_RATE_LIMITED+"|"+action+"|"+ip)
+
+	if shouldBan && onAutoBan != nil {
+		onAutoBan(violator, fmt.Sprintf("rate limit exceeded repeatedly (%s)", action), banDuration)
+	}
+
+	return false
+}
+
+// caller must hold the lock
+func (throttle *AbuseThrottle) window(action string, key string) *slidingWindow {
+	window, ok := throttle.windows[action+"|"+key]
+	if !ok {
+		window = &slidingWindow{}
+		throttle.windows[action+"|"+key] = window
+	}
+	return window
+}
+
+func (throttle *AbuseThrottle) prefixOf(addr netip.Addr) netip.Prefix {
+	return addrPrefix(addr, throttle.ipv4PrefixBits, throttle.ipv6PrefixBits)
+}
+
+// The network of a address, ex: 1.2.3.0/24 for 1.2.3.4
+func addrPrefix(addr netip.Addr, ipv4Bits int, ipv6Bits int) netip.Prefix {
+	bits := ipv6Bits
+	if addr.Is4() {
+		bits = ipv4Bits
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return prefix
+}
+
+// Count a violation, returns the ban duration if the violations warrant a ban,
+// caller must hold the lock
+func (throttle *AbuseThrottle) recordViolation(key string, now time.Time) (time.Duration, bool) {
+	if throttle.autoBanViolations <= 0 || throttle.autoBanWindow <= 0 || throttle.autoBanDuration <= 0 {
+		return 0, false
+	}
+	if prefix, err := ParseAddrOrPrefix(key); err == nil {
+		for _, exempt := range throttle.neverBan {
+			if exempt.Overlaps(prefix) {
+				return 0, false
+			}
+		}
+	}
+
+	violations, ok := throttle.violations[key]
+	if !ok {
+		violations = &slidingWindow{}
+		throttle.violations[key] = violations
+	}
+
+	if violations.hit(now, throttle.autoBanWindow, throttle.autoBanViolations) {
+		return 0, false
+	}
+
+	// Sustained violations, start over and escalate the ban duration
+	violations.previous = 0
+	violations.current = 0
+
+	duration := throttle.autoBanDuration << throttle.autoBans[key]
+	if duration > throttle.autoBanMaxDuration || duration <= 0 {
+		duration = throttle.autoBanMaxDuration
+	}
+	throttle.autoBans[key]++
+
+	return duration, true
+}
+
+func (sfui *SfUI) autoBan(key string, reason string, duration time.Duration) {
+	sfui.Ban(key, reason, duration, AUTO_BAN_CREATOR)
+
+	MLogger.LogEvent(Metric{
+		Type:     METRIC_AUTO_BAN,
+		Reason:   reason,
+		Duration: duration.Seconds(),
+	}, key)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	window := time.Minute
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		hits   []time.Duration // offsets from start of the counted events
+		at     time.Duration
+		allows bool // whether a hit at "at" is allowed with a limit of 3
+	}{
+		{"below the limit", []time.Duration{0, time.Second}, 2 * time.Second, true},
+		{"at the limit", []time.Duration{0, time.Second, 2 * time.Second}, 3 * time.Second, false},
+		{"previous window weighs in", []time.Duration{50 * time.Second, 51 * time.Second, 52 * time.Second}, 61 * time.Second, false},
+		{"previous window fades out", []time.Duration{0, time.Second, 2 * time.Second}, 100 * time.Second, true},
+		{"expired after two windows", []time.Duration{50 * time.Second, 51 * time.Second, 52 * time.Second}, 121 * time.Second, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sw := &slidingWindow{}
+			for _, hit := range test.hits {
+				sw.add(start.Add(hit), window)
+			}
+			if got := sw.hit(start.Add(test.at), window, 3); got != test.allows {
+				t.Errorf("hit() = %v, want %v (estimate %.2f)", got, test.allows, sw.estimate(start.Add(test.at), window))
+			}
+		})
+	}
+}
+
+type autoBanRecorder struct {
+	mu   sync.Mutex
+	bans map[string]time.Duration
+}
+
+func (recorder *autoBanRecorder) ban(key string, reason string, duration time.Duration) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.bans[key] = duration
+}
+
+func newTestThrottle(limit RateLimit, autoBanViolations int, trustedProxies []string) (*AbuseThrottle, *autoBanRecorder) {
+	throttle := &AbuseThrottle{
+		mu:         &sync.Mutex{},
+		windows:    make(map[string]*slidingWindow),
+		violations: make(map[string]*slidingWindow),
+		autoBans:   make(map[string]int),
+	}
+	sfui := getDefaultConfig()
+	sfui.EnableRateLimits = true
+	sfui.RateLimits = map[string]RateLimit{RATE_LIMIT_LOGIN: limit}
+	sfui.TrustedProxies = trustedProxies
+	sfui.AutoBanViolations = autoBanViolations
+	sfui.AutoBanWindow = 10
+	sfui.AutoBanDuration = 30
+	sfui.AutoBanMaxDuration = 60
+	throttle.Configure(&sfui)
+
+	recorder := &autoBanRecorder{bans: map[string]time.Duration{}}
+	throttle.onAutoBan = recorder.ban
+	return throttle, recorder
+}
+
+func TestThrottleAllow(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    RateLimit
+		requests []string // client ips, in order
+		allowed  int      // no of requests allowed
+	}{
+		{"per ip limit", RateLimit{Limit: 2, Window: 60}, []string{"192.0.2.1", "192.0.2.1", "192.0.2.1"}, 2},
+		{"ips are counted apart", RateLimit{Limit: 2, Window: 60}, []string{"192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.2"}, 4},
+		{"ipv4 prefix", RateLimit{PrefixLimit: 2, Window: 60}, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, 2},
+		{"other ipv4 prefix", RateLimit{PrefixLimit: 2, Window: 60}, []string{"192.0.2.1", "192.0.2.2", "192.0.3.1"}, 3},
+		{"ipv6 prefix", RateLimit{PrefixLimit: 2, Window: 60}, []string{"2001:db8::1", "2001:db8::ffff:1", "2001:db8:0:0:1::1"}, 2},
+		{"other ipv6 prefix", RateLimit{PrefixLimit: 2, Window: 60}, []string{"2001:db8::1", "2001:db8::2", "2001:db8:0:1::1"}, 3},
+		{"mapped ipv4 shares the ipv4 counter", RateLimit{Limit: 1, Window: 60}, []string{"192.0.2.1", "::ffff:192.0.2.1"}, 1},
+		{"unparsable address is let through", RateLimit{Limit: 1, Window: 60}, []string{"unknown", "unknown"}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			throttle, _ := newTestThrottle(test.limit, 0, nil)
+			allowed := 0
+			for _, ip := range test.requests {
+				if throttle.Allow(RATE_LIMIT_LOGIN, ip) {
+					allowed++
+				}
+			}
+			if allowed != test.allowed {
+				t.Errorf("allowed %d requests, want %d", allowed, test.allowed)
+			}
+			if !throttle.Allow(RATE_LIMIT_NEW_ACCOUNT, test.requests[0]) {
+				t.Error("a action without a limit was throttled")
+			}
+		})
+	}
+}
+
+func TestThrottleDisabled(t *testing.T) {
+	throttle, _ := newTestThrottle(RateLimit{Limit: 1, Window: 60}, 0, nil)
+	sfui := getDefaultConfig()
+	sfui.EnableRateLimits = false
+	throttle.Configure(&sfui)
+
+	for i := 0; i < 3; i++ {
+		if !throttle.Allow(RATE_LIMIT_LOGIN, "192.0.2.1") {
+			t.Fatal("throttled with enable_rate_limits off")
+		}
+	}
+}
+
+func TestThrottleAutoBan(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		trusted  []string
+		requests int
+		banned   string // key that was banned, empty for none
+	}{
+		{"below the violations", "192.0.2.1", nil, 1 + 3, ""},
+		{"banned after the violations", "192.0.2.1", nil, 1 + 4, "192.0.2.1"},
+		{"loopback is never banned", "127.0.0.1", nil, 1 + 10, ""},
+		{"ipv6 loopback is never banned", "::1", nil, 1 + 10, ""},
+		{"trusted proxy is never banned", "10.1.2.3", []string{"10.0.0.0/8"}, 1 + 10, ""},
+		{"address next to a trusted proxy", "10.1.2.3", []string{"10.0.0.1"}, 1 + 4, "10.1.2.3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			throttle, recorder := newTestThrottle(RateLimit{Limit: 1, Window: 60}, 3, test.trusted)
+			for i := 0; i < test.requests; i++ {
+				throttle.Allow(RATE_LIMIT_LOGIN, test.ip)
+			}
+
+			if test.banned == "" && len(recorder.bans) != 0 {
+				t.Errorf("banned %v, want no ban", recorder.bans)
+			}
+			if test.banned != "" {
+				if duration, ok := recorder.bans[test.banned]; !ok || duration != 30*time.Minute {
+					t.Errorf("bans = %v, want %s for 30m", recorder.bans, test.banned)
+				}
+			}
+		})
+	}
+}
+
+func TestThrottleAutoBanEscalates(t *testing.T) {
+	throttle, _ := newTestThrottle(RateLimit{Limit: 1, Window: 60}, 1, nil)
+	now := time.Now()
+
+	want := []time.Duration{0, 30 * time.Minute, 0, time.Hour, 0, time.Hour} // capped at auto_ban_max_duration
+	for i, expected := range want {
+		throttle.mu.Lock()
+		duration, banned := throttle.recordViolation("192.0.2.0/24", now)
+		throttle.mu.Unlock()
+		if banned != (expected > 0) || duration != expected {
+			t.Errorf("violation %d: ban %v for %s, want %s", i+1, banned, duration, expected)
+		}
+	}
+}
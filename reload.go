@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The config can be reloaded (SIGHUP or POST /admin/reload) without a
+// restart. Options that are read on every request are applied to a copy of
+// the running config, which then replaces it. Stores that copied options on
+// start (rate limits, metric sinks, tokens, pow) are reconfigured. Requests
+// and sessions that started earlier keep the config they started with, so
+// existing sessions are left untouched. Changes to the other options are only
+// reported, they take effect on the next restart.
+var RunningConfig atomic.Pointer[SfUI]
+
+var reloadMu = &sync.Mutex{}
+
+// yaml keys of the options that can be changed at runtime
+var reloadableOptions = map[string]bool{
+	"max_ws_terminals":             true,
+	"max_shared_desktop_conn":      true,
+	"ws_ping_interval":             true,
+	"ws_timeout":                   true,
+	"debug":                        true,
+	"start_xpra_command":           true,
+	"start_vnc_command":            true,
+	"start_filebrowser_command":    true,
+	"sf_endpoints":                 true,
+	"sf_ui_origin":                 true,
+	"use_x_forwarded_for_header":   true,
+	"trusted_proxies":              true,
+	"disable_origin_check":         true,
+	"disable_desktop":              true,
+	"client_inactivity_timeout":    true,
+	"maintenance_secret":           true,
+	"maintenance_secret_file":      true,
+	"admin_tokens":                 true,
+	"metrics_scrape_token":         true,
+	"metric_max_retries":           true,
+	"metric_flush_interval":        true,
+	"metric_batch_size":            true,
+	"metric_retry_backoff":         true,
+	"pow_enabled":                  true,
+	"pow_difficulty":               true,
+	"pow_max_difficulty":           true,
+	"pow_challenge_ttl":            true,
+	"pow_scale_window":             true,
+	"pow_scale_steps":              true,
+	"allow_secret_auth":            true,
+	"tus_max_upload_size":          true,
+	"tus_client_quota":             true,
+	"download_link_max_expiry":     true,
+	"download_link_max_per_client": true,
+	"enable_rate_limits":           true,
+	"rate_limits":                  true,
+	"rate_limit_ipv4_prefix":       true,
+	"rate_limit_ipv6_prefix":       true,
+	"auto_ban_violations":          true,
+	"auto_ban_window":              true,
+	"auto_ban_duration":            true,
+	"auto_ban_max_duration":        true,
+}
+
+type ConfigReload struct {
+	Applied         []string `json:"applied"`          // Changed options now in effect
+	RestartRequired []string `json:"restart_required"` // Changed options that need a restart
+}
+
+// Re-read and validate the config, nothing is applied if it is invalid
+func ReloadConfig() (ConfigReload, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	current := RunningConfig.Load()
+	base := getDefaultConfig()
+	base.MaintenanceSecret = current.MaintenanceSecret // random unless configured
+	loaded, err := loadConfig(base)
+	if err != nil {
+		return ConfigReload{}, err
+	}
+	if verr := validateConfig(&loaded); verr != nil {
+		return ConfigReload{}, verr
+	}
+
+	next := *current
+	result := ConfigReload{Applied: []string{}, RestartRequired: []string{}}
+	currentValue := reflect.ValueOf(current).Elem()
+	loadedValue := reflect.ValueOf(&loaded).Elem()
+	nextValue := reflect.ValueOf(&next).Elem()
+	for i := 0; i < currentValue.NumField(); i++ {
+		option := configOption(currentValue.Type().Field(i))
+		if option == "" || reflect.DeepEqual(currentValue.Field(i).Interface(), loadedValue.Field(i).Interface()) {
+			continue
+		}
+		if reloadableOptions[option] {
+			nextValue.Field(i).Set(loadedValue.Field(i))
+			result.Applied = append(result.Applied, option)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, option)
+		}
+	}
+	if len(result.Applied) == 0 {
+		return result, nil
+	}
+
+	next.CompiledClientConfig = getcompiledClientConfig(next)
+	next.NoOfEndpoints = int32(len(next.SfEndpoints))
+	next.ClientIPResolver, _ = NewClientIPResolver(next.UseXForwardedForHeader, next.TrustedProxies) // validated
+	RunningConfig.Store(&next)
+
+	Throttle.Configure(&next)
+	MLogger.Configure(&next)
+	Tokens.Configure(&next)
+	PoW.Configure(&next)
+	return result, nil
+}
+
+// Reload and log the outcome, on SIGHUP
+func reloadConfigAndLog() {
+	result, err := ReloadConfig()
+	if err != nil {
+		log.Println("Config not reloaded, ", err)
+		return
+	}
+	log.Printf("Config reloaded, applied: %v, restart required: %v\n", result.Applied, result.RestartRequired)
+}
+
+// POST : reload the config, responds with the options that were applied and
+// the ones that need a restart
+func (sfui *SfUI) handleReload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	adminName, ok := sfui.authenticateAdmin(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"status":"denied"}`))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"status":"method not allowed"}`))
+		return
+	}
+
+	result, err := ReloadConfig()
+	if err != nil {
+		log.Println("Config not reloaded, ", err)
+		data, _ := json.Marshal(map[string]string{"status": "invalid config", "error": err.Error()})
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(data)
+		return
+	}
+	logAdminAction(adminName, "reload_config", strings.Join(result.Applied, ","))
+
+	data, _ := json.Marshal(struct {
+		Status string `json:"status"`
+		ConfigReload
+	}{"ok", result})
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -5,28 +5,63 @@ import (
 	"regexp"
 )
 
-var routes map[string]func(w http.ResponseWriter, r *http.Request)
+// Handlers take the config the request is served with, see RunningConfig
+var routes map[string]func(sfui *SfUI, w http.ResponseWriter, r *http.Request)
 var isFbPath = regexp.MustCompile(`(?m)^/filebrowser.*`).MatchString
 
-func (sfui *SfUI) InitRouter() {
-	routes = map[string]func(w http.ResponseWriter, r *http.Request){
-		"/secret":          sfui.handleLogin, // login
-		"/logout":          sfui.handleLogout,
-		"/config":          sfui.handleUIConfig,
-		"/ws":              sfui.handleTerminalWs,
-		"/desktopws":       sfui.handleDesktopWS,
-		"/sharedDesktopWs": sfui.handleSharedDesktopWS,
-		"/filebrowser":     sfui.handleSetupFileBrowser,
-		"/desktop/share":   sfui.handleSetupDesktopSharing,
+func InitRouter() {
+	routes = map[string]func(sfui *SfUI, w http.ResponseWriter, r *http.Request){
+		"/secret":          (*SfUI).handleLogin, // login
+		"/logout":          (*SfUI).handleLogout,
+		"/token/refresh":   (*SfUI).handleTokenRefresh,
+		"/config":          (*SfUI).handleUIConfig,
+		"/ws":              (*SfUI).handleTerminalWs,
+		"/desktopws":       (*SfUI).handleDesktopWS,
+		"/sharedDesktopWs": (*SfUI).handleSharedDesktopWS,
+		"/filebrowser":     (*SfUI).handleSetupFileBrowser,
+		"/desktop/share":   (*SfUI).handleSetupDesktopSharing,
 		//
 		// Administrative
 		//
-		"/ban/add":      sfui.AddBan,
-		"/ban/remove":   sfui.RemoveBan,
-		"/ban/list":     sfui.ListBans,
-		"/client/stats": sfui.handleClientStats,
-		"/client/kill":  sfui.handleKillClient,
+		"/ban/add":      (*SfUI).AddBan,
+		"/ban/remove":   (*SfUI).RemoveBan,
+		"/ban/list":     (*SfUI).ListBans,
+		"/ban/sources":  (*SfUI).ListBlocklists,
+		"/policy":       (*SfUI).handleAccessPolicy,
+		"/metrics":      (*SfUI).handlePrometheusMetrics,
+		"/client/stats": (*SfUI).handleClientStats,
+		"/client/kill":  (*SfUI).handleKillClient,
+		"/pseudonyms":   (*SfUI).handlePseudonyms,
+		"/links/list":   (*SfUI).handleListDownloadLinks,
+		"/links/revoke": (*SfUI).handleRevokeDownloadLink,
+
+		"/admin/analytics": (*SfUI).handleAnalytics, // ?from=&to=&granularity=hour|day&format=json|csv
+		"/admin/reload":    (*SfUI).handleReload,
+	}
+}
+
+// Route pattern of a path, recorded in traces instead of the path, which can
+// carry file names (ex: /filebrowser/api/resources/<path>)
+func requestRoute(path string) string {
+	if _, ok := routes[path]; ok {
+		return path
 	}
+	switch {
+	case isFbPath(path):
+		return "/filebrowser/*"
+	case isDownloadLinkPath(path):
+		return "/dl/*"
+	case isTusPath(path):
+		return "/files/tus/*"
+	case isFilesPath(path):
+		return "/files/*"
+	}
+	return "/*"
+}
+
+// Serve a request with the config that is running when it arrives
+func serveRequest(w http.ResponseWriter, r *http.Request) {
+	RunningConfig.Load().requestHandler(w, r)
 }
 
 func (sfui *SfUI) requestHandler(w http.ResponseWriter, r *http.Request) {
@@ -38,7 +73,7 @@ func (sfui *SfUI) requestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if handler, ok := routes[r.URL.Path]; ok {
-		handler(w, r)
+		handler(sfui, w, r)
 		return
 	}
 
@@ -48,5 +83,23 @@ func (sfui *SfUI) requestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// /dl/*, public download links
+	if isDownloadLinkPath(r.URL.Path) {
+		sfui.handlePublicDownload(w, r)
+		return
+	}
+
+	// /files/tus/*
+	if isTusPath(r.URL.Path) {
+		sfui.handleTusUpload(w, r)
+		return
+	}
+
+	// /files/*
+	if isFilesPath(r.URL.Path) {
+		sfui.handleFiles(w, r)
+		return
+	}
+
 	handleUIRequest(w, r)
 }
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Secret validation and generation can be delegated to a external service,
+// ex: the segfault core. SecretBackend.Type picks the backend:
+//
+//	local : every well formed secret is valid, secrets are random strings
+//	http  : POST {"secret","client_ip"} to ValidateUrl, expects {"valid":bool,"reason":"..."}
+//	        POST {"client_ip"} to GenerateUrl, expects {"secret":"..."}
+//	exec  : run ValidateCommand with SFUI_SECRET and SFUI_CLIENT_IP set, exit status 0 means
+//	        valid, otherwise the first line of output is the reason. GenerateCommand
+//	        (SFUI_CLIENT_IP set) prints the secret.
+//
+// Generated secrets are prefixed with the endpoint name by the caller.
+const (
+	SECRET_BACKEND_LOCAL = "local"
+	SECRET_BACKEND_HTTP  = "http"
+	SECRET_BACKEND_EXEC  = "exec"
+
+	SECRET_BACKEND_MAX_RESPONSE = 64 << 10
+)
+
+type SecretBackendConfig struct {
+	Type            string `yaml:"type"`             // local | http | exec
+	ValidateUrl     string `yaml:"validate_url"`     // http
+	GenerateUrl     string `yaml:"generate_url"`     // http, empty to generate locally
+	Token           string `yaml:"token"`            // http, sent as a bearer token
+	ValidateCommand string `yaml:"validate_command"` // exec, run with sh -c
+	GenerateCommand string `yaml:"generate_command"` // exec, empty to generate locally
+	Timeout         int    `yaml:"timeout"`          // Seconds
+	CacheTTL        int    `yaml:"cache_ttl"`        // Seconds for which validation results are cached, 0 to disable
+}
+
+type SecretValidation struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason"` // Shown to the user if the secret is not valid
+}
+
+type SecretValidator interface {
+	ValidateSecret(secret string, clientIp string) (SecretValidation, error)
+}
+
+type SecretGenerator interface {
+	GenerateSecret(clientIp string) (string, error)
+}
+
+func NewSecretBackend(config SecretBackendConfig) (SecretValidator, SecretGenerator, error) {
+	timeout := time.Second * time.Duration(config.Timeout)
+	var validator SecretValidator
+	var generator SecretGenerator = LocalSecretBackend{}
+
+	switch config.Type {
+	case SECRET_BACKEND_LOCAL, "":
+		return LocalSecretBackend{}, LocalSecretBackend{}, nil
+	case SECRET_BACKEND_HTTP:
+		if config.ValidateUrl == "" {
+			return nil, nil, errors.New("secret_backend.validate_url is required")
+		}
+		backend := &HTTPSecretBackend{
+			ValidateUrl: config.ValidateUrl,
+			GenerateUrl: config.GenerateUrl,
+			Token:       config.Token,
+			Client:      &http.Client{Timeout: timeout},
+		}
+		validator = backend
+		if config.GenerateUrl != "" {
+			generator = backend
+		}
+	case SECRET_BACKEND_EXEC:
+		if config.ValidateCommand == "" {
+			return nil, nil, errors.New("secret_backend.validate_command is required")
+		}
+		backend := &ExecSecretBackend{
+			ValidateCommand: config.ValidateCommand,
+			GenerateCommand: config.GenerateCommand,
+			Timeout:         timeout,
+		}
+		validator = backend
+		if config.GenerateCommand != "" {
+			generator = backend
+		}
+	default:
+		return nil, nil, errors.New("unknown secret_backend.type " + config.Type)
+	}
+
+	if config.CacheTTL > 0 {
+		validator = NewCachingSecretValidator(validator, time.Second*time.Duration(config.CacheTTL))
+	}
+	return validator, generator, nil
+}
+
+// Current behavior, no external checks
+type LocalSecretBackend struct{}
+
+func (LocalSecretBackend) ValidateSecret(secret string, clientIp string) (SecretValidation, error) {
+	return SecretValidation{Valid: true}, nil
+}
+
+func (LocalSecretBackend) GenerateSecret(clientIp string) (string, error) {
+	return RandomStr(25), nil
+}
+
+type HTTPSecretBackend struct {
+	ValidateUrl string
+	GenerateUrl string
+	Token       string
+	Client      *http.Client
+}
+
+func (backend *HTTPSecretBackend) post(url string, request interface{}, response interface{}) error {
+	body, _ := json.Marshal(request)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if backend.Token != "" {
+		req.Header.Add("Authorization", "Bearer "+backend.Token)
+	}
+
+	resp, err := backend.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, SECRET_BACKEND_MAX_RESPONSE))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.Unmarshal(data, response)
+}
+
+func (backend *HTTPSecretBackend) ValidateSecret(secret string, clientIp string) (SecretValidation, error) {
+	validation := SecretValidation{}
+	err := backend.post(backend.ValidateUrl, map[string]string{
+		"secret":    secret,
+		"client_ip": clientIp,
+	}, &validation)
+	return validation, err
+}
+
+func (backend *HTTPSecretBackend) GenerateSecret(clientIp string) (string, error) {
+	response := struct {
+		Secret string `json:"secret"`
+	}{}
+	if err := backend.post(backend.GenerateUrl, map[string]string{"client_ip": clientIp}, &response); err != nil {
+		return "", err
+	}
+	if response.Secret == "" {
+		return "", errors.New("secret backend returned a empty secret")
+	}
+	return response.Secret, nil
+}
+
+type ExecSecretBackend struct {
+	ValidateCommand string
+	GenerateCommand string
+	Timeout         time.Duration
+}
+
+// Run a command, the secret and ip are passed in the environment so that
+// they never end up in a shell command line
+func (backend *ExecSecretBackend) run(command string, env ...string) (output string, exitErr error, err error) {
+	out := bytes.Buffer{}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Own process group, so that children of the shell are killed on a timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if serr := cmd.Start(); serr != nil {
+		return "", nil, serr
+	}
+
+	timedOut := &atomic.Bool{}
+	if backend.Timeout > 0 {
+		timer := time.AfterFunc(backend.Timeout, func() {
+			timedOut.Store(true)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+
+	rerr := cmd.Wait()
+	if timedOut.Load() {
+		return "", nil, errors.New("secret backend command timed out")
+	}
+
+	var exitError *exec.ExitError
+	if errors.As(rerr, &exitError) {
+		return out.String(), rerr, nil
+	}
+	return out.String(), nil, rerr
+}
+
+func (backend *ExecSecretBackend) ValidateSecret(secret string, clientIp string) (SecretValidation, error) {
+	output, exitErr, err := backend.run(backend.ValidateCommand, "SFUI_SECRET="+secret, "SFUI_CLIENT_IP="+clientIp)
+	if err != nil {
+		return SecretValidation{}, err
+	}
+	if exitErr != nil {
+		return SecretValidation{Valid: false, Reason: strings.TrimSpace(strings.SplitN(output, "\n", 2)[0])}, nil
+	}
+	return SecretValidation{Valid: true}, nil
+}
+
+func (backend *ExecSecretBackend) GenerateSecret(clientIp string) (string, error) {
+	output, exitErr, err := backend.run(backend.GenerateCommand, "SFUI_CLIENT_IP="+clientIp)
+	if err == nil {
+		err = exitErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimSpace(output)
+	if secret == "" {
+		return "", errors.New("secret backend returned a empty secret")
+	}
+	return secret, nil
+}
+
+// Caches results of a validator per secret/ip pair, failures are not cached
+type CachingSecretValidator struct {
+	Validator SecretValidator
+	TTL       time.Duration
+	mu        *sync.Mutex
+	cache     map[string]cachedSecretValidation
+}
+
+type cachedSecretValidation struct {
+	Validation SecretValidation
+	Expires    time.Time
+}
+
+func NewCachingSecretValidator(validator SecretValidator, ttl time.Duration) *CachingSecretValidator {
+	cachingValidator := CachingSecretValidator{
+		Validator: validator,
+		TTL:       ttl,
+		mu:        &sync.Mutex{},
+		cache:     make(map[string]cachedSecretValidation),
+	}
+	go cachingValidator.periodicCleanup()
+	return &cachingValidator
+}
+
+func (validator *CachingSecretValidator) periodicCleanup() {
+	for {
+		time.Sleep(time.Minute)
+		validator.mu.Lock()
+		for key, cached := range validator.cache {
+			if time.Now().After(cached.Expires) {
+				delete(validator.cache, key)
+			}
+		}
+		validator.mu.Unlock()
+	}
+}
+
+func (validator *CachingSecretValidator) ValidateSecret(secret string, clientIp string) (SecretValidation, error) {
+	key := getClientId(secret) + "|" + clientIp
+
+	validator.mu.Lock()
+	cached, ok := validator.cache[key]
+	validator.mu.Unlock()
+	if ok && time.Now().Before(cached.Expires) {
+		return cached.Validation, nil
+	}
+
+	validation, err := validator.Validator.ValidateSecret(secret, clientIp)
+	if err != nil {
+		return validation, err
+	}
+
+	validator.mu.Lock()
+	validator.cache[key] = cachedSecretValidation{
+		Validation: validation,
+		Expires:    time.Now().Add(validator.TTL),
+	}
+	validator.mu.Unlock()
+
+	return validation, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewSecretBackend(t *testing.T) {
+	tests := []struct {
+		name   string
+		config SecretBackendConfig
+		cached bool
+		valid  bool
+	}{
+		{"default", SecretBackendConfig{}, false, true},
+		{"local", SecretBackendConfig{Type: SECRET_BACKEND_LOCAL, CacheTTL: 60}, false, true},
+		{"http", SecretBackendConfig{Type: SECRET_BACKEND_HTTP, ValidateUrl: "http://127.0.0.1/v"}, false, true},
+		{"http cached", SecretBackendConfig{Type: SECRET_BACKEND_HTTP, ValidateUrl: "http://127.0.0.1/v", CacheTTL: 60}, true, true},
+		{"http without url", SecretBackendConfig{Type: SECRET_BACKEND_HTTP}, false, false},
+		{"exec", SecretBackendConfig{Type: SECRET_BACKEND_EXEC, ValidateCommand: "true"}, false, true},
+		{"exec without command", SecretBackendConfig{Type: SECRET_BACKEND_EXEC}, false, false},
+		{"unknown type", SecretBackendConfig{Type: "ldap"}, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validator, _, err := NewSecretBackend(test.config)
+			if (err == nil) != test.valid {
+				t.Fatalf("NewSecretBackend() error = %v, want valid %v", err, test.valid)
+			}
+			if _, cached := validator.(*CachingSecretValidator); test.valid && cached != test.cached {
+				t.Errorf("cached = %v, want %v", cached, test.cached)
+			}
+		})
+	}
+}
+
+func TestLocalSecretBackend(t *testing.T) {
+	backend := LocalSecretBackend{}
+	if validation, err := backend.ValidateSecret("anything", "192.0.2.1"); err != nil || !validation.Valid {
+		t.Errorf("ValidateSecret() = %v, %v, want valid", validation, err)
+	}
+	first, _ := backend.GenerateSecret("192.0.2.1")
+	second, _ := backend.GenerateSecret("192.0.2.1")
+	if first == "" || first == second {
+		t.Errorf("GenerateSecret() = %q, %q, want distinct random secrets", first, second)
+	}
+}
+
+func TestHTTPSecretBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		request := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&request)
+
+		switch request["secret"] {
+		case "valid":
+			w.Write([]byte(`{"valid":true}`))
+		case "revoked":
+			w.Write([]byte(`{"valid":false,"reason":"revoked"}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "garbled":
+			w.Write([]byte(`{"valid":`))
+		case "slow":
+			time.Sleep(time.Second)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		want   SecretValidation
+		valid  bool // whether the backend answered
+	}{
+		{"valid", "valid", "token", SecretValidation{Valid: true}, true},
+		{"invalid with a reason", "revoked", "token", SecretValidation{Reason: "revoked"}, true},
+		{"server error", "broken", "token", SecretValidation{}, false},
+		{"malformed response", "garbled", "token", SecretValidation{}, false},
+		{"timeout", "slow", "token", SecretValidation{}, false},
+		{"wrong token", "valid", "other", SecretValidation{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &HTTPSecretBackend{
+				ValidateUrl: server.URL,
+				Token:       test.token,
+				Client:      &http.Client{Timeout: 200 * time.Millisecond},
+			}
+			validation, err := backend.ValidateSecret(test.secret, "192.0.2.1")
+			if (err == nil) != test.valid {
+				t.Fatalf("ValidateSecret() error = %v, want valid %v", err, test.valid)
+			}
+			if test.valid && validation != test.want {
+				t.Errorf("ValidateSecret() = %+v, want %+v", validation, test.want)
+			}
+		})
+	}
+}
+
+func TestExecSecretBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    SecretValidation
+		valid   bool // whether the backend answered
+	}{
+		{"valid", `test "$SFUI_SECRET" = s3cret && test "$SFUI_CLIENT_IP" = 192.0.2.1`, SecretValidation{Valid: true}, true},
+		{"invalid with a reason", "echo 'secret revoked'; echo more; exit 1", SecretValidation{Reason: "secret revoked"}, true},
+		{"invalid without output", "exit 3", SecretValidation{}, true},
+		{"timeout", "sleep 5", SecretValidation{}, false},
+		{"timeout of a child", "sleep 5 | cat", SecretValidation{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := &ExecSecretBackend{ValidateCommand: test.command, Timeout: 300 * time.Millisecond}
+			start := time.Now()
+			validation, err := backend.ValidateSecret("s3cret", "192.0.2.1")
+			if (err == nil) != test.valid {
+				t.Fatalf("ValidateSecret() error = %v, want valid %v", err, test.valid)
+			}
+			if test.valid && validation != test.want {
+				t.Errorf("ValidateSecret() = %+v, want %+v", validation, test.want)
+			}
+			if time.Since(start) > 2*time.Second {
+				t.Errorf("ValidateSecret() took %s, the command was not killed", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestExecSecretBackendGenerate(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+		valid   bool
+	}{
+		{"echo \"  gen-$SFUI_CLIENT_IP  \"", "gen-192.0.2.1", true},
+		{"echo", "", false},
+		{"echo secret; exit 1", "", false},
+	}
+
+	for _, test := range tests {
+		backend := &ExecSecretBackend{GenerateCommand: test.command, Timeout: time.Second}
+		secret, err := backend.GenerateSecret("192.0.2.1")
+		if (err == nil) != test.valid || secret != test.want {
+			t.Errorf("GenerateSecret() with %q = %q, %v, want %q", test.command, secret, err, test.want)
+		}
+	}
+}
+
+type countingSecretValidator struct {
+	mu         sync.Mutex
+	calls      int
+	validation SecretValidation
+	err        error
+}
+
+func (validator *countingSecretValidator) ValidateSecret(secret string, clientIp string) (SecretValidation, error) {
+	validator.mu.Lock()
+	defer validator.mu.Unlock()
+	validator.calls++
+	return validator.validation, validator.err
+}
+
+func TestCachingSecretValidator(t *testing.T) {
+	backend := &countingSecretValidator{validation: SecretValidation{Valid: true}}
+	validator := NewCachingSecretValidator(backend, 100*time.Millisecond)
+
+	validate := func(secret string, clientIp string, calls int) {
+		t.Helper()
+		if _, err := validator.ValidateSecret(secret, clientIp); err != nil && backend.err == nil {
+			t.Fatal(err)
+		}
+		if backend.calls != calls {
+			t.Errorf("backend called %d times, want %d", backend.calls, calls)
+		}
+	}
+
+	validate("secret", "192.0.2.1", 1)
+	validate("secret", "192.0.2.1", 1) // cached
+	validate("secret", "192.0.2.2", 2) // other ip
+	validate("other", "192.0.2.1", 3)  // other secret
+
+	time.Sleep(150 * time.Millisecond)
+	validate("secret", "192.0.2.1", 4) // expired
+
+	backend.err = errTestBackend
+	validate("failing", "192.0.2.1", 5)
+	validate("failing", "192.0.2.1", 6) // errors are not cached
+}
+
+var errTestBackend = errors.New("backend down")
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
 	"log"
@@ -10,9 +11,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -22,6 +25,7 @@ type SSHConnection struct {
 	ControlTerminal       *ssh.Session
 	ControlTerminalStdin  *io.WriteCloser
 	ControlTerminalActive *atomic.Bool
+	ClientId              string // For tracing, the secret is never recorded
 	Host                  string
 	Port                  string
 	Username              string
@@ -32,9 +36,24 @@ type SSHConnection struct {
 	Secret                string
 	ForwardedConnections  map[uint16]*net.Conn
 	Timeout               time.Duration
+	SFTPClient            *sftp.Client // Lazily opened, see GetSFTPClient()
+	sftpMu                sync.Mutex
 }
 
-func (sshConnection *SSHConnection) StartSSHConnection() error {
+func (sshConnection *SSHConnection) StartSSHConnection(ctx context.Context) (err error) {
+	_, span := Tracer.StartSpan(ctx, "ssh.connect", SPAN_KIND_CLIENT)
+	span.SetAttribute(SPAN_ATTR_CLIENT_ID, sshConnection.ClientId)
+	span.SetAttribute(SPAN_ATTR_ENDPOINT, sshConnection.Host)
+	defer func() {
+		if err != nil {
+			span.SetOutcome("error")
+			span.SetError(err)
+		} else {
+			span.SetOutcome("ok")
+		}
+		span.End()
+	}()
+
 	// get host public key
 	hostKey := getHostKey(sshConnection.Host)
 
@@ -68,11 +87,19 @@ func (sshConnection *SSHConnection) StartSSHConnection() error {
 	}
 
 	// connect
+	dialStart := time.Now()
 	client, err := ssh.Dial("tcp", sshConnection.Host+":"+sshConnection.Port, config)
 	if err != nil {
+		promSSHDialFailures.Inc(sshConnection.Host)
+		MLogger.LogEvent(Metric{
+			Type:     METRIC_SSH_DIAL_FAILURE,
+			Endpoint: sshConnection.Host,
+			Reason:   err.Error(),
+		}, sshConnection.ClientIpAddress)
 		log.Println(err)
 		return err
 	}
+	promSSHDialSeconds.Observe(time.Since(dialStart).Seconds(), sshConnection.Host)
 
 	sshConnection.Client = client
 	controlTerminal, cterr := client.NewSession()
@@ -144,6 +171,12 @@ func (sshConnection *SSHConnection) StopSSHConnection() error {
 		for _, forwardedConn := range sshConnection.ForwardedConnections {
 			(*forwardedConn).Close()
 		}
+		sshConnection.sftpMu.Lock()
+		if sshConnection.SFTPClient != nil {
+			sshConnection.SFTPClient.Close()
+			sshConnection.SFTPClient = nil
+		}
+		sshConnection.sftpMu.Unlock()
 		sshConnection.Client.Close()
 		return sshConnection.Client.Wait()
 	}
@@ -241,7 +274,13 @@ func (sshConnection *SSHConnection) RunControlCommand(command string) error {
 	return errors.New("control terminal not active")
 }
 
-func (sshConnection *SSHConnection) ForwardRemotePort(port uint16) (*net.Conn, error) {
+func (sshConnection *SSHConnection) ForwardRemotePort(ctx context.Context, port uint16) (*net.Conn, error) {
+	_, span := Tracer.StartSpan(ctx, "ssh.forward", SPAN_KIND_CLIENT)
+	span.SetAttribute(SPAN_ATTR_CLIENT_ID, sshConnection.ClientId)
+	span.SetAttribute(SPAN_ATTR_ENDPOINT, sshConnection.Host)
+	span.SetAttribute(SPAN_ATTR_PORT, int(port))
+	defer span.End()
+
 	conn, err := sshConnection.Client.DialTCP("tcp4", nil, net.TCPAddrFromAddrPort(
 		netip.AddrPortFrom(
 			netip.AddrFrom4(
@@ -250,9 +289,81 @@ func (sshConnection *SSHConnection) ForwardRemotePort(port uint16) (*net.Conn, e
 			port,
 		),
 	))
+	if err != nil {
+		span.SetOutcome("error")
+		span.SetError(err)
+	} else {
+		span.SetOutcome("ok")
+	}
 	return &conn, err
 }
 
+// Return the SFTP client bound to the master connection, the sftp subsystem
+// is started on first use and reused by all subsequent file operations.
+func (sshConnection *SSHConnection) GetSFTPClient() (*sftp.Client, error) {
+	if !sshConnection.Connected.Load() {
+		return nil, errors.New("connection is not active yet")
+	}
+
+	sshConnection.sftpMu.Lock()
+	defer sshConnection.sftpMu.Unlock()
+
+	if sshConnection.SFTPClient != nil {
+		return sshConnection.SFTPClient, nil
+	}
+
+	sess, err := sshConnection.Client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	// The instance is selected using SECRET, same as a terminal session
+	st1err := sess.Setenv("SECRET", sshConnection.Secret)
+	if st1err != nil {
+		log.Println(st1err, "SECRET")
+	}
+	st2err := sess.Setenv("REMOTE_ADDR", sshConnection.ClientIpAddress)
+	if st2err != nil {
+		log.Println(st2err, "REMOTE_ADDR")
+	}
+
+	stdin, sierr := sess.StdinPipe()
+	if sierr != nil {
+		sess.Close()
+		return nil, sierr
+	}
+	stdout, soerr := sess.StdoutPipe()
+	if soerr != nil {
+		sess.Close()
+		return nil, soerr
+	}
+
+	if serr := sess.RequestSubsystem("sftp"); serr != nil {
+		sess.Close()
+		return nil, serr
+	}
+
+	sftpClient, cerr := sftp.NewClientPipe(stdout, stdin)
+	if cerr != nil {
+		sess.Close()
+		return nil, cerr
+	}
+
+	// Forget the client once the subsystem exits, so that the next call starts a new one
+	go func() {
+		sftpClient.Wait()
+		sess.Close()
+		sshConnection.sftpMu.Lock()
+		if sshConnection.SFTPClient == sftpClient {
+			sshConnection.SFTPClient = nil
+		}
+		sshConnection.sftpMu.Unlock()
+	}()
+
+	sshConnection.SFTPClient = sftpClient
+	return sftpClient, nil
+}
+
 func GetSSHPrivateKeyAuthMethod(keyFilePath string) (ssh.AuthMethod, error) {
 	filebytes, ferr := os.ReadFile(keyFilePath)
 	if ferr != nil {
@@ -5,7 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -17,12 +20,20 @@ type TermRequest struct {
 	NewInstance bool   `json:"new_instance"`
 	ClientIp    string
 	TabId       string `json:"tab_id"`
+	Challenge   string `json:"challenge"` // Proof of work challenge and its solution, if one was requested
+	Solution    string `json:"solution"`
 }
 
 type TermResponse struct {
 	Status      string `json:"status"`
 	Secret      string `json:"secret,omitempty"`
 	IsDuplicate bool   `json:"is_duplicate_session,omitempty"`
+	Reason      string `json:"reason,omitempty"` // Why a request was refused
+	// Access tokens by scope (terminal, desktop, files), use these instead of the secret
+	Tokens      map[string]string `json:"tokens,omitempty"`
+	TokenExpiry int64             `json:"token_expiry,omitempty"`
+	// Proof of work to solve before retrying, sent with status "Challenge Required"
+	Challenge *PoWChallenge `json:"challenge,omitempty"`
 }
 
 // First byte read from Terminal.Pty is matched with
@@ -45,10 +56,13 @@ type Terminal struct {
 	WSConn       *websocket.Conn
 	SSHSession   *ssh.Session
 	MsgBuf       []byte
+	BytesIn      *atomic.Int64 // From the browser
+	BytesOut     *atomic.Int64 // To the browser
 }
 
 type TermConfig struct {
 	Secret string `json:"secret"`
+	Token  string `json:"token"` // Access token, preferred over Secret
 	Rows   int    `json:"rows"`
 	Cols   int    `json:"cols"`
 }
@@ -63,29 +77,46 @@ func (sfui *SfUI) handleTerminalWs(w http.ResponseWriter, r *http.Request) {
 			ClientIp: clientIp,
 			WSConn:   ws,
 			MsgBuf:   make([]byte, 256),
+			BytesIn:  &atomic.Int64{},
+			BytesOut: &atomic.Int64{},
 		}
 
 		ws.PayloadType = websocket.BinaryFrame
 
-		clientSecret, cerr := terminal.ReadSecret()
+		if !Throttle.Allow(RATE_LIMIT_WS_CONNECT, clientIp) {
+			ws.Write([]byte(string(SFUI_NORMAL_MSG) + `too many requests`))
+			return
+		}
+
+		credential, cerr := terminal.ReadSecret()
 		if cerr != nil {
 			ws.Write([]byte(cerr.Error()))
 			return
 		}
-		terminal.ClientSecret = clientSecret
 
 		if !sfui.originAcceptable(ws.Request()) {
 			ws.Write([]byte(string(SFUI_NORMAL_MSG) + `unacceptable origin`))
 			return
 		}
 
-		if err := sfui.secretValid(&TermRequest{
-			Secret:   clientSecret,
-			ClientIp: clientIp,
-		}); err != nil { // Invalid Secret
-			ws.Write([]byte(string(SFUI_NORMAL_MSG) + err.Error()))
+		clientSecret, rerr := sfui.resolveCredential(credential, TOKEN_SCOPE_TERMINAL, clientIp)
+		if rerr != nil {
+			ws.Write([]byte(string(SFUI_NORMAL_MSG) + rerr.Error()))
 			return
 		}
+		terminal.ClientSecret = clientSecret
+
+		// Raw secrets were already checked by resolveCredential, recheck the
+		// secret behind a token in case the backend revoked it since the login
+		if clientSecret != credential {
+			if err := sfui.secretValid(&TermRequest{
+				Secret:   clientSecret,
+				ClientIp: clientIp,
+			}); err != nil { // Invalid Secret
+				ws.Write([]byte(string(SFUI_NORMAL_MSG) + err.Error()))
+				return
+			}
+		}
 
 		err := sfui.handleWsPty(&terminal)
 		if err != nil {
@@ -99,7 +130,7 @@ func (terminal *Terminal) setTermDimensions(rows int, cols int) {
 	terminal.SSHSession.WindowChange(rows, cols)
 }
 
-// Read Secret Sent by Client
+// Read Secret (or access token) Sent by Client
 func (terminal *Terminal) ReadSecret() (secret string, err error) {
 	return readSecretFromWs(terminal.WSConn, &terminal.MsgBuf, TERM_MAX_AUTH_FAILURES)
 }
@@ -113,6 +144,9 @@ func readSecretFromWs(wsConn *websocket.Conn, msgBuf *[]byte, maxAuthFailures in
 			if (*msgBuf)[0] == SFUI_CMD_AUTHENTICATE { // Check the type of data we recieved
 				var termConfig TermConfig
 				if jerr := json.Unmarshal((*msgBuf)[1:n], &termConfig); jerr == nil {
+					if termConfig.Token != "" {
+						return termConfig.Token, nil
+					}
 					if termConfig.Secret != "" {
 						return termConfig.Secret, nil
 					}
@@ -130,6 +164,8 @@ func readSecretFromWs(wsConn *websocket.Conn, msgBuf *[]byte, maxAuthFailures in
 func (terminal *Terminal) Read(msg []byte) (n int, err error) {
 	n, err = terminal.WSConn.Read(terminal.MsgBuf)
 	if n > 0 {
+		promBytes.Add(float64(n), PROM_CHANNEL_TERMINAL, PROM_DIRECTION_IN)
+		terminal.BytesIn.Add(int64(n))
 		switch terminal.MsgBuf[0] { // Check the type of data we recieved
 		case SFUI_CMD_RESIZE:
 			var termConfig TermConfig
@@ -153,6 +189,8 @@ var REG_CMD_BYTES = []byte{'0'}            // Mark as Regular data chunk
 func (terminal *Terminal) Write(msg []byte) (n int, err error) {
 	bw := append(REG_CMD_BYTES, msg[:]...)
 	n, err = terminal.WSConn.Write(bw)
+	promBytes.Add(float64(n), PROM_CHANNEL_TERMINAL, PROM_DIRECTION_OUT)
+	terminal.BytesOut.Add(int64(n))
 	bw = nil
 	return n - 1, err // n-1 so that writer does not get confused as to where the extra 1 byte came from
 }
@@ -170,7 +208,7 @@ func (sfui *SfUI) handleWsPty(terminal *Terminal) error {
 
 	// Get the  associated client or create a new one
 	// client variable below will get stale
-	client, cerr := sfui.GetExistingClientOrMakeNew(terminal.ClientSecret, terminal.ClientIp)
+	client, cerr := sfui.GetExistingClientOrMakeNew(terminal.WSConn.Request().Context(), terminal.ClientSecret, terminal.ClientIp)
 	if cerr != nil {
 		return cerr
 	}
@@ -181,6 +219,12 @@ func (sfui *SfUI) handleWsPty(terminal *Terminal) error {
 	}
 	defer client.DecTermCount() // Remove from terminal Quota
 
+	client.Terminals.Store(terminal, struct{}{})
+	defer client.Terminals.Delete(terminal)
+
+	promTerminalsActive.Inc()
+	defer promTerminalsActive.Dec()
+
 	sess, stdin, stdout, stderr, serr := client.SSHConnection.StartTerminal()
 	if serr != nil {
 		return serr
@@ -188,6 +232,17 @@ func (sfui *SfUI) handleWsPty(terminal *Terminal) error {
 	terminal.SSHSession = sess
 	defer sess.Close()
 
+	openedAt := time.Now()
+	MLogger.LogEvent(Metric{Type: METRIC_TERMINAL_OPEN}, terminal.ClientIp)
+	defer func() {
+		MLogger.LogEvent(Metric{
+			Type:     METRIC_TERMINAL_CLOSE,
+			Duration: time.Since(openedAt).Seconds(),
+			BytesIn:  terminal.BytesIn.Load(),
+			BytesOut: terminal.BytesOut.Load(),
+		}, terminal.ClientIp)
+	}()
+
 	stdOutbuf := make([]byte, 32*1024)
 	stdErrbuf := make([]byte, 32*1024)
 
@@ -212,16 +267,43 @@ func (sfui *SfUI) handleWsPty(terminal *Terminal) error {
 	return nil
 }
 
+// Ask the secret backend whether the secret/ip pair is allowed, the
+// returned error carries the reason shown to the user
 func (sfui *SfUI) secretValid(TermRequest *TermRequest) error {
-	// Pass Secret and Client IP to sf Core
-	// return errors.New("Banned User")
-	// return errors.New("Banned IP")
+	if sfui.SecretValidator == nil {
+		return nil
+	}
+
+	validation, err := sfui.SecretValidator.ValidateSecret(TermRequest.Secret, TermRequest.ClientIp)
+	if err != nil {
+		log.Println("Secret validation failed:", err)
+		return errors.New("could not validate secret, please try again later")
+	}
+	if !validation.Valid {
+		if validation.Reason == "" {
+			return errors.New("secret not accepted")
+		}
+		return errors.New(validation.Reason)
+	}
 	return nil
 }
 
-func (sfui *SfUI) generateSecret(TermRequest *TermRequest) string {
-	// Return a new secret
-	return RandomStr(25)
+func (sfui *SfUI) generateSecret(TermRequest *TermRequest) (string, error) {
+	if sfui.SecretGenerator == nil {
+		return RandomStr(25), nil
+	}
+
+	secret, err := sfui.SecretGenerator.GenerateSecret(TermRequest.ClientIp)
+	if err != nil {
+		log.Println("Secret generation failed:", err)
+		return "", errors.New("could not create a new instance, please try again later")
+	}
+	// The endpoint name is prepended with a "-", a "-" in the secret would break the split
+	if !sfui.ValidSecret(secret) || strings.Contains(secret, "-") {
+		log.Println("Secret generation failed: secret backend returned a malformed secret")
+		return "", errors.New("could not create a new instance, please try again later")
+	}
+	return secret, nil
 }
 
 func (sfui *SfUI) originAcceptable(r *http.Request) bool {
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Short lived access tokens, issued by /secret so that the raw secret does not
+// have to travel in urls, headers or WS auth messages. A token is scoped to a
+// single capability, bound to a client id and the ip it was issued to.
+//
+// Format : base64url(scope "." clientId "." expiry) "." base64url(HMAC(payload "." ip))
+const (
+	TOKEN_SCOPE_TERMINAL = "terminal"
+	TOKEN_SCOPE_DESKTOP  = "desktop"
+	TOKEN_SCOPE_FILES    = "files"
+	TOKEN_SCOPE_SHARE    = "share" // share:<hash of the share secret>, issued to shared desktop viewers
+)
+
+var tokenScopes = []string{TOKEN_SCOPE_TERMINAL, TOKEN_SCOPE_DESKTOP, TOKEN_SCOPE_FILES}
+
+type AccessToken struct {
+	Scope    string
+	ClientId string
+	Expiry   time.Time
+}
+
+// Maps client ids to secrets, a session is created on login so that a
+// token holder can be served even after the master connection was torn down.
+type tokenSession struct {
+	Secret  string
+	Expires time.Time
+}
+
+type TokenIssuer struct {
+	key      []byte
+	ttl      time.Duration
+	lifetime time.Duration // how long a session can be refreshed without a fresh login
+	mu       *sync.Mutex
+	sessions map[string]tokenSession // ClientId -> session
+}
+
+var Tokens = TokenIssuer{}
+
+func (issuer *TokenIssuer) Init(key string, ttl time.Duration, lifetime time.Duration) {
+	if key == "" {
+		key = RandomStr(42) // tokens do not survive a restart
+	}
+	issuer.key = []byte(key)
+	issuer.ttl = ttl
+	issuer.lifetime = lifetime
+	issuer.mu = &sync.Mutex{}
+	issuer.sessions = make(map[string]tokenSession)
+	go issuer.periodicCleanup()
+}
+
+// Apply a reloaded ws_timeout, sessions already started keep their expiry
+func (issuer *TokenIssuer) Configure(sfui *SfUI) {
+	issuer.mu.Lock()
+	issuer.lifetime = time.Minute * time.Duration(sfui.WSTimeout)
+	issuer.mu.Unlock()
+}
+
+func (issuer *TokenIssuer) periodicCleanup() {
+	for {
+		time.Sleep(time.Minute)
+		issuer.mu.Lock()
+		for clientId, session := range issuer.sessions {
+			if time.Now().After(session.Expires) {
+				delete(issuer.sessions, clientId)
+			}
+		}
+		issuer.mu.Unlock()
+	}
+}
+
+// Record a login, returns a token for every capability
+func (issuer *TokenIssuer) StartSession(secret string, clientIp string) (tokens map[string]string, expiry time.Time) {
+	clientId := getClientId(secret)
+
+	issuer.mu.Lock()
+	issuer.sessions[clientId] = tokenSession{
+		Secret:  secret,
+		Expires: time.Now().Add(issuer.lifetime),
+	}
+	issuer.mu.Unlock()
+
+	tokens = make(map[string]string)
+	expiry = time.Now().Add(issuer.ttl)
+	for _, scope := range tokenScopes {
+		tokens[scope] = issuer.Issue(scope, clientId, clientIp, expiry)
+	}
+	return tokens, expiry
+}
+
+func (issuer *TokenIssuer) EndSession(secret string) {
+	issuer.mu.Lock()
+	delete(issuer.sessions, getClientId(secret))
+	issuer.mu.Unlock()
+}
+
+func (issuer *TokenIssuer) Issue(scope string, clientId string, clientIp string, expiry time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString(
+		[]byte(scope + "." + clientId + "." + strconv.FormatInt(expiry.Unix(), 10)))
+	return payload + "." + issuer.sign(payload, clientIp)
+}
+
+func (issuer *TokenIssuer) sign(payload string, clientIp string) string {
+	mac := hmac.New(sha256.New, issuer.key)
+	mac.Write([]byte(payload + "." + clientIp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify the signature and ip binding of a token, expiry is checked by the caller
+func (issuer *TokenIssuer) Parse(token string, clientIp string) (AccessToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || issuer.key == nil {
+		return AccessToken{}, errors.New("malformed token")
+	}
+
+	if !hmac.Equal([]byte(issuer.sign(parts[0], clientIp)), []byte(parts[1])) {
+		return AccessToken{}, errors.New("invalid token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return AccessToken{}, errors.New("malformed token")
+	}
+
+	fields := strings.Split(string(payload), ".")
+	if len(fields) != 3 {
+		return AccessToken{}, errors.New("malformed token")
+	}
+
+	expiry, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return AccessToken{}, errors.New("malformed token")
+	}
+
+	return AccessToken{
+		Scope:    fields[0],
+		ClientId: fields[1],
+		Expiry:   time.Unix(expiry, 0),
+	}, nil
+}
+
+// Verify a token for a given scope, returns the clients secret
+func (issuer *TokenIssuer) Verify(token string, scope string, clientIp string) (secret string, err error) {
+	accessToken, err := issuer.Parse(token, clientIp)
+	if err != nil {
+		return "", err
+	}
+
+	if accessToken.Scope != scope {
+		return "", errors.New("token not valid for this resource")
+	}
+
+	if time.Now().After(accessToken.Expiry) {
+		return "", errors.New("token expired")
+	}
+
+	issuer.mu.Lock()
+	session, ok := issuer.sessions[accessToken.ClientId]
+	issuer.mu.Unlock()
+	if !ok || time.Now().After(session.Expires) {
+		return "", errors.New("session expired, please login again")
+	}
+
+	return session.Secret, nil
+}
+
+// Issue a fresh token with the same scope, the old token may have expired
+// but the session it belongs to must still be valid.
+func (issuer *TokenIssuer) Refresh(token string, clientIp string) (string, time.Time, error) {
+	accessToken, err := issuer.Parse(token, clientIp)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	issuer.mu.Lock()
+	session, ok := issuer.sessions[accessToken.ClientId]
+	issuer.mu.Unlock()
+	if !ok || time.Now().After(session.Expires) {
+		return "", time.Time{}, errors.New("session expired, please login again")
+	}
+
+	expiry := time.Now().Add(issuer.ttl)
+	return issuer.Issue(accessToken.Scope, accessToken.ClientId, clientIp, expiry), expiry, nil
+}
+
+// Resolve a credential presented to a handler into the clients secret. Tokens are
+// always accepted, raw secrets only if AllowSecretAuth is set and the secret
+// backend accepts them (tokens are only issued for secrets it accepted on login).
+func (sfui *SfUI) resolveCredential(credential string, scope string, clientIp string) (secret string, err error) {
+	if strings.Contains(credential, ".") {
+		return Tokens.Verify(credential, scope, clientIp)
+	}
+
+	if sfui.AllowSecretAuth && sfui.ValidSecret(credential) {
+		if verr := sfui.secretValid(&TermRequest{Secret: credential, ClientIp: clientIp}); verr != nil {
+			return "", verr
+		}
+		return credential, nil
+	}
+
+	return "", errors.New("unacceptable secret")
+}
+
+type TokenRefreshRequest struct {
+	Token string `json:"token"`
+}
+
+type TokenRefreshResponse struct {
+	Status string `json:"status"`
+	Token  string `json:"token,omitempty"`
+	Expiry int64  `json:"token_expiry,omitempty"`
+}
+
+func (sfui *SfUI) handleTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	data, err := io.ReadAll(io.LimitReader(r.Body, 2048))
+	if err == nil {
+		refreshReq := TokenRefreshRequest{}
+		if json.Unmarshal(data, &refreshReq) == nil {
+			token, expiry, terr := Tokens.Refresh(refreshReq.Token, sfui.getClientAddr(r))
+			if terr != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				response, _ := json.Marshal(TokenRefreshResponse{Status: terr.Error()})
+				w.Write(response)
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+			response, _ := json.Marshal(TokenRefreshResponse{
+				Status: "OK",
+				Token:  token,
+				Expiry: expiry.Unix(),
+			})
+			w.Write(response)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(`{"status":"Internal Server Error"}`))
+}
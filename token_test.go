@@ -0,0 +1,184 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "abcdefghijklmnopqrstuvwxy"
+
+func newTestIssuer() *TokenIssuer {
+	return &TokenIssuer{
+		key:      []byte("test key"),
+		ttl:      time.Minute,
+		lifetime: time.Hour,
+		mu:       &sync.Mutex{},
+		sessions: make(map[string]tokenSession),
+	}
+}
+
+func TestTokenVerify(t *testing.T) {
+	issuer := newTestIssuer()
+	tokens, _ := issuer.StartSession(testSecret, "192.0.2.1")
+	clientId := getClientId(testSecret)
+	expired := issuer.Issue(TOKEN_SCOPE_TERMINAL, clientId, "192.0.2.1", time.Now().Add(-time.Second))
+	unknownClient := issuer.Issue(TOKEN_SCOPE_TERMINAL, "unknown", "192.0.2.1", time.Now().Add(time.Minute))
+	otherKey := newTestIssuer()
+	otherKey.key = []byte("other key")
+	forged := otherKey.Issue(TOKEN_SCOPE_TERMINAL, clientId, "192.0.2.1", time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name  string
+		token string
+		scope string
+		ip    string
+		valid bool
+	}{
+		{"terminal token", tokens[TOKEN_SCOPE_TERMINAL], TOKEN_SCOPE_TERMINAL, "192.0.2.1", true},
+		{"desktop token", tokens[TOKEN_SCOPE_DESKTOP], TOKEN_SCOPE_DESKTOP, "192.0.2.1", true},
+		{"files token", tokens[TOKEN_SCOPE_FILES], TOKEN_SCOPE_FILES, "192.0.2.1", true},
+		{"wrong scope", tokens[TOKEN_SCOPE_FILES], TOKEN_SCOPE_TERMINAL, "192.0.2.1", false},
+		{"other ip", tokens[TOKEN_SCOPE_TERMINAL], TOKEN_SCOPE_TERMINAL, "192.0.2.2", false},
+		{"expired", expired, TOKEN_SCOPE_TERMINAL, "192.0.2.1", false},
+		{"no session", unknownClient, TOKEN_SCOPE_TERMINAL, "192.0.2.1", false},
+		{"signed with another key", forged, TOKEN_SCOPE_TERMINAL, "192.0.2.1", false},
+		{"tampered payload", "x" + tokens[TOKEN_SCOPE_TERMINAL], TOKEN_SCOPE_TERMINAL, "192.0.2.1", false},
+		{"missing signature", strings.Split(tokens[TOKEN_SCOPE_TERMINAL], ".")[0], TOKEN_SCOPE_TERMINAL, "192.0.2.1", false},
+		{"extra part", tokens[TOKEN_SCOPE_TERMINAL] + ".x", TOKEN_SCOPE_TERMINAL, "192.0.2.1", false},
+		{"empty", "", TOKEN_SCOPE_TERMINAL, "192.0.2.1", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret, err := issuer.Verify(test.token, test.scope, test.ip)
+			if (err == nil) != test.valid {
+				t.Fatalf("Verify() error = %v, want valid %v", err, test.valid)
+			}
+			if test.valid && secret != testSecret {
+				t.Errorf("Verify() = %q, want the session secret", secret)
+			}
+		})
+	}
+}
+
+func TestTokenSessionEnd(t *testing.T) {
+	tests := []struct {
+		name  string
+		end   func(issuer *TokenIssuer)
+		valid bool
+	}{
+		{"active session", func(issuer *TokenIssuer) {}, true},
+		{"logged out", func(issuer *TokenIssuer) { issuer.EndSession(testSecret) }, false},
+		{"session lifetime over", func(issuer *TokenIssuer) {
+			session := issuer.sessions[getClientId(testSecret)]
+			session.Expires = time.Now().Add(-time.Second)
+			issuer.sessions[getClientId(testSecret)] = session
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer := newTestIssuer()
+			tokens, _ := issuer.StartSession(testSecret, "192.0.2.1")
+			test.end(issuer)
+
+			_, verr := issuer.Verify(tokens[TOKEN_SCOPE_DESKTOP], TOKEN_SCOPE_DESKTOP, "192.0.2.1")
+			if (verr == nil) != test.valid {
+				t.Errorf("Verify() error = %v, want valid %v", verr, test.valid)
+			}
+			_, _, rerr := issuer.Refresh(tokens[TOKEN_SCOPE_DESKTOP], "192.0.2.1")
+			if (rerr == nil) != test.valid {
+				t.Errorf("Refresh() error = %v, want valid %v", rerr, test.valid)
+			}
+		})
+	}
+}
+
+func TestTokenConfigure(t *testing.T) {
+	issuer := newTestIssuer()
+	issuer.StartSession("first-secret", "192.0.2.1")
+	issuer.Configure(&SfUI{WSTimeout: 5})
+	issuer.StartSession(testSecret, "192.0.2.1")
+
+	if expires := issuer.sessions[getClientId("first-secret")].Expires; time.Until(expires) < 50*time.Minute {
+		t.Errorf("session started before the reload expires in %s, want it kept at 1h", time.Until(expires))
+	}
+	if expires := issuer.sessions[getClientId(testSecret)].Expires; time.Until(expires) > 5*time.Minute {
+		t.Errorf("session started after the reload expires in %s, want 5m", time.Until(expires))
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	issuer := newTestIssuer()
+	issuer.StartSession(testSecret, "192.0.2.1")
+	expired := issuer.Issue(TOKEN_SCOPE_FILES, getClientId(testSecret), "192.0.2.1", time.Now().Add(-time.Hour))
+
+	if _, _, err := issuer.Refresh(expired, "192.0.2.2"); err == nil {
+		t.Error("Refresh() accepted a token from another ip")
+	}
+
+	token, expiry, err := issuer.Refresh(expired, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiry.Before(time.Now()) {
+		t.Errorf("refreshed expiry %v is in the past", expiry)
+	}
+	if _, verr := issuer.Verify(token, TOKEN_SCOPE_FILES, "192.0.2.1"); verr != nil {
+		t.Errorf("refreshed token not valid: %v", verr)
+	}
+	if _, verr := issuer.Verify(token, TOKEN_SCOPE_TERMINAL, "192.0.2.1"); verr == nil {
+		t.Error("refresh changed the token scope")
+	}
+}
+
+type testSecretValidator struct {
+	rejected string
+}
+
+func (validator testSecretValidator) ValidateSecret(secret string, clientIp string) (SecretValidation, error) {
+	return SecretValidation{Valid: secret != validator.rejected}, nil
+}
+
+func TestResolveCredential(t *testing.T) {
+	issuer := newTestIssuer()
+	saved := Tokens
+	Tokens = *issuer
+	defer func() { Tokens = saved }()
+	tokens, _ := Tokens.StartSession(testSecret, "192.0.2.1")
+
+	validSecret := regexp.MustCompile(`^[a-zA-Z0-9]{25}$`).MatchString
+	tests := []struct {
+		name            string
+		credential      string
+		allowSecretAuth bool
+		valid           bool
+	}{
+		{"token", tokens[TOKEN_SCOPE_FILES], false, true},
+		{"token of another scope", tokens[TOKEN_SCOPE_TERMINAL], false, false},
+		{"raw secret not allowed", testSecret, false, false},
+		{"raw secret allowed", testSecret, true, true},
+		{"malformed secret", "short", true, false},
+		{"secret rejected by the backend", "zyxwvutsrqponmlkjihgfedcb", true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sfui := &SfUI{
+				AllowSecretAuth: test.allowSecretAuth,
+				ValidSecret:     validSecret,
+				SecretValidator: testSecretValidator{rejected: "zyxwvutsrqponmlkjihgfedcb"},
+			}
+			secret, err := sfui.resolveCredential(test.credential, TOKEN_SCOPE_FILES, "192.0.2.1")
+			if (err == nil) != test.valid {
+				t.Fatalf("resolveCredential() error = %v, want valid %v", err, test.valid)
+			}
+			if test.valid && secret != testSecret {
+				t.Errorf("resolveCredential() = %q, want %q", secret, testSecret)
+			}
+		})
+	}
+}
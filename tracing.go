@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Spans are exported to a OpenTelemetry collector with the OTLP/HTTP protocol
+// (json encoding), without pulling in the OpenTelemetry SDK. Only what sfui
+// needs is implemented: parent/child spans carried in a context.Context,
+// W3C traceparent propagation, ratio based sampling and batched export.
+
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_SERVER   = 2
+	SPAN_KIND_CLIENT   = 3
+
+	SPAN_STATUS_UNSET = 0
+	SPAN_STATUS_OK    = 1
+	SPAN_STATUS_ERROR = 2
+
+	TRACING_QUEUE_SIZE     = 2048
+	TRACING_BATCH_SIZE     = 256
+	TRACING_FLUSH_INTERVAL = 5 * time.Second
+)
+
+// Span attributes, the client secret is never recorded, only the client id
+// derived from it
+const (
+	SPAN_ATTR_CLIENT_ID    = "client.id"
+	SPAN_ATTR_ENDPOINT     = "endpoint"
+	SPAN_ATTR_OUTCOME      = "outcome"
+	SPAN_ATTR_PORT         = "port"
+	SPAN_ATTR_DESKTOP_TYPE = "desktop.type"
+	SPAN_ATTR_HTTP_METHOD  = "http.method"
+	SPAN_ATTR_HTTP_ROUTE   = "http.route"
+	SPAN_ATTR_HTTP_STATUS  = "http.status_code"
+)
+
+type TraceExporter struct {
+	Enabled     atomic.Bool
+	Endpoint    string // <collector>/v1/traces
+	Headers     map[string]string
+	ServiceName string
+	SampleRatio float64
+	queue       chan *Span
+	client      *http.Client
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+var Tracer = TraceExporter{}
+
+type Span struct {
+	TraceId       [16]byte
+	SpanId        [8]byte
+	ParentSpanId  [8]byte // zero for root spans
+	Name          string
+	Kind          int
+	StartTime     time.Time
+	EndTime       time.Time
+	Attributes    map[string]interface{} // string, int, int64, bool or float64
+	Status        int
+	StatusMessage string
+	sampled       bool
+	ended         bool
+	mu            *sync.Mutex
+}
+
+type spanContextKey struct{}
+
+// Start exporting spans, spans started before Init or when tracing is
+// disabled are nil and all Span methods are no-ops on them
+func (tracer *TraceExporter) Init(sfui *SfUI) {
+	if !sfui.TracingEnabled {
+		return
+	}
+	if sfui.TracingEndpoint == "" {
+		log.Println("Tracing is enabled but tracing_endpoint is empty, tracing disabled")
+		return
+	}
+
+	tracer.Endpoint = strings.TrimSuffix(sfui.TracingEndpoint, "/") + "/v1/traces"
+	tracer.Headers = sfui.TracingHeaders
+	tracer.ServiceName = sfui.TracingServiceName
+	tracer.SampleRatio = sfui.TracingSampleRatio
+	tracer.queue = make(chan *Span, TRACING_QUEUE_SIZE)
+	tracer.client = &http.Client{Timeout: time.Second * time.Duration(sfui.TracingTimeout)}
+	tracer.stop = make(chan struct{})
+	tracer.done = make(chan struct{})
+	tracer.Enabled.Store(true)
+
+	go tracer.export()
+}
+
+// Export the spans that are still queued and stop the exporter
+func (tracer *TraceExporter) Stop() {
+	if !tracer.Enabled.Swap(false) {
+		return
+	}
+	close(tracer.stop)
+	<-tracer.done
+}
+
+// Start a span as a child of the span in ctx, or as a new trace if ctx has
+// none. Sampling is decided for the root span and inherited by its children.
+func (tracer *TraceExporter) StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if !tracer.Enabled.Load() {
+		return ctx, nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: map[string]interface{}{},
+		mu:         &sync.Mutex{},
+	}
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok && parent != nil {
+		span.TraceId = parent.TraceId
+		span.ParentSpanId = parent.SpanId
+		span.sampled = parent.sampled
+	} else {
+		rand.Read(span.TraceId[:])
+		span.sampled = mrand.Float64() < tracer.SampleRatio
+	}
+	rand.Read(span.SpanId[:])
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// Start a server span for a request, continuing the trace of the caller if
+// it sent a W3C traceparent header. The header is only honored from
+// trusted_proxies, anyone else could otherwise pick trace ids and force sampling.
+func (tracer *TraceExporter) StartRequestSpan(r *http.Request, name string) (context.Context, *Span) {
+	ctx := r.Context()
+	if !tracer.Enabled.Load() {
+		return ctx, nil
+	}
+
+	if sfui := RunningConfig.Load(); sfui != nil && sfui.fromTrustedProxy(r) {
+		if remote, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanContextKey{}, remote)
+		}
+	}
+	ctx, span := tracer.StartSpan(ctx, name, SPAN_KIND_SERVER)
+	span.SetAttribute(SPAN_ATTR_HTTP_METHOD, r.Method)
+	span.SetAttribute(SPAN_ATTR_HTTP_ROUTE, requestRoute(r.URL.Path))
+	return ctx, span
+}
+
+// traceparent: version-traceid-parentid-flags, ex:
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(header string) (*Span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+
+	remote := &Span{}
+	if _, err := hex.Decode(remote.TraceId[:], []byte(parts[1])); err != nil || remote.TraceId == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(remote.SpanId[:], []byte(parts[2])); err != nil || remote.SpanId == [8]byte{} {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	remote.sampled = flags&1 == 1
+	return remote, true
+}
+
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.Attributes[key] = value
+}
+
+// Record the outcome of the operation, outcomes other than "ok" do not imply
+// a error, use SetError for that
+func (span *Span) SetOutcome(outcome string) {
+	span.SetAttribute(SPAN_ATTR_OUTCOME, outcome)
+}
+
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	span.Status = SPAN_STATUS_ERROR
+	span.StatusMessage = err.Error()
+}
+
+// End the span and queue it for export, spans are dropped if the queue is full
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	if span.ended {
+		span.mu.Unlock()
+		return
+	}
+	span.ended = true
+	span.EndTime = time.Now()
+	span.mu.Unlock()
+
+	if !span.sampled || !Tracer.Enabled.Load() {
+		return
+	}
+	select {
+	case Tracer.queue <- span:
+	default:
+	}
+}
+
+func (tracer *TraceExporter) export() {
+	defer close(tracer.done)
+
+	ticker := time.NewTicker(TRACING_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, TRACING_BATCH_SIZE)
+	for {
+		select {
+		case span := <-tracer.queue:
+			batch = append(batch, span)
+			if len(batch) >= TRACING_BATCH_SIZE {
+				tracer.send(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				tracer.send(batch)
+				batch = batch[:0]
+			}
+		case <-tracer.stop:
+			for {
+				select {
+				case span := <-tracer.queue:
+					batch = append(batch, span)
+				default:
+					if len(batch) > 0 {
+						tracer.send(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// OTLP/HTTP json request body, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	switch v := value.(type) {
+	case bool:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"boolValue": v}}
+	case int:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case int64:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}}
+	case float64:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"doubleValue": v}}
+	case string:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"stringValue": v}}
+	default:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+func (span *Span) toOTLP() otlpSpan {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+
+	encoded := otlpSpan{
+		TraceId:           hex.EncodeToString(span.TraceId[:]),
+		SpanId:            hex.EncodeToString(span.SpanId[:]),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		Status:            otlpStatus{Code: span.Status, Message: span.StatusMessage},
+	}
+	if span.ParentSpanId != [8]byte{} {
+		encoded.ParentSpanId = hex.EncodeToString(span.ParentSpanId[:])
+	}
+	for key, value := range span.Attributes {
+		encoded.Attributes = append(encoded.Attributes, otlpAttribute(key, value))
+	}
+	return encoded
+}
+
+func (tracer *TraceExporter) send(batch []*Span) {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		spans = append(spans, span.toOTLP())
+	}
+
+	body, err := json.Marshal(otlpTraceRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpKeyValue{
+				otlpAttribute("service.name", tracer.ServiceName),
+				otlpAttribute("service.version", SfuiVersion),
+			}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "sfui", Version: SfuiVersion},
+				Spans: spans,
+			}},
+		}},
+	})
+	if err != nil {
+		log.Println("Failed to encode spans", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, tracer.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Println("Failed to export spans", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range tracer.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := tracer.client.Do(req)
+	if err != nil {
+		log.Println("Failed to export spans", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		log.Printf("Failed to export %d spans, collector returned %s\n", len(batch), res.Status)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"future version with extra fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"invalid version ff", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"zero parent id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"short trace id", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false, false},
+		{"bad flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz", false, false},
+		{"missing fields", "00-4bf92f3577b34da6a3ce929d0e0e4736", false, false},
+		{"empty", "", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote, ok := parseTraceparent(test.header)
+			if ok != test.valid {
+				t.Fatalf("parseTraceparent(%q) valid = %v, want %v", test.header, ok, test.valid)
+			}
+			if ok && remote.sampled != test.sampled {
+				t.Errorf("sampled = %v, want %v", remote.sampled, test.sampled)
+			}
+		})
+	}
+}
+
+func TestOTLPAttribute(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{true, `{"key":"k","value":{"boolValue":true}}`},
+		{42, `{"key":"k","value":{"intValue":"42"}}`},
+		{int64(1) << 40, `{"key":"k","value":{"intValue":"1099511627776"}}`},
+		{1.5, `{"key":"k","value":{"doubleValue":1.5}}`},
+		{"v", `{"key":"k","value":{"stringValue":"v"}}`},
+		{uint16(22), `{"key":"k","value":{"stringValue":"22"}}`},
+	}
+
+	for _, test := range tests {
+		encoded, _ := json.Marshal(otlpAttribute("k", test.value))
+		if string(encoded) != test.want {
+			t.Errorf("otlpAttribute(%#v) = %s, want %s", test.value, encoded, test.want)
+		}
+	}
+}
+
+func TestSpanToOTLP(t *testing.T) {
+	remote, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span := &Span{
+		TraceId:      remote.TraceId,
+		SpanId:       [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		ParentSpanId: remote.SpanId,
+		Name:         "sfui.login",
+		Kind:         SPAN_KIND_SERVER,
+		StartTime:    time.Unix(1, 5),
+		EndTime:      time.Unix(2, 0),
+		Attributes:   map[string]interface{}{SPAN_ATTR_OUTCOME: "ok"},
+		Status:       SPAN_STATUS_ERROR,
+		mu:           &sync.Mutex{},
+	}
+
+	encoded := span.toOTLP()
+	want := otlpSpan{
+		TraceId:           "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanId:            "0102030405060708",
+		ParentSpanId:      "00f067aa0ba902b7",
+		Name:              "sfui.login",
+		Kind:              SPAN_KIND_SERVER,
+		StartTimeUnixNano: "1000000005",
+		EndTimeUnixNano:   "2000000000",
+		Attributes:        []otlpKeyValue{otlpAttribute(SPAN_ATTR_OUTCOME, "ok")},
+		Status:            otlpStatus{Code: SPAN_STATUS_ERROR},
+	}
+	got, _ := json.Marshal(encoded)
+	expected, _ := json.Marshal(want)
+	if string(got) != string(expected) {
+		t.Errorf("toOTLP() = %s, want %s", got, expected)
+	}
+
+	// Root spans have no parentSpanId
+	span.ParentSpanId = [8]byte{}
+	if root, _ := json.Marshal(span.toOTLP()); strings.Contains(string(root), "parentSpanId") {
+		t.Errorf("root span encoded with a parent: %s", root)
+	}
+}
+
+func TestRequestSpanTraceparent(t *testing.T) {
+	resolver, _ := NewClientIPResolver(true, []string{"10.0.0.1"})
+	RunningConfig.Store(&SfUI{ClientIPResolver: resolver})
+	Tracer.Enabled.Store(true)
+	defer Tracer.Enabled.Store(false)
+	InitRouter()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		path       string
+		continued  bool
+		route      string
+	}{
+		{"trusted proxy", "10.0.0.1:4000", "/secret", true, "/secret"},
+		{"untrusted peer", "192.0.2.7:4000", "/secret", false, "/secret"},
+		{"filebrowser path is not recorded", "10.0.0.1:4000", "/filebrowser/api/resources/home/notes.txt", true, "/filebrowser/*"},
+		{"files api", "192.0.2.7:4000", "/files/download", false, "/files/*"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.path, nil)
+			r.RemoteAddr = test.remoteAddr
+			r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+			_, span := Tracer.StartRequestSpan(r, "test")
+			continued := span.ParentSpanId != [8]byte{}
+			if continued != test.continued {
+				t.Errorf("trace continued = %v, want %v", continued, test.continued)
+			}
+			if route := span.Attributes[SPAN_ATTR_HTTP_ROUTE]; route != test.route {
+				t.Errorf("http.route = %v, want %v", route, test.route)
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Resumable uploads to the instance, implements the tus 1.0.0 protocol
+// (core + creation + termination extensions), see https://tus.io/protocols/resumable-upload
+//
+//	POST   /files/tus/      create a upload (Upload-Length, Upload-Metadata: filename, path)
+//	HEAD   /files/tus/{id}  current offset
+//	PATCH  /files/tus/{id}  append a chunk at Upload-Offset
+//	DELETE /files/tus/{id}  abort the upload
+//
+// Chunks are written over SFTP to "<destination>.sfui-upload" which is renamed
+// to the destination once the upload completes. Upload state is kept per client
+// and outlives the clients SSH connection, so a upload can be resumed after
+// a reconnect.
+const (
+	TUS_VERSION       = "1.0.0"
+	TUS_EXTENSIONS    = "creation,termination"
+	TUS_PART_SUFFIX   = ".sfui-upload"
+	TUS_CHUNK_CT      = "application/offset+octet-stream"
+	TUS_PATH_PREFIX   = "/files/tus/"
+	TUS_CLEANUP_DELAY = time.Minute
+)
+
+var isTusPath = regexp.MustCompile(`(?m)^/files/tus(/.*)?$`).MatchString
+
+type TusUpload struct {
+	Id          string
+	ClientId    string
+	Destination string // Final path on the instance
+	Length      int64
+	Offset      atomic.Int64 // Written under mu, read without it for quota checks
+	CreatedOn   time.Time
+	LastActive  time.Time
+	mu          *sync.Mutex // Held while a PATCH is in progress
+}
+
+type TusUploadStore struct {
+	mu      *sync.Mutex
+	Uploads map[string]map[string]*TusUpload // ClientId -> UploadId -> Upload
+}
+
+var TusUploads = TusUploadStore{}
+
+func (store *TusUploadStore) Init(expiry time.Duration) {
+	store.mu = &sync.Mutex{}
+	store.Uploads = make(map[string]map[string]*TusUpload)
+	go store.periodicCleanup(expiry)
+}
+
+// Forget uploads that have not seen a chunk within the expiry duration and
+// remove their partial files, if the client is still connected
+func (store *TusUploadStore) periodicCleanup(expiry time.Duration) {
+	for {
+		time.Sleep(TUS_CLEANUP_DELAY)
+		expired := []*TusUpload{}
+		store.mu.Lock()
+		for clientId, uploads := range store.Uploads {
+			for uploadId, upload := range uploads {
+				if !upload.mu.TryLock() {
+					continue // a chunk is being written
+				}
+				if time.Since(upload.LastActive) > expiry {
+					delete(uploads, uploadId)
+					expired = append(expired, upload)
+				}
+				upload.mu.Unlock()
+			}
+			if len(uploads) == 0 {
+				delete(store.Uploads, clientId)
+			}
+		}
+		store.mu.Unlock()
+
+		for _, upload := range expired {
+			removeTusPartFile(upload)
+		}
+	}
+}
+
+// SFTP calls can block, so this runs outside of the store lock
+func removeTusPartFile(upload *TusUpload) {
+	client, cerr := RunningConfig.Load().GetClientById(upload.ClientId)
+	if cerr != nil {
+		return
+	}
+	sftpClient, serr := client.SSHConnection.GetSFTPClient()
+	if serr != nil {
+		return
+	}
+	sftpClient.Remove(upload.Destination + TUS_PART_SUFFIX)
+}
+
+// Add a upload, fails if the client would exceed its quota of unfinished upload bytes
+func (store *TusUploadStore) Add(upload *TusUpload, clientQuota int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	uploads, ok := store.Uploads[upload.ClientId]
+	if !ok {
+		uploads = make(map[string]*TusUpload)
+		store.Uploads[upload.ClientId] = uploads
+	}
+
+	if clientQuota > 0 {
+		pending := upload.Length
+		for _, existing := range uploads {
+			pending += existing.Length - existing.Offset.Load()
+		}
+		if pending > clientQuota {
+			return errors.New("upload quota exceeded")
+		}
+	}
+
+	uploads[upload.Id] = upload
+	return nil
+}
+
+func (store *TusUploadStore) Get(clientId string, uploadId string) (*TusUpload, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if upload, ok := store.Uploads[clientId][uploadId]; ok {
+		return upload, nil
+	}
+	return nil, errors.New("no such upload")
+}
+
+func (store *TusUploadStore) Remove(clientId string, uploadId string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if uploads, ok := store.Uploads[clientId]; ok {
+		delete(uploads, uploadId)
+		if len(uploads) == 0 {
+			delete(store.Uploads, clientId)
+		}
+	}
+}
+
+func (sfui *SfUI) handleTusUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", TUS_VERSION)
+	w.Header().Set("Access-Control-Expose-Headers",
+		"Location, Upload-Offset, Upload-Length, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", TUS_VERSION)
+		w.Header().Set("Tus-Extension", TUS_EXTENSIONS)
+		if sfui.TusMaxUploadSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(sfui.TusMaxUploadSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != TUS_VERSION {
+		w.Header().Set("Tus-Version", TUS_VERSION)
+		writeFilesError(w, http.StatusPreconditionFailed, "unsupported tus version")
+		return
+	}
+
+	clientSecret, serr := sfui.resolveCredential(r.Header.Get("X-SfUi-Token"), TOKEN_SCOPE_FILES, sfui.getClientAddr(r))
+	if serr != nil {
+		writeFilesError(w, http.StatusForbidden, serr.Error())
+		return
+	}
+	clientId := getClientId(clientSecret)
+
+	uploadId := strings.Trim(strings.TrimPrefix(r.URL.Path, "/files/tus"), "/")
+
+	switch {
+	case uploadId == "" && r.Method == http.MethodPost:
+		sfui.tusCreate(w, r, clientSecret, clientId)
+	case uploadId != "" && r.Method == http.MethodHead:
+		tusHead(w, clientId, uploadId)
+	case uploadId != "" && r.Method == http.MethodPatch:
+		sfui.tusPatch(w, r, clientSecret, clientId, uploadId)
+	case uploadId != "" && r.Method == http.MethodDelete:
+		sfui.tusTerminate(w, clientSecret, clientId, uploadId)
+	default:
+		writeFilesError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (sfui *SfUI) tusCreate(w http.ResponseWriter, r *http.Request, clientSecret string, clientId string) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeFilesError(w, http.StatusBadRequest, "invalid Upload-Length")
+		return
+	}
+
+	if sfui.TusMaxUploadSize > 0 && length > sfui.TusMaxUploadSize {
+		writeFilesError(w, http.StatusRequestEntityTooLarge, "upload too large")
+		return
+	}
+
+	metadata := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	fileName := path.Base(path.Clean("/" + metadata["filename"]))
+	if fileName == "/" || fileName == "." {
+		writeFilesError(w, http.StatusBadRequest, "missing filename in Upload-Metadata")
+		return
+	}
+	destination := path.Join(cleanFilePath(metadata["path"]), fileName)
+
+	client, cerr := sfui.GetClient(clientSecret)
+	if cerr != nil {
+		writeFilesError(w, http.StatusInternalServerError, cerr.Error())
+		return
+	}
+
+	sftpClient, serr := client.SSHConnection.GetSFTPClient()
+	if serr != nil {
+		writeFilesError(w, http.StatusInternalServerError, serr.Error())
+		return
+	}
+
+	// Create (or truncate) the partial file so that offsets start at 0
+	partFile, perr := sftpClient.OpenFile(destination+TUS_PART_SUFFIX, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if perr != nil {
+		writeFilesError(w, http.StatusInternalServerError, perr.Error())
+		return
+	}
+	partFile.Close()
+
+	upload := TusUpload{
+		Id:          RandomStr(33),
+		ClientId:    clientId,
+		Destination: destination,
+		Length:      length,
+		CreatedOn:   time.Now(),
+		LastActive:  time.Now(),
+		mu:          &sync.Mutex{},
+	}
+
+	if aerr := TusUploads.Add(&upload, sfui.TusClientQuota); aerr != nil {
+		sftpClient.Remove(destination + TUS_PART_SUFFIX)
+		writeFilesError(w, http.StatusRequestEntityTooLarge, aerr.Error())
+		return
+	}
+
+	// Zero length uploads are complete on creation
+	if length == 0 {
+		if ferr := tusFinalize(sftpClient, &upload); ferr != nil {
+			writeFilesError(w, http.StatusInternalServerError, ferr.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Location", TUS_PATH_PREFIX+upload.Id)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusHead(w http.ResponseWriter, clientId string, uploadId string) {
+	upload, err := TusUploads.Get(clientId, uploadId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	offset := upload.Offset.Load()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (sfui *SfUI) tusPatch(w http.ResponseWriter, r *http.Request, clientSecret string, clientId string, uploadId string) {
+	if r.Header.Get("Content-Type") != TUS_CHUNK_CT {
+		writeFilesError(w, http.StatusUnsupportedMediaType, "invalid Content-Type")
+		return
+	}
+
+	upload, err := TusUploads.Get(clientId, uploadId)
+	if err != nil {
+		writeFilesError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	// Only one chunk at a time per upload
+	if !upload.mu.TryLock() {
+		writeFilesError(w, http.StatusLocked, "upload is in use")
+		return
+	}
+	defer upload.mu.Unlock()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset.Load() {
+		writeFilesError(w, http.StatusConflict, "offset mismatch")
+		return
+	}
+
+	client, cerr := sfui.GetClient(clientSecret)
+	if cerr != nil {
+		writeFilesError(w, http.StatusInternalServerError, cerr.Error())
+		return
+	}
+
+	sftpClient, serr := client.SSHConnection.GetSFTPClient()
+	if serr != nil {
+		writeFilesError(w, http.StatusInternalServerError, serr.Error())
+		return
+	}
+
+	partFile, perr := sftpClient.OpenFile(upload.Destination+TUS_PART_SUFFIX, os.O_WRONLY|os.O_CREATE)
+	if perr != nil {
+		writeFilesError(w, http.StatusInternalServerError, perr.Error())
+		return
+	}
+	defer partFile.Close()
+
+	// Discard anything past the acknowledged offset, left behind by a interrupted chunk
+	if terr := partFile.Truncate(offset); terr != nil {
+		writeFilesError(w, http.StatusInternalServerError, terr.Error())
+		return
+	}
+	if _, serr := partFile.Seek(offset, io.SeekStart); serr != nil {
+		writeFilesError(w, http.StatusInternalServerError, serr.Error())
+		return
+	}
+
+	// Whatever made it to the instance counts, even if the connection drops mid chunk
+	written, werr := io.Copy(partFile, io.LimitReader(r.Body, upload.Length-offset))
+	offset = upload.Offset.Add(written)
+	upload.LastActive = time.Now()
+	if werr != nil {
+		writeFilesError(w, http.StatusInternalServerError, werr.Error())
+		return
+	}
+
+	if offset == upload.Length {
+		partFile.Close()
+		if ferr := tusFinalize(sftpClient, upload); ferr != nil {
+			writeFilesError(w, http.StatusInternalServerError, ferr.Error())
+			return
+		}
+		MLogger.LogEvent(Metric{Type: METRIC_FILE_UPLOAD, Source: "tus", Size: upload.Length}, client.ClientIp)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (sfui *SfUI) tusTerminate(w http.ResponseWriter, clientSecret string, clientId string, uploadId string) {
+	upload, err := TusUploads.Get(clientId, uploadId)
+	if err != nil {
+		writeFilesError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	TusUploads.Remove(clientId, uploadId)
+
+	if client, cerr := sfui.GetClient(clientSecret); cerr == nil {
+		if sftpClient, serr := client.SSHConnection.GetSFTPClient(); serr == nil {
+			sftpClient.Remove(upload.Destination + TUS_PART_SUFFIX)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Move the completed partial file into place and forget the upload
+func tusFinalize(sftpClient *sftp.Client, upload *TusUpload) error {
+	partPath := upload.Destination + TUS_PART_SUFFIX
+	// posix-rename overwrites an existing destination, plain rename does not
+	if err := sftpClient.PosixRename(partPath, upload.Destination); err != nil {
+		if rerr := sftpClient.Rename(partPath, upload.Destination); rerr != nil {
+			return fmt.Errorf("could not finalize upload: %s", rerr.Error())
+		}
+	}
+	TusUploads.Remove(upload.ClientId, upload.Id)
+	return nil
+}
+
+// Upload-Metadata is a comma separated list of "key base64(value)" pairs
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if kv[0] == "" {
+			continue
+		}
+		if len(kv) == 1 {
+			metadata[kv[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(kv[1])
+		if err == nil {
+			metadata[kv[0]] = string(value)
+		}
+	}
+	return metadata
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   map[string]string
+	}{
+		{"single pair", "filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==", map[string]string{"filename": "world_domination_plan.pdf"}},
+		{"several pairs", "filename YS50eHQ=, filetype dGV4dC9wbGFpbg==", map[string]string{"filename": "a.txt", "filetype": "text/plain"}},
+		{"key without value", "is_confidential,filename YS50eHQ=", map[string]string{"is_confidential": "", "filename": "a.txt"}},
+		{"invalid base64 is skipped", "filename !!!,filetype dGV4dC9wbGFpbg==", map[string]string{"filetype": "text/plain"}},
+		{"empty pairs are skipped", ",, filename YS50eHQ= ,", map[string]string{"filename": "a.txt"}},
+		{"empty value", "filename ", map[string]string{"filename": ""}},
+		{"empty header", "", map[string]string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseTusMetadata(test.header)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseTusMetadata(%q) = %v, want %v", test.header, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsTusPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/files/tus", true},
+		{"/files/tus/", true},
+		{"/files/tus/0123abcd", true},
+		{"/files/tusx", false},
+		{"/files/", false},
+		{"/filebrowser/files/tus", false},
+	}
+
+	for _, test := range tests {
+		if got := isTusPath(test.path); got != test.want {
+			t.Errorf("isTusPath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestTusUploadStoreQuota(t *testing.T) {
+	newUpload := func(id string, length int64, offset int64) *TusUpload {
+		upload := &TusUpload{Id: id, ClientId: "client", Length: length, mu: &sync.Mutex{}}
+		upload.Offset.Store(offset)
+		return upload
+	}
+
+	tests := []struct {
+		name     string
+		existing []*TusUpload
+		length   int64
+		quota    int64
+		accepted bool
+	}{
+		{"no quota", []*TusUpload{newUpload("a", 1000, 0)}, 1000, 0, true},
+		{"within quota", []*TusUpload{newUpload("a", 400, 0)}, 600, 1000, true},
+		{"over quota", []*TusUpload{newUpload("a", 400, 0)}, 601, 1000, false},
+		{"written bytes do not count", []*TusUpload{newUpload("a", 400, 300)}, 900, 1000, true},
+		{"single upload over quota", nil, 1001, 1000, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := TusUploadStore{mu: &sync.Mutex{}, Uploads: make(map[string]map[string]*TusUpload)}
+			for _, upload := range test.existing {
+				if err := store.Add(upload, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := store.Add(newUpload("new", test.length, 0), test.quota)
+			if (err == nil) != test.accepted {
+				t.Fatalf("Add() error = %v, want accepted %v", err, test.accepted)
+			}
+			if _, gerr := store.Get("client", "new"); (gerr == nil) != test.accepted {
+				t.Errorf("Get() error = %v after Add()", gerr)
+			}
+		})
+	}
+
+	store := TusUploadStore{mu: &sync.Mutex{}, Uploads: make(map[string]map[string]*TusUpload)}
+	store.Add(newUpload("a", 10, 0), 0)
+	store.Remove("client", "a")
+	if _, ok := store.Uploads["client"]; ok {
+		t.Error("Remove() left an empty upload map for the client")
+	}
+}
@@ -5,6 +5,7 @@ import { Config } from 'src/environments/environment';
 import { DashboardComponent } from 'src/app/pages/dashboard/dashboard.component';
 import { TerminalViewComponent } from 'src/app/pages/terminal-view/terminal-view.component'
 import { TerminalService } from 'src/app/services/terminal.service';
+import { TokenService } from 'src/app/services/token.service';
 import { ChangeFontSizeDialogComponent } from '../change-font-size-dialog/change-font-size-dialog.component';
 
 @Component({
@@ -61,6 +62,7 @@ export class AppControlsComponent {
     }
 
     localStorage.removeItem("secret")
+    TokenService.clear()
     Config.LoggedIn = false
     this.router.navigate(['/login'])
 
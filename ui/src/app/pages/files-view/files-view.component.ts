@@ -3,6 +3,7 @@ import { DomSanitizer, SafeUrl } from '@angular/platform-browser';
 import { Config } from 'src/environments/environment';
 import { MatSnackBar } from '@angular/material/snack-bar';
 import { TerminalService } from 'src/app/services/terminal.service';
+import { TokenService } from 'src/app/services/token.service';
 
 @Component({
   selector: 'files-view',
@@ -65,17 +66,15 @@ export class FilesViewComponent {
     }
 
     this.FbIframeURL = this.DOMsanitizer.bypassSecurityTrustResourceUrl(
-      "/assets/filebrowser_client/" + indexFile + "#/" + localStorage.getItem("secret")
+      "/assets/filebrowser_client/" + indexFile + "#/" + await TokenService.get('files')
       + ',' + Config.ApiEndpoint
     );
   }
 
   async startFileBrowser() {
     this.FileBrowserDisconnected = false
-    let clientSecret = localStorage.getItem("secret")
-
     let data = {
-      client_secret: clientSecret
+      token: await TokenService.get('files')
     }
 
     fetch(Config.ApiEndpoint + "/filebrowser", {
@@ -6,6 +6,7 @@ import { Router } from '@angular/router';
 import { Config } from 'src/environments/environment';
 import { SaveSecretDialogComponent } from 'src/app/components/save-secret-dialog/save-secret-dialog.component';
 import { DuplicateSessionDialogComponent } from 'src/app/components/duplicate-session-dialog/duplicate-session-dialog.component';
+import { TokenService } from 'src/app/services/token.service';
 
 @Component({
   selector: 'app-login',
@@ -78,7 +79,7 @@ export class LoginComponent {
 
     this.loginDisabled = true
 
-    let loginData = {
+    let loginData: { [key: string]: any } = {
       "secret": this.secret,
       "new_instance": false,
       "tab_id": Config.TabId
@@ -120,14 +121,21 @@ export class LoginComponent {
       timeZone = "ERR"
     }
 
-    let response = fetch(Config.ApiEndpoint + "/secret", {
-      "headers": {
-        "TimeZone": timeZone
-      },
-      "method": "POST",
-      "body": JSON.stringify(loginData)
-    })
-    let rdata = await response
+    let rdata = await this.postLogin(loginData, timeZone)
+
+    // A proof of work is required, solve it and retry once
+    if (rdata.status == 428) {
+      let challengeResponse = await rdata.json()
+      this.logginInMsg.dismiss()
+      this.logginInMsg = this.snackBar.open("Verifying Your Browser ....", "OK", {
+        duration: 60 * 1000
+      });
+      loginData["challenge"] = challengeResponse.challenge.challenge
+      loginData["solution"] = await this.solveChallenge(challengeResponse.challenge.challenge,
+        challengeResponse.challenge.difficulty)
+      rdata = await this.postLogin(loginData, timeZone)
+    }
+
     if (rdata.status == 200) {
       this.logginInMsg.dismiss()
 
@@ -149,6 +157,7 @@ export class LoginComponent {
       }
 
       this.loadingDashBoard = true
+      TokenService.save(response.tokens ?? {}, response.token_expiry ?? 0)
 
       if (this.LoginWithSecret) {
         localStorage.setItem('secret', this.secret)
@@ -165,6 +174,7 @@ export class LoginComponent {
     }
 
     localStorage.removeItem('secret')
+    TokenService.clear()
     this.loginDisabled = false
 
     if (rdata.status==451){
@@ -175,12 +185,64 @@ export class LoginComponent {
       return 
     }
 
+    if (rdata.status == 403 || rdata.status == 428 || rdata.status == 429 || rdata.status == 503) {
+      let response = await rdata.json()
+      this.logginInMsg.dismiss()
+      this.snackBar.open(response.reason ?? response.status, "OK", {
+        duration: 15 * 1000
+      });
+      return
+    }
+
     this.logginInMsg.dismiss()
     this.snackBar.open("Invalid Secret !", "OK", {
       duration: 5 * 1000
     });
   }
 
+  postLogin(loginData: { [key: string]: any }, timeZone: string): Promise<Response> {
+    return fetch(Config.ApiEndpoint + "/secret", {
+      "headers": {
+        "TimeZone": timeZone
+      },
+      "method": "POST",
+      "body": JSON.stringify(loginData)
+    })
+  }
+
+  // Find a solution for which sha256(challenge + ":" + solution) starts with difficulty zero bits.
+  // Hashes are computed in batches, awaiting every digest on its own is several times slower.
+  async solveChallenge(challenge: string, difficulty: number): Promise<string> {
+    const encoder = new TextEncoder()
+    const batchSize = 4096
+    for (let start = 0; ; start += batchSize) {
+      let digests: Promise<ArrayBuffer>[] = []
+      for (let nonce = start; nonce < start + batchSize; nonce++) {
+        digests.push(crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + nonce.toString(36))))
+      }
+
+      let hashes = await Promise.all(digests)
+      for (let i = 0; i < hashes.length; i++) {
+        if (this.leadingZeroBits(new Uint8Array(hashes[i])) >= difficulty) {
+          return (start + i).toString(36)
+        }
+      }
+    }
+  }
+
+  leadingZeroBits(hash: Uint8Array): number {
+    let zeroBits = 0
+    for (let i = 0; i < hash.length; i++) {
+      if (hash[i] == 0) {
+        zeroBits += 8
+        continue
+      }
+      zeroBits += Math.clz32(hash[i]) - 24
+      break
+    }
+    return zeroBits
+  }
+
   async handleDuplicateSession(): Promise<boolean> {
     return new Promise((resolve, reject) => {
       const dialogRef = this.dialog.open(DuplicateSessionDialogComponent, {
@@ -62,7 +62,8 @@ export class SharedDesktopViewComponent {
     switch (rdata.status) {
       case 200:
         this.shareAvailable = true
-        let wsPath = "sharedDesktopWs%3Fsecret%3D" + this.shareSecret + "%26type%3D" + this.desktopType + "%26client%5Fid%3D" + this.clientId
+        let respBody = await rdata.json()
+        let wsPath = "sharedDesktopWs%3Ftoken%3D" + respBody.token + "%26type%3D" + this.desktopType
         this.IframeURL = this.sanitizer.bypassSecurityTrustResourceUrl("/assets/novnc_client/vnc.html?path=" + wsPath
           + "&host=" + Config.ApiHost + "&port=" + Config.ApiPort + "&encrypt=" + this.shouldEncrypt
           + "&autoconnect=true&shared=true&reconnect=false&logging=error&resize=scale");
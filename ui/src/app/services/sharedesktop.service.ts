@@ -1,5 +1,6 @@
 import { Injectable } from '@angular/core';
 import { Config } from 'src/environments/environment';
+import { TokenService } from './token.service';
 
 
 
@@ -13,7 +14,7 @@ export class ShareDesktopService {
 
     async enableSharing(viewOnly: boolean): Promise<number> {
         let data = {
-            "secret": localStorage.getItem('secret'),
+            "token": await TokenService.get('desktop'),
             "action": "activate",
             "view_only": viewOnly
         }
@@ -42,7 +43,7 @@ export class ShareDesktopService {
 
     async disableSharing(): Promise<number> {
         let data = {
-            "secret": localStorage.getItem('secret'),
+            "token": await TokenService.get('desktop'),
             "action": "deactivate",
         }
 
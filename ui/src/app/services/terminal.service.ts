@@ -5,6 +5,7 @@ import { AttachAddonComponent } from '../components/attach-addon/attach-addon.co
 import { WebglAddon } from 'xterm-addon-webgl';
 import { Config } from 'src/environments/environment';
 import { WebLinksAddon } from 'xterm-addon-web-links';
+import { TokenService } from './token.service';
 
 
 class SfTerminal {
@@ -82,14 +83,14 @@ class SfTerminal {
             this.terminal.writeln("Connecting to SFUI Socket...")
             this.terminal.focus()
 
-            //Authenticate using Secret
-            this.socket.onopen = () => {
+            //Authenticate using a terminal token
+            this.socket.onopen = async () => {
                 this.terminal.clear()
                 this.terminal.writeln("Connecting to instance...")
-                const termSecret = {
-                    secret: localStorage.getItem('secret')
+                const termToken = {
+                    token: await TokenService.get('terminal')
                 }
-                this.socket?.send(this.SF_AUTHENTICATE + JSON.stringify(termSecret))
+                this.socket?.send(this.SF_AUTHENTICATE + JSON.stringify(termToken))
                 // Resize Terminal for the first time
                 this.fitAddon.fit();
                 this.connected.emit(true)
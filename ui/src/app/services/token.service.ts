@@ -0,0 +1,51 @@
+import { Config } from 'src/environments/environment';
+
+interface StoredToken {
+    token: string
+    expiry: number // unix time
+}
+
+// Scoped access tokens handed out by /secret on login. They are used in place
+// of the secret for the terminal, desktop and file api and are renewed through
+// /token/refresh shortly before they expire.
+export class TokenService {
+    static readonly REFRESH_MARGIN = 60 // seconds
+
+    static save(tokens: { [scope: string]: string }, expiry: number) {
+        let stored: { [scope: string]: StoredToken } = {}
+        for (let scope in tokens) {
+            stored[scope] = { token: tokens[scope], expiry: expiry }
+        }
+        localStorage.setItem('tokens', JSON.stringify(stored))
+    }
+
+    static clear() {
+        localStorage.removeItem('tokens')
+    }
+
+    // Returns a valid token for the scope, empty if the login has expired
+    static async get(scope: string): Promise<string> {
+        let stored: { [scope: string]: StoredToken } = JSON.parse(localStorage.getItem('tokens') ?? '{}')
+        let current = stored[scope]
+        if (current == undefined) {
+            return ""
+        }
+
+        if (current.expiry - TokenService.REFRESH_MARGIN > Date.now() / 1000) {
+            return current.token
+        }
+
+        let rdata = await fetch(Config.ApiEndpoint + "/token/refresh", {
+            "method": "POST",
+            "body": JSON.stringify({ token: current.token })
+        })
+        if (rdata.status != 200) {
+            return ""
+        }
+
+        let response = await rdata.json()
+        stored[scope] = { token: response.token, expiry: response.token_expiry }
+        localStorage.setItem('tokens', JSON.stringify(stored))
+        return response.token
+    }
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"io"
 	"math/big"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
+	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -26,19 +30,11 @@ func RandomStr(n int) string {
 	return string(s)
 }
 
-func (sfui *SfUI) getClientAddr(r *http.Request) string {
-	if sfui.UseXForwardedForHeader {
-		fwAddr := r.Header.Get("X-Forwarded-For")
-		if fwAddr != "" {
-			fwAddr = strings.ReplaceAll(fwAddr, ":", "") // Go returns address in v6 compatibility mode ':'
-			return strings.ReplaceAll(fwAddr, "f", "")   // remove 'f's
-		}
-	}
-	return strings.Split(r.RemoteAddr, ":")[0] // Remote addr is ip:port, we need only ip
-}
-
-// NewHttpToNetConnProxy : Proxy between http/websocket and net.Conn
-func NewHttpToNetConnProxy(hconn *net.Conn) (*httputil.ReverseProxy, error) {
+// NewSSHReverseProxy : Long lived reverse proxy to a port on the instance, every
+// connection the transport asks for is a fresh direct-tcpip channel over the master
+// SSH connection. Idle connections are kept alive and reused across requests, WebSocket
+// upgrades are handled by httputil.ReverseProxy itself.
+func NewSSHReverseProxy(sshConnection *SSHConnection, port uint16) (*httputil.ReverseProxy, error) {
 	// Target Url value is never used since we use a custom Dial, but it has to specified anyhow
 	targetUrl := "http://127.0.0.1:8080"
 	target, err := url.Parse(targetUrl)
@@ -49,11 +45,19 @@ func NewHttpToNetConnProxy(hconn *net.Conn) (*httputil.ReverseProxy, error) {
 	proxy := httputil.NewSingleHostReverseProxy(target)
 
 	proxy.Transport = &http.Transport{
-		Dial: func(proto, addr string) (conn net.Conn, err error) {
-			return *hconn, nil
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if !sshConnection.Connected.Load() {
+				return nil, errors.New("connection is not active yet")
+			}
+			conn, err := sshConnection.ForwardRemotePort(ctx, port)
+			if err != nil {
+				return nil, err
+			}
+			return *conn, nil
 		},
 		ForceAttemptHTTP2:     false,
 		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32, // every request goes to the same "host"
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
@@ -62,20 +66,57 @@ func NewHttpToNetConnProxy(hconn *net.Conn) (*httputil.ReverseProxy, error) {
 	return proxy, nil
 }
 
-// copyCh is like io.Copy, but it writes to a channel when finished.
-func copyCh(dst io.Writer, src io.Reader, done chan error) {
-	buf := make([]byte, 32*1024)
-	_, err := io.CopyBuffer(dst, src, buf)
-	done <- err
+// Close idle connections held by a proxy created with NewSSHReverseProxy
+func CloseReverseProxy(proxy *httputil.ReverseProxy) {
+	if proxy == nil {
+		return
+	}
+	if transport, ok := proxy.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
 }
 
-func GetCountryByIp(ip string) string {
-	countryCode, err := GeoIpLookup(ip)
+// Write data to a temporary file in the same directory and rename it over
+// path, readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
 	if err != nil {
-		return "WORLD"
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
 	}
-	if countryCode == "" {
-		return "LOCAL"
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
 	}
-	return countryCode
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// Rename a file that could not be loaded so that it is not overwritten,
+// returns the new path
+func moveAside(path string) (string, error) {
+	aside := fmt.Sprintf("%s.invalid-%d", path, time.Now().Unix())
+	return aside, os.Rename(path, aside)
+}
+
+// copyCh is like io.Copy, but it writes to a channel when finished.
+func copyCh(dst io.Writer, src io.Reader, done chan error) {
+	buf := make([]byte, 32*1024)
+	_, err := io.CopyBuffer(dst, src, buf)
+	done <- err
 }
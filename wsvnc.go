@@ -60,16 +60,27 @@ func wsProxyHandler(conn *net.Conn, viewOnly bool, isSharedConnection bool, clos
 		ws.PayloadType = websocket.BinaryFrame
 		done := make(chan error)
 
+		channel := PROM_CHANNEL_DESKTOP
+		activeGauge := promDesktopsActive
+		if isSharedConnection {
+			channel = PROM_CHANNEL_SHARED_DESKTOP
+			activeGauge = promSharedViewersActive
+		}
+		activeGauge.Inc()
+		defer activeGauge.Dec()
+		fromServer := &promCountingReader{Reader: *conn, channel: channel, direction: PROM_DIRECTION_OUT}
+
 		if viewOnly {
 			viewOnlyConn := ViewOnlyConn{
 				Ws:     ws,
 				MsgBuf: make([]byte, 256),
 			}
-			go copyCh(*conn, &viewOnlyConn, done) // Use custom Read() function to filter out input
-			go copyCh(ws, *conn, done)
+			// Use custom Read() function to filter out input
+			go copyCh(*conn, &promCountingReader{Reader: &viewOnlyConn, channel: channel, direction: PROM_DIRECTION_IN}, done)
+			go copyCh(ws, fromServer, done)
 		} else {
-			go copyCh(*conn, ws, done)
-			go copyCh(ws, *conn, done)
+			go copyCh(*conn, &promCountingReader{Reader: ws, channel: channel, direction: PROM_DIRECTION_IN}, done)
+			go copyCh(ws, fromServer, done)
 		}
 
 		timeout := time.NewTimer(timeoutDuration)